@@ -7,7 +7,7 @@ if [ "$(uname)" == "Darwin" ]; then
 fi
 
 ORG_PATH="github.com/linkernetworks"
-export REPO_PATH="${ORG_PATH}/plugins"
+export REPO_PATH="${ORG_PATH}/cni"
 
 if [ ! -h gopath/src/${REPO_PATH} ]; then
 	mkdir -p gopath/src/${ORG_PATH}
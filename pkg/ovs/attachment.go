@@ -0,0 +1,157 @@
+package ovs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Attachment is a container port cnie added to a bridge, as recorded in its
+// external ids
+type Attachment struct {
+	Bridge      string `json:"bridge"`
+	Port        string `json:"port"`
+	ContainerID string `json:"containerId"`
+	IfName      string `json:"ifName"`
+	IPs         string `json:"ips"`
+	PortGroup   string `json:"portGroup,omitempty"`
+	Uplink      string `json:"uplink,omitempty"`
+}
+
+// ListAttachments returns the cnie managed ports of all bridges. It only
+// reads OVSDB, so ports whose interface has disappeared are listed as well.
+func ListAttachments() ([]Attachment, error) {
+	bridges, err := listTable("bridge", "name", "ports")
+	if err != nil {
+		return nil, err
+	}
+	portBridge := map[string]string{}
+	for _, row := range bridges {
+		var name string
+		if err := json.Unmarshal(row[0], &name); err != nil {
+			return nil, fmt.Errorf("failed to parse bridge name: %v", err)
+		}
+		uuids, err := parseUUIDSet(row[1])
+		if err != nil {
+			return nil, err
+		}
+		for _, uuid := range uuids {
+			portBridge[uuid] = name
+		}
+	}
+
+	ports, err := listTable("port", "_uuid", "name", "external_ids")
+	if err != nil {
+		return nil, err
+	}
+	var attachments []Attachment
+	for _, row := range ports {
+		uuids, err := parseUUIDSet(row[0])
+		if err != nil || len(uuids) != 1 {
+			return nil, fmt.Errorf("failed to parse port uuid: %s", row[0])
+		}
+		var name string
+		if err := json.Unmarshal(row[1], &name); err != nil {
+			return nil, fmt.Errorf("failed to parse port name: %v", err)
+		}
+		ids, err := parseMapColumn(row[2])
+		if err != nil {
+			return nil, err
+		}
+		if ids[ContainerIDKey] == "" {
+			continue
+		}
+		attachments = append(attachments, Attachment{
+			Bridge:      portBridge[uuids[0]],
+			Port:        name,
+			ContainerID: ids[ContainerIDKey],
+			IfName:      ids[IfNameKey],
+			IPs:         ids[IPsKey],
+			PortGroup:   ids[PortGroupKey],
+			Uplink:      ids[UplinkKey],
+		})
+	}
+
+	sort.Slice(attachments, func(i, j int) bool {
+		if attachments[i].Bridge != attachments[j].Bridge {
+			return attachments[i].Bridge < attachments[j].Bridge
+		}
+		return attachments[i].Port < attachments[j].Port
+	})
+	return attachments, nil
+}
+
+// listTable returns the given columns of every row of an OVSDB table, each
+// cell still in the OVSDB JSON notation
+func listTable(table string, columns ...string) ([][]json.RawMessage, error) {
+	args := []string{"--format=json", "--columns=" + strings.Join(columns, ","), "list", table}
+	out, err := run("ovs-vsctl", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %v", table, err)
+	}
+	var res struct {
+		Data [][]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return nil, fmt.Errorf("failed to parse %s table: %v", table, err)
+	}
+	for _, row := range res.Data {
+		if len(row) != len(columns) {
+			return nil, fmt.Errorf("unexpected %s row %v", table, row)
+		}
+	}
+	return res.Data, nil
+}
+
+// parseUUIDSet parses ["uuid","x"] or ["set",[["uuid","x"],...]]
+func parseUUIDSet(cell json.RawMessage) ([]string, error) {
+	var v []json.RawMessage
+	if err := json.Unmarshal(cell, &v); err != nil || len(v) != 2 {
+		return nil, fmt.Errorf("malformed uuid set %s", cell)
+	}
+	var kind string
+	if err := json.Unmarshal(v[0], &kind); err != nil {
+		return nil, fmt.Errorf("malformed uuid set %s", cell)
+	}
+	switch kind {
+	case "uuid":
+		var uuid string
+		if err := json.Unmarshal(v[1], &uuid); err != nil {
+			return nil, fmt.Errorf("malformed uuid %s", cell)
+		}
+		return []string{uuid}, nil
+	case "set":
+		var pairs [][2]string
+		if err := json.Unmarshal(v[1], &pairs); err != nil {
+			return nil, fmt.Errorf("malformed uuid set %s", cell)
+		}
+		uuids := make([]string, 0, len(pairs))
+		for _, p := range pairs {
+			uuids = append(uuids, p[1])
+		}
+		return uuids, nil
+	}
+	return nil, fmt.Errorf("malformed uuid set %s", cell)
+}
+
+// parseMapColumn parses ["map",[["k","v"],...]]
+func parseMapColumn(cell json.RawMessage) (map[string]string, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(cell, &raw); err != nil || len(raw) != 2 {
+		return nil, fmt.Errorf("malformed map %s", cell)
+	}
+	var kind string
+	var pairs [][2]string
+	if err := json.Unmarshal(raw[0], &kind); err != nil || kind != "map" {
+		return nil, fmt.Errorf("malformed map %s", cell)
+	}
+	if err := json.Unmarshal(raw[1], &pairs); err != nil {
+		return nil, fmt.Errorf("malformed map %s", cell)
+	}
+	m := make(map[string]string, len(pairs))
+	for _, p := range pairs {
+		m[p[0]] = p[1]
+	}
+	return m, nil
+}
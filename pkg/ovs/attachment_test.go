@@ -0,0 +1,54 @@
+package ovs
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseUUIDSet(t *testing.T) {
+	tests := []struct {
+		cell    string
+		want    []string
+		wantErr bool
+	}{
+		{`["uuid","a"]`, []string{"a"}, false},
+		{`["set",[]]`, []string{}, false},
+		{`["set",[["uuid","a"],["uuid","b"]]]`, []string{"a", "b"}, false},
+		{`["map",[]]`, nil, true},
+		{`["uuid"]`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseUUIDSet(json.RawMessage(tt.cell))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseUUIDSet(%s) error = %v, want error %t", tt.cell, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseUUIDSet(%s) = %v, want %v", tt.cell, got, tt.want)
+		}
+	}
+}
+
+func TestParseMapColumn(t *testing.T) {
+	tests := []struct {
+		cell    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{`["map",[]]`, map[string]string{}, false},
+		{`["map",[["cnie-owner","c1/eth0"],["iface-id","x"]]]`, map[string]string{"cnie-owner": "c1/eth0", "iface-id": "x"}, false},
+		{`["set",[]]`, nil, true},
+		{`["map",[["k",1]]]`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseMapColumn(json.RawMessage(tt.cell))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseMapColumn(%s) error = %v, want error %t", tt.cell, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseMapColumn(%s) = %v, want %v", tt.cell, got, tt.want)
+		}
+	}
+}
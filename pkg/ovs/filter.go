@@ -0,0 +1,64 @@
+package ovs
+
+import (
+	"fmt"
+	"net"
+)
+
+// egressFilterFlows are the flows FilterEgress installs for ofport. Denied
+// destinations are dropped above every flow passing traffic on. With allowed
+// destinations the rest of the port's IP traffic is dropped too, except
+// neighbor discovery, which IPv6 cannot do without.
+func egressFilterFlows(ofport int, allow, deny []*net.IPNet) []string {
+	var flows []string
+	for _, subnet := range deny {
+		flows = append(flows, fmt.Sprintf("priority=290,%s,in_port=%d,%s=%s,actions=drop", ipProto(subnet), ofport, ipDst(subnet), subnet))
+	}
+	if len(allow) == 0 {
+		return flows
+	}
+	for _, subnet := range allow {
+		flows = append(flows, fmt.Sprintf("priority=280,%s,in_port=%d,vlan_tci=0x0000/0x1fff,%s=%s,actions=normal", ipProto(subnet), ofport, ipDst(subnet), subnet))
+	}
+	// router and neighbor solicitations and advertisements
+	for _, icmpType := range []int{133, 134, 135, 136} {
+		flows = append(flows, fmt.Sprintf("priority=280,icmp6,in_port=%d,vlan_tci=0x0000/0x1fff,icmp_type=%d,actions=normal", ofport, icmpType))
+	}
+	for _, proto := range []string{"ip", "ipv6"} {
+		flows = append(flows, fmt.Sprintf("priority=270,%s,in_port=%d,actions=drop", proto, ofport))
+	}
+	return flows
+}
+
+// FilterEgress installs the flows dropping the IP traffic port sends to the
+// deny subnets and, if allow is not empty, to anything but the allow
+// subnets. A destination in both is denied. Allowed traffic goes to NORMAL
+// switching.
+func (f *Flows) FilterEgress(port string, allow, deny []*net.IPNet) error {
+	ofport, err := f.sw.OFPort(port)
+	if err != nil {
+		return err
+	}
+	for _, flow := range egressFilterFlows(ofport, allow, deny) {
+		if err := f.Add(flow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ipProto is the ovs-ofctl protocol of the IP version of subnet
+func ipProto(subnet *net.IPNet) string {
+	if subnet.IP.To4() == nil {
+		return "ipv6"
+	}
+	return "ip"
+}
+
+// ipDst is the ovs-ofctl destination field of the IP version of subnet
+func ipDst(subnet *net.IPNet) string {
+	if subnet.IP.To4() == nil {
+		return "ipv6_dst"
+	}
+	return "nw_dst"
+}
@@ -0,0 +1,55 @@
+package ovs
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestEgressFilterFlows(t *testing.T) {
+	cidrs := func(ss ...string) []*net.IPNet {
+		var nets []*net.IPNet
+		for _, s := range ss {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nets = append(nets, n)
+		}
+		return nets
+	}
+	tests := []struct {
+		name        string
+		allow, deny []*net.IPNet
+		want        []string
+	}{
+		{"none", nil, nil, nil},
+		{
+			"deny only",
+			nil, cidrs("169.254.169.254/32", "fd00:ec2::/64"),
+			[]string{
+				"priority=290,ip,in_port=3,nw_dst=169.254.169.254/32,actions=drop",
+				"priority=290,ipv6,in_port=3,ipv6_dst=fd00:ec2::/64,actions=drop",
+			},
+		},
+		{
+			"allow and deny",
+			cidrs("10.0.0.0/8"), cidrs("10.1.0.0/16"),
+			[]string{
+				"priority=290,ip,in_port=3,nw_dst=10.1.0.0/16,actions=drop",
+				"priority=280,ip,in_port=3,vlan_tci=0x0000/0x1fff,nw_dst=10.0.0.0/8,actions=normal",
+				"priority=280,icmp6,in_port=3,vlan_tci=0x0000/0x1fff,icmp_type=133,actions=normal",
+				"priority=280,icmp6,in_port=3,vlan_tci=0x0000/0x1fff,icmp_type=134,actions=normal",
+				"priority=280,icmp6,in_port=3,vlan_tci=0x0000/0x1fff,icmp_type=135,actions=normal",
+				"priority=280,icmp6,in_port=3,vlan_tci=0x0000/0x1fff,icmp_type=136,actions=normal",
+				"priority=270,ip,in_port=3,actions=drop",
+				"priority=270,ipv6,in_port=3,actions=drop",
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := egressFilterFlows(3, tt.allow, tt.deny); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: egressFilterFlows = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
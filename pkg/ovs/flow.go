@@ -0,0 +1,310 @@
+package ovs
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// cnie claims the top 16 bits of the flow cookies it installs, the other 48
+// are a hash of the flow owner. A dump-flows with
+// cookie=0xc1e0000000000000/0xffff000000000000 shows every cnie flow.
+const (
+	CookieTag  uint64 = 0xc1e0 << 48
+	CookieMask uint64 = 0xffff << 48
+)
+
+// Cookie returns the flow cookie of the flows installed for owner
+func Cookie(owner string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(owner))
+	return CookieTag | h.Sum64()&^CookieMask
+}
+
+// OFPort returns the OpenFlow port number OVS assigned to port
+func (sw *Switch) OFPort(port string) (int, error) {
+	out, err := sw.vsctl("get", "interface", port, "ofport")
+	if err != nil {
+		return 0, fmt.Errorf("failed to get ofport of %q: %v", port, err)
+	}
+	ofport, err := strconv.Atoi(string(out))
+	if err != nil || ofport <= 0 {
+		return 0, fmt.Errorf("port %q has no valid ofport: %q", port, out)
+	}
+	return ofport, nil
+}
+
+// WaitOFPort ovs-vsctl --timeout=N wait-until interface eth0 ofport>0
+// OVS assigns the ofport of a new port asynchronously, flows matching the
+// port need it first.
+func (sw *Switch) WaitOFPort(port string, timeout int) error {
+	if _, err := sw.vsctl(fmt.Sprintf("--timeout=%d", timeout), "wait-until", "interface", port, "ofport>0"); err != nil {
+		return fmt.Errorf("port %q got no ofport within %ds: %v", port, timeout, err)
+	}
+	return nil
+}
+
+// AddFlow ovs-ofctl add-flow br0 "priority=100,in_port=1,actions=normal"
+func (sw *Switch) AddFlow(flow string) error {
+	if _, err := sw.ofctl("add-flow", sw.bridgeName, flow); err != nil {
+		return fmt.Errorf("failed to add flow: %v", err)
+	}
+	return nil
+}
+
+// AddNormalFlow ovs-ofctl add-flow br0 "priority=0,actions=normal"
+// Every flow of a higher priority, such as cnie's per-port flows, wins over
+// it.
+func (sw *Switch) AddNormalFlow() error {
+	return sw.AddFlow("priority=0,actions=normal")
+}
+
+// DeleteFlows ovs-ofctl del-flows br0 "in_port=1"
+func (sw *Switch) DeleteFlows(match string) error {
+	if _, err := sw.ofctl("del-flows", sw.bridgeName, match); err != nil {
+		return fmt.Errorf("failed to delete flows: %v", err)
+	}
+	return nil
+}
+
+// DeleteCookieFlows removes all flows carrying exactly cookie
+func (sw *Switch) DeleteCookieFlows(cookie uint64) error {
+	return sw.DeleteFlows(fmt.Sprintf("cookie=%#x/-1", cookie))
+}
+
+// Flows adds and removes the flows of one owner on the bridge. Every flow it
+// adds carries the owner's cookie, so removing them never touches flows of
+// other owners or of a controller.
+type Flows struct {
+	sw     *Switch
+	cookie uint64
+	// queue is the bandwidth queue of the owner's port, 0 for none
+	queue int
+}
+
+// Flows returns the flows of owner on the bridge
+func (sw *Switch) Flows(owner string) *Flows {
+	return &Flows{sw: sw, cookie: Cookie(owner)}
+}
+
+// Cookie returns the cookie of the owner's flows
+func (f *Flows) Cookie() uint64 {
+	return f.cookie
+}
+
+// SetQueue makes the flows forwarding what the owner's port sends put it
+// into queue id first. They sit above the flow of AddPortQueue, which
+// would not see the traffic otherwise. 0 is no queue.
+func (f *Flows) SetQueue(id int) {
+	f.queue = id
+}
+
+// forward prefixes actions passing a packet on with the owner's queue
+func (f *Flows) forward(actions string) string {
+	if f.queue == 0 {
+		return actions
+	}
+	return fmt.Sprintf("set_queue:%d,%s", f.queue, actions)
+}
+
+// Add installs flow, given without a cookie, under the owner's cookie
+func (f *Flows) Add(flow string) error {
+	return f.sw.AddFlow(fmt.Sprintf("cookie=%#x,%s", f.cookie, flow))
+}
+
+// Delete removes the owner's flows, matched by the whole cookie so a flow of
+// someone else whose cookie shares the hash bits stays
+func (f *Flows) Delete() error {
+	return f.sw.DeleteCookieFlows(f.cookie)
+}
+
+// DeleteStrict ovs-ofctl --strict del-flows br0 "cookie=...,priority=100,in_port=1"
+// It removes the owner's flow whose match and priority are exactly those of
+// match, leaving the owner's other flows and those of others alone.
+func (f *Flows) DeleteStrict(match string) error {
+	if _, err := f.sw.ofctl("--strict", "del-flows", f.sw.bridgeName, fmt.Sprintf("cookie=%#x/-1,%s", f.cookie, match)); err != nil {
+		return fmt.Errorf("failed to delete flow: %v", err)
+	}
+	return nil
+}
+
+// Dump returns the owner's flows as ovs-ofctl dump-flows prints them
+func (f *Flows) Dump() ([]string, error) {
+	out, err := f.sw.ofctl("dump-flows", f.sw.bridgeName, fmt.Sprintf("cookie=%#x/-1", f.cookie))
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump flows: %v", err)
+	}
+	var flows []string
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		// the reply header, e.g. NXST_FLOW reply (xid=0x4):
+		if line == "" || strings.Contains(line, "reply") {
+			continue
+		}
+		flows = append(flows, line)
+	}
+	return flows, nil
+}
+
+// PinPort installs the flows switching what port sends and what is sent to
+// mac with NORMAL that a flow table evicting under its flow limit keeps:
+// they never time out and have the highest importance, so a controller's
+// idle-evicted flows for the port do not cost the next packet a miss. They
+// sit below every other flow of cnie and only matter where no other flow
+// matches. importance needs OpenFlow 1.4.
+func (f *Flows) PinPort(port, mac string) error {
+	ofport, err := f.sw.OFPort(port)
+	if err != nil {
+		return err
+	}
+	for _, match := range []string{fmt.Sprintf("in_port=%d", ofport), "dl_dst=" + mac} {
+		flow := fmt.Sprintf("cookie=%#x,priority=50,%s,idle_timeout=0,hard_timeout=0,importance=65535,actions=normal", f.cookie, match)
+		if _, err := f.sw.ofctl("-O", "OpenFlow14", "add-flow", f.sw.bridgeName, flow); err != nil {
+			return fmt.Errorf("failed to add flow: %v", err)
+		}
+	}
+	return nil
+}
+
+// IsolatePort installs the flows confining port to its access VLAN: frames
+// it sends untagged go to NORMAL, which only forwards them within the port's
+// VLAN, and anything else it sends is dropped.
+func (f *Flows) IsolatePort(port string) error {
+	ofport, err := f.sw.OFPort(port)
+	if err != nil {
+		return err
+	}
+	for _, flow := range []string{
+		fmt.Sprintf("priority=200,in_port=%d,vlan_tci=0x0000/0x1fff,actions=%s", ofport, f.forward("normal")),
+		fmt.Sprintf("priority=190,in_port=%d,actions=drop", ofport),
+	} {
+		if err := f.Add(flow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockMatches are the matches of the flows BlockPort installs
+func blockMatches(ofport int, mac string) []string {
+	matches := []string{fmt.Sprintf("priority=400,in_port=%d", ofport)}
+	if mac != "" {
+		matches = append(matches, fmt.Sprintf("priority=400,dl_dst=%s", mac))
+	}
+	return matches
+}
+
+// BlockPort installs flows dropping everything port sends and everything
+// sent to mac, ahead of every other flow of cnie. UnblockPort removes them.
+func (f *Flows) BlockPort(port, mac string) error {
+	ofport, err := f.sw.OFPort(port)
+	if err != nil {
+		return err
+	}
+	for _, match := range blockMatches(ofport, mac) {
+		if err := f.Add(match + ",actions=drop"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnblockPort removes exactly the flows BlockPort installed, leaving the
+// owner's other flows in place
+func (f *Flows) UnblockPort(port, mac string) error {
+	ofport, err := f.sw.OFPort(port)
+	if err != nil {
+		return err
+	}
+	for _, match := range blockMatches(ofport, mac) {
+		flow := fmt.Sprintf("cookie=%#x/-1,%s", f.cookie, match)
+		if _, err := f.sw.ofctl("--strict", "del-flows", f.sw.bridgeName, flow); err != nil {
+			return fmt.Errorf("failed to delete flow %q: %v", flow, err)
+		}
+	}
+	return nil
+}
+
+// DrainPort installs flows dropping the TCP SYNs port sends and the ones sent
+// to mac, so no new connections start while established ones keep flowing.
+func (f *Flows) DrainPort(port, mac string) error {
+	ofport, err := f.sw.OFPort(port)
+	if err != nil {
+		return err
+	}
+	var flows []string
+	for _, proto := range []string{"tcp", "tcp6"} {
+		flows = append(flows, fmt.Sprintf("priority=300,%s,in_port=%d,tcp_flags=+syn-ack,actions=drop", proto, ofport))
+		if mac != "" {
+			flows = append(flows, fmt.Sprintf("priority=300,%s,dl_dst=%s,tcp_flags=+syn-ack,actions=drop", proto, mac))
+		}
+	}
+	for _, flow := range flows {
+		if err := f.Add(flow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SteerToUplink installs flows sending the IP traffic port sends untagged
+// out of uplink, tagged with vlan if it is not 0. Traffic to local subnets
+// still goes through NORMAL switching, as does everything that is not IP.
+func (f *Flows) SteerToUplink(port, uplink string, vlan int, local []*net.IPNet) error {
+	ofport, err := f.sw.OFPort(port)
+	if err != nil {
+		return err
+	}
+	uplinkPort, err := f.sw.OFPort(uplink)
+	if err != nil {
+		return err
+	}
+	output := fmt.Sprintf("output:%d", uplinkPort)
+	if vlan != 0 {
+		output = fmt.Sprintf("mod_vlan_vid:%d,%s", vlan, output)
+	}
+	output = f.forward(output)
+	var flows []string
+	for _, subnet := range local {
+		dst := "ip,nw_dst"
+		if subnet.IP.To4() == nil {
+			dst = "ipv6,ipv6_dst"
+		}
+		flows = append(flows, fmt.Sprintf("priority=216,in_port=%d,vlan_tci=0x0000/0x1fff,%s=%s,actions=%s", ofport, dst, subnet, f.forward("normal")))
+	}
+	for _, proto := range []string{"ip", "ipv6"} {
+		flows = append(flows, fmt.Sprintf("priority=215,%s,in_port=%d,vlan_tci=0x0000/0x1fff,actions=%s", proto, ofport, output))
+	}
+	for _, flow := range flows {
+		if err := f.Add(flow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkDSCP installs flows setting the DSCP of the IPv4 and IPv6 packets port
+// sends untagged before NORMAL switching. They sit above the isolation and
+// meter flows so an isolated port is marked as well; a non-zero meter is
+// applied to the marked packets too.
+func (f *Flows) MarkDSCP(port string, dscp int, meter uint32) error {
+	ofport, err := f.sw.OFPort(port)
+	if err != nil {
+		return err
+	}
+	for _, proto := range []string{"ip", "ipv6"} {
+		// mod_nw_tos takes the whole TOS byte, DSCP is its upper six bits
+		actions := f.forward(fmt.Sprintf("mod_nw_tos:%d,normal", dscp<<2))
+		if meter == 0 {
+			err = f.Add(fmt.Sprintf("priority=210,%s,in_port=%d,vlan_tci=0x0000/0x1fff,actions=%s", proto, ofport, actions))
+		} else {
+			err = f.addOF13(fmt.Sprintf("priority=210,%s,in_port=%d,vlan_tci=0x0000/0x1fff,actions=meter:%d,%s", proto, ofport, meter, actions))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package ovs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCookie(t *testing.T) {
+	owners := []string{"", "c1/eth0", "c1/net1", "c2/eth0", natOwner, natOwner + "/192.168.1.10"}
+	seen := map[uint64]string{}
+	for _, owner := range owners {
+		c := Cookie(owner)
+		if c&CookieMask != CookieTag {
+			t.Errorf("Cookie(%q) = %#x, want the tag %#x in the top 16 bits", owner, c, CookieTag)
+		}
+		if c != Cookie(owner) {
+			t.Errorf("Cookie(%q) is not stable", owner)
+		}
+		if other, ok := seen[c]; ok {
+			t.Errorf("owners %q and %q share the cookie %#x", owner, other, c)
+		}
+		seen[c] = owner
+	}
+}
+
+func TestForward(t *testing.T) {
+	tests := []struct {
+		queue int
+		want  string
+	}{
+		{0, "normal"},
+		{3, "set_queue:3,normal"},
+	}
+	for _, tt := range tests {
+		f := (&Switch{}).Flows("c1/eth0")
+		f.SetQueue(tt.queue)
+		if got := f.forward("normal"); got != tt.want {
+			t.Errorf("queue %d: forward = %q, want %q", tt.queue, got, tt.want)
+		}
+	}
+}
+
+func TestBlockMatches(t *testing.T) {
+	tests := []struct {
+		mac  string
+		want []string
+	}{
+		{"", []string{"priority=400,in_port=5"}},
+		{"02:00:00:00:00:05", []string{"priority=400,in_port=5", "priority=400,dl_dst=02:00:00:00:00:05"}},
+	}
+	for _, tt := range tests {
+		if got := blockMatches(5, tt.mac); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("blockMatches(5, %q) = %q, want %q", tt.mac, got, tt.want)
+		}
+	}
+}
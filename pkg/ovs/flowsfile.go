@@ -0,0 +1,96 @@
+package ovs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+)
+
+// FlowVars are what a flows file can refer to, e.g. in_port={{.OFPort}}
+type FlowVars struct {
+	// OFPort is the ofport of the container port
+	OFPort int
+	// Cookie is the attachment's flow cookie in hex, for actions such as
+	// learn() that install flows of their own
+	Cookie string
+	Port   string
+	MAC    string
+	Vlan   int
+}
+
+// FlowsTemplate is a parsed flows file
+type FlowsTemplate struct {
+	path string
+	tmpl *template.Template
+}
+
+// LoadFlowsTemplate reads the flows file at path, ovs-ofctl flows one per
+// line as a text/template over FlowVars. Blank lines and lines starting
+// with # are skipped. It fails unless the file renders into flows Add can
+// install, which must not set a cookie of their own.
+func LoadFlowsTemplate(path string) (*FlowsTemplate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read flows file: %v", err)
+	}
+	tmpl, err := template.New(path).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse flows file %q: %v", path, err)
+	}
+	t := &FlowsTemplate{path: path, tmpl: tmpl}
+	if _, err := t.Render(FlowVars{OFPort: 1, Cookie: "0x0", Port: "port", MAC: "02:00:00:00:00:01"}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Render returns the flows of the file for vars
+func (t *FlowsTemplate) Render(vars FlowVars) ([]string, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, vars); err != nil {
+		return nil, fmt.Errorf("failed to render flows file %q: %v", t.path, err)
+	}
+	var flows []string
+	for i, line := range strings.Split(buf.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.Contains(line, "actions=") {
+			return nil, fmt.Errorf("flows file %q line %d has no actions: %q", t.path, i+1, line)
+		}
+		match := line[:strings.Index(line, "actions=")]
+		if strings.HasPrefix(match, "cookie=") || strings.Contains(match, ",cookie=") {
+			return nil, fmt.Errorf("flows file %q line %d sets a cookie, the attachment's is added", t.path, i+1)
+		}
+		flows = append(flows, line)
+	}
+	return flows, nil
+}
+
+// AddTemplate installs the flows t renders for port under the owner's
+// cookie
+func (f *Flows) AddTemplate(t *FlowsTemplate, port, mac string, vlan int) error {
+	ofport, err := f.sw.OFPort(port)
+	if err != nil {
+		return err
+	}
+	flows, err := t.Render(FlowVars{
+		OFPort: ofport,
+		Cookie: fmt.Sprintf("%#x", f.cookie),
+		Port:   port,
+		MAC:    mac,
+		Vlan:   vlan,
+	})
+	if err != nil {
+		return err
+	}
+	for _, flow := range flows {
+		if err := f.Add(flow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package ovs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFlowsTemplateRender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cnie-flows")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	vars := FlowVars{OFPort: 7, Cookie: "0xc1e0000000000001", Port: "veth1", MAC: "02:00:00:00:00:07", Vlan: 100}
+	tests := []struct {
+		name  string
+		flows string
+		want  []string
+		err   string
+	}{
+		{
+			"flows",
+			"# drop what is not the container's\n\npriority=120,in_port={{.OFPort}},dl_src={{.MAC}},actions=normal\n  priority=110,in_port={{.OFPort}},actions=drop  \n",
+			[]string{
+				"priority=120,in_port=7,dl_src=02:00:00:00:00:07,actions=normal",
+				"priority=110,in_port=7,actions=drop",
+			},
+			"",
+		},
+		{
+			"learn",
+			"priority=120,in_port={{.OFPort}},actions=learn(cookie={{.Cookie}},table=1,NXM_OF_ETH_DST[]=NXM_OF_ETH_SRC[]),normal\n",
+			[]string{"priority=120,in_port=7,actions=learn(cookie=0xc1e0000000000001,table=1,NXM_OF_ETH_DST[]=NXM_OF_ETH_SRC[]),normal"},
+			"",
+		},
+		{"no actions", "priority=120,in_port={{.OFPort}}\n", nil, "line 1 has no actions"},
+		{"cookie", "# comment\ncookie=0x1,priority=120,actions=drop\n", nil, "line 2 sets a cookie"},
+		{"cookie in match", "priority=120,cookie=0x1,actions=drop\n", nil, "line 1 sets a cookie"},
+		{"unknown var", "priority=120,in_port={{.Bridge}},actions=drop\n", nil, "failed to render"},
+		{"bad template", "priority=120,in_port={{.OFPort,actions=drop\n", nil, "failed to parse"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.Repeat("f", i+1))
+			if err := ioutil.WriteFile(path, []byte(tt.flows), 0600); err != nil {
+				t.Fatal(err)
+			}
+			tmpl, err := LoadFlowsTemplate(path)
+			if err == nil {
+				var flows []string
+				flows, err = tmpl.Render(vars)
+				if err == nil && !reflect.DeepEqual(flows, tt.want) {
+					t.Errorf("Render = %q, want %q", flows, tt.want)
+				}
+			}
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error = %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
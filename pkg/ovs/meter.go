@@ -0,0 +1,51 @@
+package ovs
+
+import (
+	"fmt"
+)
+
+// AddMeter ovs-ofctl -O OpenFlow13 add-meter br0 meter=1,kbps,burst,band=type=drop,rate=1000,burst_size=100
+// rate is in kbit/s and burst in kbit, 0 leaves the burst to the datapath.
+// A meter already using id is replaced, which also removes its flows.
+func (sw *Switch) AddMeter(id uint32, rate, burst uint64) error {
+	if err := sw.DeleteMeter(id); err != nil {
+		return err
+	}
+	meter := fmt.Sprintf("meter=%d,kbps,band=type=drop,rate=%d", id, rate)
+	if burst > 0 {
+		meter = fmt.Sprintf("meter=%d,kbps,burst,band=type=drop,rate=%d,burst_size=%d", id, rate, burst)
+	}
+	if _, err := sw.ofctl("-O", "OpenFlow13", "add-meter", sw.bridgeName, meter); err != nil {
+		return fmt.Errorf("failed to add meter %d: %v", id, err)
+	}
+	return nil
+}
+
+// DeleteMeter ovs-ofctl -O OpenFlow13 del-meter br0 meter=1
+// Deleting a meter that does not exist succeeds.
+func (sw *Switch) DeleteMeter(id uint32) error {
+	if _, err := sw.ofctl("-O", "OpenFlow13", "del-meter", sw.bridgeName, fmt.Sprintf("meter=%d", id)); err != nil {
+		return fmt.Errorf("failed to delete meter %d: %v", id, err)
+	}
+	return nil
+}
+
+// MeterPort installs the flow passing everything port sends untagged through
+// meter before NORMAL switching. It sits above the isolation flows, which
+// still drop what the port sends tagged.
+func (f *Flows) MeterPort(port string, meter uint32) error {
+	ofport, err := f.sw.OFPort(port)
+	if err != nil {
+		return err
+	}
+	return f.addOF13(fmt.Sprintf("priority=205,in_port=%d,vlan_tci=0x0000/0x1fff,actions=meter:%d,%s", ofport, meter, f.forward("normal")))
+}
+
+// addOF13 installs flow under the owner's cookie over OpenFlow 1.3, which
+// the meter instruction needs
+func (f *Flows) addOF13(flow string) error {
+	if _, err := f.sw.ofctl("-O", "OpenFlow13", "add-flow", f.sw.bridgeName, fmt.Sprintf("cookie=%#x,%s", f.cookie, flow)); err != nil {
+		return fmt.Errorf("failed to add flow: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package ovs
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// natTable is where packets continue after going through conntrack NAT
+const natTable = 40
+
+// natOwner owns the shared flows of egress NAT, so they carry a cookie of
+// cnie without belonging to an attachment. The de-NAT flow of an external IP
+// is owned by natOwner/<ip>.
+const natOwner = "egressNAT"
+
+// natAction matches the conntrack action of a per-port NAT flow as
+// ovs-ofctl dump-flows prints it
+var natAction = regexp.MustCompile(`ct\(commit,zone=(\d+),nat\(src=([^)]+)\)`)
+
+// AddEgressNAT installs the flows masquerading the IPv4 traffic port sends
+// from podIP as externalIP, except to the pod's own subnet. Replies coming
+// back to externalIP are de-NATed and delivered to podMAC on port. All of it
+// is tracked in conntrack zone, so an externalIP serves a single zone: it is
+// an error while ports of other owners NAT to it in another zone. The
+// per-port flows are the owner's; the two shared flows stay on the bridge
+// under the cookies of natOwner.
+func (f *Flows) AddEgressNAT(port string, podIP *net.IPNet, podMAC string, externalIP net.IP, zone int) error {
+	ofport, err := f.sw.OFPort(port)
+	if err != nil {
+		return err
+	}
+	zones, err := f.natZones(externalIP)
+	if err != nil {
+		return err
+	}
+	for other := range zones {
+		if other != zone {
+			return fmt.Errorf("external IP %s of bridge %q is NATed in conntrack zone %d, it cannot serve zone %d too", externalIP, f.sw.bridgeName, other, zone)
+		}
+	}
+	shared := []struct{ owner, flow string }{
+		{natOwner + "/" + externalIP.String(), fmt.Sprintf("table=0,priority=250,ip,nw_dst=%s,actions=ct(nat,zone=%d,table=%d)", externalIP, zone, natTable)},
+		{natOwner, fmt.Sprintf("table=%d,priority=0,actions=normal", natTable)},
+	}
+	for _, s := range shared {
+		if err := f.sw.Flows(s.owner).Add(s.flow); err != nil {
+			return err
+		}
+	}
+	subnet := &net.IPNet{IP: podIP.IP.Mask(podIP.Mask), Mask: podIP.Mask}
+	for _, flow := range []string{
+		fmt.Sprintf("table=0,priority=260,ip,in_port=%d,vlan_tci=0x0000/0x1fff,nw_dst=%s,actions=%s", ofport, subnet, f.forward("normal")),
+		fmt.Sprintf("table=0,priority=250,ip,in_port=%d,vlan_tci=0x0000/0x1fff,nw_src=%s,actions=%s", ofport, podIP.IP, f.forward(fmt.Sprintf("ct(commit,zone=%d,nat(src=%s),table=%d)", zone, externalIP, natTable))),
+		fmt.Sprintf("table=%d,priority=100,ct_state=+trk+rpl,ct_zone=%d,ip,nw_dst=%s,actions=mod_dl_dst:%s,output:%d", natTable, zone, podIP.IP, podMAC, ofport),
+	} {
+		if err := f.Add(flow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// natZones returns the conntrack zones the per-port flows of other owners on
+// the bridge NAT to externalIP in
+func (f *Flows) natZones(externalIP net.IP) (map[int]bool, error) {
+	out, err := f.sw.ofctl("dump-flows", f.sw.bridgeName, fmt.Sprintf("cookie=%#x/%#x,table=0,ip", CookieTag, CookieMask))
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump flows: %v", err)
+	}
+	own := fmt.Sprintf("cookie=%#x,", f.cookie)
+	zones := map[int]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		m := natAction.FindStringSubmatch(line)
+		if m == nil || strings.HasPrefix(line, own) || !net.ParseIP(m[2]).Equal(externalIP) {
+			continue
+		}
+		zone, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed zone in flow %q", line)
+		}
+		zones[zone] = true
+	}
+	return zones, nil
+}
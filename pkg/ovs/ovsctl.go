@@ -0,0 +1,531 @@
+// Package ovs is the Open vSwitch interaction layer of the ovsbridge plugin.
+package ovs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-openvswitch/ovs"
+)
+
+// External ids set on the container ports cnie manages
+const (
+	ContainerIDKey = "cnie-container-id"
+	IfNameKey      = "cnie-ifname"
+	IPsKey         = "cnie-ips"
+	MACKey         = "cnie-mac"
+	// PortGroupKey names the group an ACL controller matches the port by
+	PortGroupKey = "cnie-port-group"
+	// UplinkKey names the uplink port the container's traffic leaves the
+	// bridge through
+	UplinkKey = "cnie-uplink"
+)
+
+// binDir holds ovs-vsctl and ovs-ofctl, they are looked up in PATH if empty
+var binDir string
+
+// SetBinDir makes the OVS tools be run from dir instead of PATH. It fails if
+// either tool is missing or not executable there.
+func SetBinDir(dir string) error {
+	for _, tool := range []string{"ovs-vsctl", "ovs-ofctl"} {
+		path := filepath.Join(dir, tool)
+		fi, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("OVS tool %q not found: %v", path, err)
+		}
+		if fi.IsDir() || fi.Mode()&0111 == 0 {
+			return fmt.Errorf("OVS tool %q is not executable", path)
+		}
+	}
+	binDir = dir
+	return nil
+}
+
+// dbArgs point ovs-vsctl at the OVSDB set with SetDB
+var dbArgs []string
+
+// SetDB makes ovs-vsctl talk to the OVSDB at target, e.g. ssl:10.0.0.1:6640,
+// instead of the local default. The TLS files are passed on for ssl: targets
+// and must exist.
+func SetDB(target, privateKey, certificate, caCert string) error {
+	args := []string{"--db=" + target}
+	for _, tls := range []struct{ flag, path string }{
+		{"--private-key", privateKey},
+		{"--certificate", certificate},
+		{"--ca-cert", caCert},
+	} {
+		if tls.path == "" {
+			continue
+		}
+		if _, err := os.Stat(tls.path); err != nil {
+			return fmt.Errorf("OVSDB TLS file %q not found: %v", tls.path, err)
+		}
+		args = append(args, tls.flag+"="+tls.path)
+	}
+	dbArgs = args
+	return nil
+}
+
+// Switch is a bridge instance
+type Switch struct {
+	bridgeName string
+	ovsclient  *ovs.Client
+}
+
+// NewSwitch for creating a ovs bridge. A new bridge gets datapathType, an
+// existing one must already have it; an empty datapathType accepts any.
+func NewSwitch(bridgeName, datapathType string) (*Switch, error) {
+	sw := OpenSwitch(bridgeName)
+	bridges, err := sw.ovsclient.VSwitch.ListBridges()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bridges: %v", err)
+	}
+	for _, name := range bridges {
+		if name == bridgeName {
+			if err := sw.checkDatapathType(datapathType); err != nil {
+				return nil, err
+			}
+			return sw, nil
+		}
+	}
+
+	args := []string{"--may-exist", "add-br", bridgeName}
+	if datapathType != "" {
+		args = append(args, "--", "set", "bridge", bridgeName, "datapath_type="+datapathType)
+	}
+	if _, err := sw.vsctl(args...); err != nil {
+		return nil, fmt.Errorf("failed to add bridge: %v", err)
+	}
+	// the bridge may have been added by someone else since it was listed
+	if err := sw.checkDatapathType(datapathType); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// DatapathType ovs-vsctl get bridge br0 datapath_type
+func (sw *Switch) DatapathType() (string, error) {
+	out, err := sw.vsctl("get", "bridge", sw.bridgeName, "datapath_type")
+	if err != nil {
+		return "", fmt.Errorf("failed to get datapath type: %v", err)
+	}
+	value := string(out)
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		value = unquoted
+	}
+	return value, nil
+}
+
+// checkDatapathType fails if the bridge does not use the wanted datapath
+func (sw *Switch) checkDatapathType(want string) error {
+	if want == "" {
+		return nil
+	}
+	actual, err := sw.DatapathType()
+	if err != nil {
+		return err
+	}
+	// an empty datapath_type is the kernel datapath
+	if actual == "" {
+		actual = "system"
+	}
+	if actual != want {
+		return fmt.Errorf("bridge %q already exists with datapath type %q, %q requested", sw.bridgeName, actual, want)
+	}
+	return nil
+}
+
+// OpenSwitch returns a handle to an existing bridge without creating it
+func OpenSwitch(bridgeName string) *Switch {
+	return &Switch{
+		bridgeName: bridgeName,
+		ovsclient:  ovs.New(ovs.Exec(execTool)),
+	}
+}
+
+// BridgeName returns the name of the bridge
+func (sw *Switch) BridgeName() string {
+	return sw.bridgeName
+}
+
+// vsctl runs ovs-vsctl for the commands the ovs client does not wrap
+func (sw *Switch) vsctl(args ...string) ([]byte, error) {
+	return run("ovs-vsctl", args...)
+}
+
+// ofctl runs ovs-ofctl for the commands the ovs client does not wrap
+func (sw *Switch) ofctl(args ...string) ([]byte, error) {
+	return run("ovs-ofctl", args...)
+}
+
+// deadline bounds the OVS tools run, none if zero
+var deadline time.Time
+
+// SetDeadline makes the OVS tools still running at t be killed and the ones
+// started afterwards fail at once. The zero time removes the deadline.
+func SetDeadline(t time.Time) {
+	deadline = t
+}
+
+// observer is told of every OVS tool run, nil if none
+var observer func(cmd string, args []string, start time.Time, err error)
+
+// SetObserver makes f be called after each OVS tool run with the tool, its
+// arguments, when it started and how it failed. nil removes it.
+func SetObserver(f func(cmd string, args []string, start time.Time, err error)) {
+	observer = f
+}
+
+// execTool runs an OVS tool through sudo and returns its combined output. It
+// is also the ExecFunc of the ovs client.
+func execTool(cmd string, args ...string) (out []byte, err error) {
+	if observer != nil {
+		tool, toolArgs, start := cmd, args, time.Now()
+		defer func() { observer(tool, toolArgs, start, err) }()
+	}
+	if cmd == "ovs-vsctl" && len(dbArgs) > 0 {
+		args = append(append([]string{}, dbArgs...), args...)
+	}
+	if binDir != "" {
+		cmd = filepath.Join(binDir, cmd)
+	}
+	if deadline.IsZero() {
+		return exec.Command("sudo", append([]string{cmd}, args...)...).CombinedOutput()
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	out, err = exec.CommandContext(ctx, "sudo", append([]string{cmd}, args...)...).CombinedOutput()
+	if ctx.Err() != nil {
+		return out, ctx.Err()
+	}
+	return out, err
+}
+
+func run(cmd string, args ...string) ([]byte, error) {
+	out, err := execTool(cmd, args...)
+	out = bytes.TrimSpace(out)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v: %s", cmd, strings.Join(args, " "), err, out)
+	}
+	return out, nil
+}
+
+// AddPort ovs-vsctl add-port br0 eth0
+func (sw *Switch) AddPort(ifName string) error {
+	if err := sw.ovsclient.VSwitch.AddPort(sw.bridgeName, ifName); err != nil {
+		return fmt.Errorf("failed to add port: %v", err)
+	}
+	return nil
+}
+
+// AddPatchPort ovs-vsctl --may-exist add-port br0 patch-br1 -- set interface patch-br1 type=patch options:peer=patch-br0
+// The port only forwards once the bridge of peer has a patch port named
+// peer pointing back to name.
+func (sw *Switch) AddPatchPort(name, peer string) error {
+	if _, err := sw.vsctl("--may-exist", "add-port", sw.bridgeName, name,
+		"--", "set", "interface", name, "type=patch", "options:peer="+strconv.Quote(peer)); err != nil {
+		return fmt.Errorf("failed to add patch port %q: %v", name, err)
+	}
+	return nil
+}
+
+// InternalPortMAC is the locally administered MAC an internal port named
+// ifName gets, the same whenever the port is recreated
+func InternalPortMAC(ifName string) net.HardwareAddr {
+	h := fnv.New64a()
+	h.Write([]byte(ifName))
+	sum := h.Sum64()
+	return net.HardwareAddr{0x02, byte(sum >> 32), byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)}
+}
+
+// AddInternalPort ovs-vsctl --may-exist add-port br0 tap0 -- set interface tap0 type=internal mac="02:..."
+// The MAC is InternalPortMAC, so peers keep their ARP entries across a
+// recreation. It is the Interface mac column, the internal port counterpart
+// of the bridge's other-config:hwaddr.
+func (sw *Switch) AddInternalPort(ifName string) error {
+	mac := fmt.Sprintf("mac=%q", InternalPortMAC(ifName).String())
+	if _, err := sw.vsctl("--may-exist", "add-port", sw.bridgeName, ifName,
+		"--", "set", "interface", ifName, "type=internal", mac); err != nil {
+		return fmt.Errorf("failed to add internal port: %v", err)
+	}
+	return nil
+}
+
+// DeletePort ovs-vsctl --if-exists del-port br0 eth0
+func (sw *Switch) DeletePort(ifName string) error {
+	if err := sw.ovsclient.VSwitch.DeletePort(sw.bridgeName, ifName); err != nil {
+		return fmt.Errorf("failed to delete port: %v", err)
+	}
+	return nil
+}
+
+// PortBridge ovs-vsctl port-to-br eth0
+// It returns "" for a port that is on no bridge.
+func PortBridge(port string) (string, error) {
+	bridge, err := ovs.New(ovs.Exec(execTool)).VSwitch.PortToBridge(port)
+	if ovs.IsPortNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get bridge of port %q: %v", port, err)
+	}
+	return bridge, nil
+}
+
+// DeleteBridge ovs-vsctl --if-exists del-br br0
+func (sw *Switch) DeleteBridge() error {
+	if err := sw.ovsclient.VSwitch.DeleteBridge(sw.bridgeName); err != nil {
+		return fmt.Errorf("failed to delete bridge %q: %v", sw.bridgeName, err)
+	}
+	return nil
+}
+
+// ListBridges ovs-vsctl list-br
+func ListBridges() ([]string, error) {
+	out, err := run("ovs-vsctl", "list-br")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bridges: %v", err)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// ListPorts ovs-vsctl list-ports br0
+func (sw *Switch) ListPorts() ([]string, error) {
+	ports, err := sw.ovsclient.VSwitch.ListPorts(sw.bridgeName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ports: %v", err)
+	}
+	// an empty bridge yields a single empty name
+	if len(ports) == 1 && ports[0] == "" {
+		return nil, nil
+	}
+	return ports, nil
+}
+
+// SetPortTag ovs-vsctl set port veth0 tag=100
+func (sw *Switch) SetPortTag(port string, vlan int) error {
+	if _, err := sw.vsctl("set", "port", port, fmt.Sprintf("tag=%d", vlan)); err != nil {
+		return fmt.Errorf("failed to set vlan tag on port %q: %v", port, err)
+	}
+	return nil
+}
+
+// SetPortNativeVlan ovs-vsctl set port eth0 vlan_mode=native-untagged tag=100
+// The port stays a trunk of all VLANs, untagged frames belong to vlan.
+func (sw *Switch) SetPortNativeVlan(port string, vlan int) error {
+	if _, err := sw.vsctl("set", "port", port, "vlan_mode=native-untagged", fmt.Sprintf("tag=%d", vlan)); err != nil {
+		return fmt.Errorf("failed to set native vlan %d of port %q: %v", vlan, port, err)
+	}
+	return nil
+}
+
+// ClearPortTag ovs-vsctl clear port veth0 tag
+func (sw *Switch) ClearPortTag(port string) error {
+	if _, err := sw.vsctl("clear", "port", port, "tag"); err != nil {
+		return fmt.Errorf("failed to clear vlan tag of port %q: %v", port, err)
+	}
+	return nil
+}
+
+// PortTag ovs-vsctl get port veth0 tag
+// It returns 0 for a port without a tag.
+func (sw *Switch) PortTag(port string) (int, error) {
+	out, err := sw.vsctl("get", "port", port, "tag")
+	if err != nil {
+		return 0, fmt.Errorf("failed to get vlan tag of port %q: %v", port, err)
+	}
+	if string(out) == "[]" {
+		return 0, nil
+	}
+	tag, err := strconv.Atoi(string(out))
+	if err != nil {
+		return 0, fmt.Errorf("port %q has invalid vlan tag %q", port, out)
+	}
+	return tag, nil
+}
+
+// SetPortProtected ovs-vsctl set port veth0 protected=true
+func (sw *Switch) SetPortProtected(port string, protected bool) error {
+	if _, err := sw.vsctl("set", "port", port, fmt.Sprintf("protected=%t", protected)); err != nil {
+		return fmt.Errorf("failed to set protected on port %q: %v", port, err)
+	}
+	return nil
+}
+
+// SetFailMode ovs-vsctl set-fail-mode br0 secure
+func (sw *Switch) SetFailMode(mode string) error {
+	if err := sw.ovsclient.VSwitch.SetFailMode(sw.bridgeName, ovs.FailMode(mode)); err != nil {
+		return fmt.Errorf("failed to set fail mode: %v", err)
+	}
+	return nil
+}
+
+// SetProtocols ovs-vsctl set bridge br0 protocols=OpenFlow10,OpenFlow13
+func (sw *Switch) SetProtocols(protocols []string) error {
+	if err := sw.ovsclient.VSwitch.Set.Bridge(sw.bridgeName, ovs.BridgeOptions{
+		Protocols: protocols,
+	}); err != nil {
+		return fmt.Errorf("failed to set protocols: %v", err)
+	}
+	return nil
+}
+
+// SetController ovs-vsctl set-controller br0 tcp:127.0.0.1:6653
+func (sw *Switch) SetController(address string) error {
+	if err := sw.ovsclient.VSwitch.SetController(sw.bridgeName, address); err != nil {
+		return fmt.Errorf("failed to set controller: %v", err)
+	}
+	return nil
+}
+
+// SetControllerOptions ovs-vsctl set controller br0 inactivity_probe=5000 max_backoff=8000
+// Both values are in milliseconds, zero leaves the OVS default.
+func (sw *Switch) SetControllerOptions(inactivityProbe, maxBackoff int) error {
+	args := []string{"set", "controller", sw.bridgeName}
+	if inactivityProbe > 0 {
+		args = append(args, fmt.Sprintf("inactivity_probe=%d", inactivityProbe))
+	}
+	if maxBackoff > 0 {
+		args = append(args, fmt.Sprintf("max_backoff=%d", maxBackoff))
+	}
+	if _, err := sw.vsctl(args...); err != nil {
+		return fmt.Errorf("failed to set controller options: %v", err)
+	}
+	return nil
+}
+
+// SetPortExternalID ovs-vsctl set port eth0 external_ids:key=value
+func (sw *Switch) SetPortExternalID(port, key, value string) error {
+	if _, err := sw.vsctl("set", "port", port, fmt.Sprintf("external_ids:%s=%s", key, strconv.Quote(value))); err != nil {
+		return fmt.Errorf("failed to set external id %q on port %q: %v", key, port, err)
+	}
+	return nil
+}
+
+// SetPortExternalIDs sets several external ids on port at once
+func (sw *Switch) SetPortExternalIDs(port string, ids map[string]string) error {
+	keys := make([]string, 0, len(ids))
+	for key := range ids {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	args := []string{"set", "port", port}
+	for _, key := range keys {
+		args = append(args, fmt.Sprintf("external_ids:%s=%s", key, strconv.Quote(ids[key])))
+	}
+	if _, err := sw.vsctl(args...); err != nil {
+		return fmt.Errorf("failed to set external ids on port %q: %v", port, err)
+	}
+	return nil
+}
+
+// SetPortOtherConfig ovs-vsctl set port eth0 other_config:key=value
+func (sw *Switch) SetPortOtherConfig(port string, config map[string]string) error {
+	if len(config) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	args := []string{"set", "port", port}
+	for _, key := range keys {
+		args = append(args, fmt.Sprintf("other_config:%s=%s", key, strconv.Quote(config[key])))
+	}
+	if _, err := sw.vsctl(args...); err != nil {
+		return fmt.Errorf("failed to set other_config on port %q: %v", port, err)
+	}
+	return nil
+}
+
+// RemovePortOtherConfig ovs-vsctl remove port eth0 other_config key...
+func (sw *Switch) RemovePortOtherConfig(port string, keys ...string) error {
+	args := append([]string{"remove", "port", port, "other_config"}, keys...)
+	if _, err := sw.vsctl(args...); err != nil {
+		return fmt.Errorf("failed to remove other_config of port %q: %v", port, err)
+	}
+	return nil
+}
+
+// SetRSTP ovs-vsctl set bridge br0 rstp_enable=true
+func (sw *Switch) SetRSTP(enable bool) error {
+	if _, err := sw.vsctl("set", "bridge", sw.bridgeName, fmt.Sprintf("rstp_enable=%t", enable)); err != nil {
+		return fmt.Errorf("failed to set rstp_enable of %q: %v", sw.bridgeName, err)
+	}
+	return nil
+}
+
+// FindPorts returns the ports of the bridge whose external id key is value
+func (sw *Switch) FindPorts(key, value string) ([]string, error) {
+	out, err := sw.vsctl("--bare", "--columns=name", "find", "port", fmt.Sprintf("external_ids:%s=%s", key, strconv.Quote(value)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find ports with %s=%s: %v", key, value, err)
+	}
+	bridgePorts, err := sw.ListPorts()
+	if err != nil {
+		return nil, err
+	}
+	onBridge := map[string]bool{}
+	for _, port := range bridgePorts {
+		onBridge[port] = true
+	}
+
+	var ports []string
+	for _, port := range strings.Fields(string(out)) {
+		if onBridge[port] {
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+// InterfaceLinkState ovs-vsctl get interface eth0 link_state
+// It returns "up" or "down", "" while OVS has not read the link yet.
+func (sw *Switch) InterfaceLinkState(name string) (string, error) {
+	out, err := sw.vsctl("get", "interface", name, "link_state")
+	if err != nil {
+		return "", fmt.Errorf("failed to get link state of %q: %v", name, err)
+	}
+	state := string(out)
+	if state == "[]" {
+		return "", nil
+	}
+	if unquoted, err := strconv.Unquote(state); err == nil {
+		state = unquoted
+	}
+	return state, nil
+}
+
+// RemovePortExternalID ovs-vsctl remove port eth0 external_ids key
+func (sw *Switch) RemovePortExternalID(port, key string) error {
+	if _, err := sw.vsctl("remove", "port", port, "external_ids", key); err != nil {
+		return fmt.Errorf("failed to remove external id %q of port %q: %v", key, port, err)
+	}
+	return nil
+}
+
+// PortExternalID ovs-vsctl --if-exists get port eth0 external_ids:key
+func (sw *Switch) PortExternalID(port, key string) (string, error) {
+	out, err := sw.vsctl("--if-exists", "get", "port", port, "external_ids:"+key)
+	if err != nil {
+		return "", fmt.Errorf("failed to get external id %q of port %q: %v", key, port, err)
+	}
+	value := string(out)
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		value = unquoted
+	}
+	return value, nil
+}
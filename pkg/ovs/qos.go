@@ -0,0 +1,372 @@
+package ovs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// qosBridgeKey tags the QoS record shared by the ports of a bridge
+	qosBridgeKey = "cnie-bridge"
+	// queueOwnerKey tags a queue with the container attachment it belongs to
+	queueOwnerKey = "cnie-owner"
+)
+
+// AddPortQueue guarantees minRate and caps maxRate (bits/s, 0 for no limit)
+// for the traffic port sends out of uplink. The queue is added to a QoS
+// record of qosType shared by the bridge and attached to uplink; owner
+// identifies the queue so the same attachment always gets its queue ID back.
+// It returns the queue ID, for the owner's flows passing port's traffic on
+// above the queue flow, see Flows.SetQueue.
+func (sw *Switch) AddPortQueue(uplink, port, owner, qosType string, minRate, maxRate uint64) (int, error) {
+	qos, err := sw.sharedQoS(uplink, qosType)
+	if err != nil {
+		return 0, err
+	}
+	queues, err := sw.qosQueues(qos)
+	if err != nil {
+		return 0, err
+	}
+
+	queue, err := sw.findByExternalID("queue", queueOwnerKey, owner)
+	if err != nil {
+		return 0, err
+	}
+	var rates []string
+	if minRate > 0 {
+		rates = append(rates, fmt.Sprintf("other-config:min-rate=%d", minRate))
+	}
+	if maxRate > 0 {
+		rates = append(rates, fmt.Sprintf("other-config:max-rate=%d", maxRate))
+	}
+	if queue == "" {
+		args := append([]string{"create", "queue", fmt.Sprintf("external_ids:%s=%s", queueOwnerKey, strconv.Quote(owner))}, rates...)
+		out, err := sw.vsctl(args...)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create queue: %v", err)
+		}
+		queue = string(out)
+	} else if len(rates) > 0 {
+		if _, err := sw.vsctl(append([]string{"set", "queue", queue}, rates...)...); err != nil {
+			return 0, fmt.Errorf("failed to update queue %s: %v", queue, err)
+		}
+	}
+
+	// keep the queue ID the owner already has, or take the lowest free one.
+	// queue 0 is left to the traffic of the bridge that is not steered.
+	id := 0
+	for qid, uuid := range queues {
+		if uuid == queue {
+			id = qid
+		}
+	}
+	if id == 0 {
+		for id = 1; queues[id] != ""; id++ {
+		}
+		if _, err := sw.vsctl("set", "qos", qos, fmt.Sprintf("queues:%d=%s", id, queue)); err != nil {
+			return 0, fmt.Errorf("failed to add queue %d to qos %s: %v", id, qos, err)
+		}
+	}
+
+	ofport, err := sw.OFPort(port)
+	if err != nil {
+		return 0, err
+	}
+	if err := sw.Flows(owner).Add(fmt.Sprintf("%s,actions=set_queue:%d,normal", queueMatch(ofport), id)); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// queueMatch is the match of the flow steering what ofport sends into its
+// queue
+func queueMatch(ofport int) string {
+	return fmt.Sprintf("priority=100,in_port=%d", ofport)
+}
+
+// DeletePortQueue removes the queue of owner and the flow steering port into
+// it, matched by owner's cookie and the exact match, so the other flows of
+// the port stay. The queues of the shared QoS record are its references: the record is
+// detached from the uplink and destroyed with the last one. port may be
+// empty when it is already gone. Callers hold the bridge lock, so no ADD adds
+// a queue between counting and destroying.
+func (sw *Switch) DeletePortQueue(port, owner string) error {
+	if port != "" {
+		if ofport, err := sw.OFPort(port); err == nil {
+			if err := sw.Flows(owner).DeleteStrict(queueMatch(ofport)); err != nil {
+				return err
+			}
+		}
+	}
+
+	queue, err := sw.findByExternalID("queue", queueOwnerKey, owner)
+	if err != nil || queue == "" {
+		return err
+	}
+	qos, err := sw.findByExternalID("qos", qosBridgeKey, sw.bridgeName)
+	if err != nil {
+		return err
+	}
+	remaining := 0
+	if qos != "" {
+		queues, err := sw.qosQueues(qos)
+		if err != nil {
+			return err
+		}
+		for id, uuid := range queues {
+			if uuid != queue {
+				remaining++
+				continue
+			}
+			if _, err := sw.vsctl("remove", "qos", qos, "queues", strconv.Itoa(id)); err != nil {
+				return fmt.Errorf("failed to remove queue %d from qos %s: %v", id, qos, err)
+			}
+		}
+	}
+	if _, err := sw.vsctl("destroy", "queue", queue); err != nil {
+		return fmt.Errorf("failed to destroy queue %s: %v", queue, err)
+	}
+	if qos != "" && remaining == 0 {
+		return sw.deleteQoS(qos)
+	}
+	return nil
+}
+
+// deleteQoS detaches the QoS record from the ports using it and destroys it.
+// If destroying fails the next AddPortQueue attaches the record again.
+func (sw *Switch) deleteQoS(qos string) error {
+	out, err := sw.vsctl("--bare", "--columns=name", "find", "port", "qos="+qos)
+	if err != nil {
+		return fmt.Errorf("failed to find ports of qos %s: %v", qos, err)
+	}
+	for _, port := range strings.Fields(string(out)) {
+		if _, err := sw.vsctl("clear", "port", port, "qos"); err != nil {
+			return fmt.Errorf("failed to detach qos %s from %q: %v", qos, port, err)
+		}
+	}
+	if _, err := sw.vsctl("destroy", "qos", qos); err != nil {
+		return fmt.Errorf("failed to destroy qos %s: %v", qos, err)
+	}
+	return nil
+}
+
+// CollectQoS destroys the cnie QoS and queue rows a crash left behind and
+// returns what it removed. A queue is orphaned when no port of its owner is
+// left, and it is taken out of the QoS records of cnie before it is
+// destroyed; a QoS record is orphaned when no port uses it or its last queue
+// is gone. Rows without a cnie tag, and queues a QoS record of someone else
+// still uses, are not touched. Callers hold the locks of all bridges.
+func CollectQoS() ([]string, error) {
+	// read the tagged rows before the ports, an ADD tags the port first
+	qosRows, err := listTable("qos", "_uuid", "external_ids", "queues")
+	if err != nil {
+		return nil, err
+	}
+	queueRows, err := listTable("queue", "_uuid", "external_ids")
+	if err != nil {
+		return nil, err
+	}
+	portRows, err := listTable("port", "qos", "external_ids")
+	if err != nil {
+		return nil, err
+	}
+
+	used := map[string]bool{}
+	owners := map[string]bool{}
+	for _, row := range portRows {
+		qos, err := parseUUIDSet(row[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, uuid := range qos {
+			used[uuid] = true
+		}
+		ids, err := parseMapColumn(row[1])
+		if err != nil {
+			return nil, err
+		}
+		if ids[ContainerIDKey] != "" {
+			owners[ids[ContainerIDKey]+"/"+ids[IfNameKey]] = true
+		}
+	}
+
+	orphans := map[string]string{}
+	for _, row := range queueRows {
+		uuid, ids, err := parseTaggedRow(row)
+		if err != nil {
+			return nil, err
+		}
+		if owner, ok := ids[queueOwnerKey]; ok && !owners[owner] {
+			orphans[uuid] = owner
+		}
+	}
+
+	type qosRow struct {
+		uuid, bridge string
+		tagged       bool
+		queues       map[int]string
+	}
+	var records []qosRow
+	for _, row := range qosRows {
+		uuid, ids, err := parseTaggedRow(row)
+		if err != nil {
+			return nil, err
+		}
+		queues, err := parseQueuesColumn(row[2])
+		if err != nil {
+			return nil, err
+		}
+		bridge, tagged := ids[qosBridgeKey]
+		if !tagged {
+			// the queues of a foreign record stay
+			for _, queue := range queues {
+				delete(orphans, queue)
+			}
+		}
+		records = append(records, qosRow{uuid, bridge, tagged, queues})
+	}
+
+	var removed []string
+	for _, r := range records {
+		if !r.tagged {
+			continue
+		}
+		remaining := 0
+		for id, queue := range r.queues {
+			if _, ok := orphans[queue]; !ok {
+				remaining++
+				continue
+			}
+			if _, err := run("ovs-vsctl", "remove", "qos", r.uuid, "queues", strconv.Itoa(id)); err != nil {
+				return removed, fmt.Errorf("failed to remove queue %d from qos %s: %v", id, r.uuid, err)
+			}
+		}
+		if remaining > 0 && used[r.uuid] {
+			continue
+		}
+		if err := OpenSwitch(r.bridge).deleteQoS(r.uuid); err != nil {
+			return removed, err
+		}
+		removed = append(removed, fmt.Sprintf("qos %s of bridge %q", r.uuid, r.bridge))
+	}
+
+	for queue, owner := range orphans {
+		if _, err := run("ovs-vsctl", "destroy", "queue", queue); err != nil {
+			return removed, fmt.Errorf("failed to destroy queue %s: %v", queue, err)
+		}
+		removed = append(removed, fmt.Sprintf("queue %s of %s", queue, owner))
+	}
+	return removed, nil
+}
+
+// parseTaggedRow parses the _uuid and external_ids cells starting a row
+func parseTaggedRow(row []json.RawMessage) (string, map[string]string, error) {
+	uuids, err := parseUUIDSet(row[0])
+	if err != nil || len(uuids) != 1 {
+		return "", nil, fmt.Errorf("failed to parse uuid: %s", row[0])
+	}
+	ids, err := parseMapColumn(row[1])
+	if err != nil {
+		return "", nil, err
+	}
+	return uuids[0], ids, nil
+}
+
+// parseQueuesColumn parses the queues of a QoS record,
+// ["map",[[1,["uuid","x"]],...]], as queue ID to UUID
+func parseQueuesColumn(cell json.RawMessage) (map[int]string, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(cell, &raw); err != nil || len(raw) != 2 {
+		return nil, fmt.Errorf("malformed queues %s", cell)
+	}
+	var pairs [][2]json.RawMessage
+	if err := json.Unmarshal(raw[1], &pairs); err != nil {
+		return nil, fmt.Errorf("malformed queues %s", cell)
+	}
+	m := make(map[int]string, len(pairs))
+	for _, p := range pairs {
+		var id int
+		if err := json.Unmarshal(p[0], &id); err != nil {
+			return nil, fmt.Errorf("malformed queue id %s", p[0])
+		}
+		uuids, err := parseUUIDSet(p[1])
+		if err != nil || len(uuids) != 1 {
+			return nil, fmt.Errorf("malformed queue %s", p[1])
+		}
+		m[id] = uuids[0]
+	}
+	return m, nil
+}
+
+// sharedQoS returns the QoS record of the bridge, creating it with qosType
+// and attaching it to uplink if necessary. The queues of the other
+// containers depend on the record's type, so an existing record of another
+// type is an error rather than changed.
+func (sw *Switch) sharedQoS(uplink, qosType string) (string, error) {
+	qos, err := sw.findByExternalID("qos", qosBridgeKey, sw.bridgeName)
+	if err != nil {
+		return "", err
+	}
+	if qos != "" {
+		out, err := sw.vsctl("get", "qos", qos, "type")
+		if err != nil {
+			return "", fmt.Errorf("failed to get type of qos %s: %v", qos, err)
+		}
+		if t := strings.Trim(strings.TrimSpace(string(out)), `"`); t != qosType {
+			return "", fmt.Errorf("qos of bridge %q is %s, not %s; the containers of a bridge share one scheduler", sw.bridgeName, t, qosType)
+		}
+	}
+	if qos == "" {
+		out, err := sw.vsctl("create", "qos", "type="+qosType, fmt.Sprintf("external_ids:%s=%s", qosBridgeKey, strconv.Quote(sw.bridgeName)))
+		if err != nil {
+			return "", fmt.Errorf("failed to create qos: %v", err)
+		}
+		qos = string(out)
+	}
+	if _, err := sw.vsctl("set", "port", uplink, "qos="+qos); err != nil {
+		return "", fmt.Errorf("failed to attach qos %s to %q: %v", qos, uplink, err)
+	}
+	return qos, nil
+}
+
+// findByExternalID returns the UUID of the first row of table whose
+// external_ids has key set to value, or "" if there is none
+func (sw *Switch) findByExternalID(table, key, value string) (string, error) {
+	out, err := sw.vsctl("--bare", "--columns=_uuid", "find", table, fmt.Sprintf("external_ids:%s=%s", key, strconv.Quote(value)))
+	if err != nil {
+		return "", fmt.Errorf("failed to find %s: %v", table, err)
+	}
+	return strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0]), nil
+}
+
+// qosQueues returns the queues column of a QoS record as queue ID to UUID
+func (sw *Switch) qosQueues(qos string) (map[int]string, error) {
+	out, err := sw.vsctl("get", "qos", qos, "queues")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get queues of qos %s: %v", qos, err)
+	}
+	return parseMap(string(out))
+}
+
+// parseMap parses an OVSDB map column printed as {1=uuid1, 2=uuid2}
+func parseMap(s string) (map[int]string, error) {
+	m := map[int]string{}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	if s == "" {
+		return m, nil
+	}
+	for _, kv := range strings.Split(s, ", ") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed map entry %q", kv)
+		}
+		k, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed map key %q", parts[0])
+		}
+		m[k] = parts[1]
+	}
+	return m, nil
+}
@@ -0,0 +1,56 @@
+package ovs
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseMap(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    map[int]string
+		wantErr bool
+	}{
+		{"{}", map[int]string{}, false},
+		{"{1=8b0c76ba-4a3b-4a1e-9a4d-0f5b0e0c9d11}", map[int]string{1: "8b0c76ba-4a3b-4a1e-9a4d-0f5b0e0c9d11"}, false},
+		{"{1=uuid1, 12=uuid12}", map[int]string{1: "uuid1", 12: "uuid12"}, false},
+		{"{1=uuid1, uuid2}", nil, true},
+		{"{x=uuid1}", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseMap(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseMap(%q) error = %v, want error %t", tt.s, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseMap(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestParseQueuesColumn(t *testing.T) {
+	tests := []struct {
+		cell    string
+		want    map[int]string
+		wantErr bool
+	}{
+		{`["map",[]]`, map[int]string{}, false},
+		{`["map",[[1,["uuid","a"]],[7,["uuid","b"]]]]`, map[int]string{1: "a", 7: "b"}, false},
+		{`["map",[["1",["uuid","a"]]]]`, nil, true},
+		{`["map",[[1,["set",[]]]]]`, nil, true},
+		{`["map"]`, nil, true},
+		{`{}`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseQueuesColumn(json.RawMessage(tt.cell))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseQueuesColumn(%s) error = %v, want error %t", tt.cell, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseQueuesColumn(%s) = %v, want %v", tt.cell, got, tt.want)
+		}
+	}
+}
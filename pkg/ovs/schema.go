@@ -0,0 +1,133 @@
+package ovs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// schemaFeature is the first OVSDB schema version, and its Open vSwitch
+// release, that supports a feature
+type schemaFeature struct {
+	version string
+	release string
+}
+
+// schemaFeatures are the features whose config would otherwise fail with an
+// unknown column or an unsupported action deep in the ADD
+var schemaFeatures = map[string]schemaFeature{
+	"protected": {"7.15.0", "2.8"},
+	// meters predate it in OpenFlow, the kernel datapath supports them
+	// since this release
+	"meter": {"7.16.0", "2.10"},
+}
+
+var schema struct {
+	once    sync.Once
+	version string
+	err     error
+}
+
+// SchemaVersion ovs-vsctl get Open_vSwitch . db_version
+// It is read once per process, after SetDB.
+func SchemaVersion() (string, error) {
+	schema.once.Do(func() {
+		out, err := run("ovs-vsctl", "get", "Open_vSwitch", ".", "db_version")
+		if err != nil {
+			schema.err = fmt.Errorf("failed to get the OVSDB schema version: %v", err)
+			return
+		}
+		schema.version = string(out)
+		if unquoted, err := strconv.Unquote(schema.version); err == nil {
+			schema.version = unquoted
+		}
+	})
+	return schema.version, schema.err
+}
+
+var release struct {
+	once    sync.Once
+	version string
+	err     error
+}
+
+// Version ovs-vsctl --version
+// It returns the Open vSwitch release of the tools, e.g. 2.17.9, read once
+// per process after SetBinDir.
+func Version() (string, error) {
+	release.once.Do(func() {
+		out, err := run("ovs-vsctl", "--version")
+		if err != nil {
+			release.err = fmt.Errorf("failed to get the Open vSwitch version: %v", err)
+			return
+		}
+		release.version, release.err = parseVersion(string(out))
+	})
+	return release.version, release.err
+}
+
+// parseVersion takes the release from the first line of --version output,
+// "ovs-vsctl (Open vSwitch) 2.17.9"
+func parseVersion(out string) (string, error) {
+	line := strings.SplitN(out, "\n", 2)[0]
+	const marker = "(Open vSwitch) "
+	i := strings.Index(line, marker)
+	if i < 0 {
+		return "", fmt.Errorf("malformed Open vSwitch version %q", line)
+	}
+	fields := strings.Fields(line[i+len(marker):])
+	if len(fields) == 0 {
+		return "", fmt.Errorf("malformed Open vSwitch version %q", line)
+	}
+	return fields[0], nil
+}
+
+// RequireFeature fails with the Open vSwitch release needed for feature if
+// the running OVSDB schema is older than the one introducing it
+func RequireFeature(feature string) error {
+	f, ok := schemaFeatures[feature]
+	if !ok {
+		return fmt.Errorf("unknown feature %q", feature)
+	}
+	version, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	older, err := versionLess(version, f.version)
+	if err != nil {
+		return err
+	}
+	if older {
+		running := "schema " + version
+		if release, err := Version(); err == nil {
+			running = release + " with " + running
+		}
+		return fmt.Errorf("%s requires Open vSwitch %s or later (OVSDB schema %s), the running one is %s",
+			feature, f.release, f.version, running)
+	}
+	return nil
+}
+
+// versionLess compares two dotted schema versions
+func versionLess(a, b string) (bool, error) {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		var err error
+		if i < len(as) {
+			if x, err = strconv.Atoi(as[i]); err != nil {
+				return false, fmt.Errorf("malformed schema version %q", a)
+			}
+		}
+		if i < len(bs) {
+			if y, err = strconv.Atoi(bs[i]); err != nil {
+				return false, fmt.Errorf("malformed schema version %q", b)
+			}
+		}
+		if x != y {
+			return x < y, nil
+		}
+	}
+	return false, nil
+}
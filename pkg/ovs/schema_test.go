@@ -0,0 +1,56 @@
+package ovs
+
+import "testing"
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		out     string
+		want    string
+		wantErr bool
+	}{
+		{"ovs-vsctl (Open vSwitch) 2.17.9\nDB Schema 8.3.0\n", "2.17.9", false},
+		{"ovs-vsctl (Open vSwitch) 2.5.0", "2.5.0", false},
+		{"ovs-vsctl (Open vSwitch) 3.1.0 (build 42)", "3.1.0", false},
+		{"ovs-vsctl (Open vSwitch) ", "", true},
+		{"ovs-vsctl: command not found", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseVersion(tt.out)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseVersion(%q) error = %v, want error %t", tt.out, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseVersion(%q) = %q, want %q", tt.out, got, tt.want)
+		}
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		want    bool
+		wantErr bool
+	}{
+		{"7.15.0", "7.16.0", true, false},
+		{"7.16.0", "7.15.0", false, false},
+		{"7.16.0", "7.16.0", false, false},
+		{"7.9.0", "7.10.0", true, false},
+		{"7.16", "7.16.1", true, false},
+		{"7.16.0", "7.16", false, false},
+		{"8", "7.16.1", false, false},
+		{"7.x.0", "7.16.0", false, true},
+		{"7.16.0", "7.16.b", false, true},
+	}
+	for _, tt := range tests {
+		got, err := versionLess(tt.a, tt.b)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("versionLess(%q, %q) error = %v, want error %t", tt.a, tt.b, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("versionLess(%q, %q) = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package ovs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// BridgeStats are the counters of all interfaces of a bridge added up
+type BridgeStats struct {
+	Bridge     string `json:"bridge"`
+	Interfaces int    `json:"interfaces"`
+	RxPackets  uint64 `json:"rxPackets"`
+	RxBytes    uint64 `json:"rxBytes"`
+	RxDropped  uint64 `json:"rxDropped"`
+	RxErrors   uint64 `json:"rxErrors"`
+	TxPackets  uint64 `json:"txPackets"`
+	TxBytes    uint64 `json:"txBytes"`
+	TxDropped  uint64 `json:"txDropped"`
+	TxErrors   uint64 `json:"txErrors"`
+}
+
+// Stats adds up the statistics column of the interfaces of the bridge, the
+// bridge's own interface included. A counter an interface does not report
+// counts as zero.
+func (sw *Switch) Stats() (*BridgeStats, error) {
+	out, err := sw.vsctl("list-ifaces", sw.bridgeName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces of %q: %v", sw.bridgeName, err)
+	}
+	ifaces := map[string]bool{sw.bridgeName: true}
+	for _, name := range strings.Fields(string(out)) {
+		ifaces[name] = true
+	}
+
+	rows, err := listTable("interface", "name", "statistics")
+	if err != nil {
+		return nil, err
+	}
+	stats := &BridgeStats{Bridge: sw.bridgeName}
+	for _, row := range rows {
+		var name string
+		if err := json.Unmarshal(row[0], &name); err != nil {
+			return nil, fmt.Errorf("failed to parse interface name: %v", err)
+		}
+		if !ifaces[name] {
+			continue
+		}
+		counters, err := parseCounters(row[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse statistics of %q: %v", name, err)
+		}
+		stats.Interfaces++
+		stats.RxPackets += counters["rx_packets"]
+		stats.RxBytes += counters["rx_bytes"]
+		stats.RxDropped += counters["rx_dropped"]
+		stats.RxErrors += counters["rx_errors"]
+		stats.TxPackets += counters["tx_packets"]
+		stats.TxBytes += counters["tx_bytes"]
+		stats.TxDropped += counters["tx_dropped"]
+		stats.TxErrors += counters["tx_errors"]
+	}
+	return stats, nil
+}
+
+// VSwitchdStatistics ovs-vsctl get Open_vSwitch . statistics
+// ovs-vswitchd only fills it in, with its CPU, load and memory figures, while
+// other_config:enable-statistics is true.
+func VSwitchdStatistics() (map[string]string, error) {
+	rows, err := listTable("Open_vSwitch", "statistics")
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) != 1 {
+		return nil, fmt.Errorf("expected one Open_vSwitch row, got %d", len(rows))
+	}
+	return parseMapColumn(rows[0][0])
+}
+
+// parseCounters parses an OVSDB map of integers, ["map",[["k",1],...]]
+func parseCounters(cell json.RawMessage) (map[string]uint64, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(cell, &raw); err != nil || len(raw) != 2 {
+		return nil, fmt.Errorf("malformed map %s", cell)
+	}
+	var pairs [][2]json.RawMessage
+	if err := json.Unmarshal(raw[1], &pairs); err != nil {
+		return nil, fmt.Errorf("malformed map %s", cell)
+	}
+	m := make(map[string]uint64, len(pairs))
+	for _, p := range pairs {
+		var key string
+		var value uint64
+		if err := json.Unmarshal(p[0], &key); err != nil {
+			return nil, fmt.Errorf("malformed map key %s", p[0])
+		}
+		if err := json.Unmarshal(p[1], &value); err != nil {
+			return nil, fmt.Errorf("malformed counter %s", p[1])
+		}
+		m[key] = value
+	}
+	return m, nil
+}
@@ -0,0 +1,32 @@
+package ovs
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseCounters(t *testing.T) {
+	tests := []struct {
+		cell    string
+		want    map[string]uint64
+		wantErr bool
+	}{
+		{`["map",[]]`, map[string]uint64{}, false},
+		{`["map",[["rx_bytes",1500],["tx_packets",3]]]`, map[string]uint64{"rx_bytes": 1500, "tx_packets": 3}, false},
+		{`["map",[["rx_bytes",-1]]]`, nil, true},
+		{`["map",[["rx_bytes","1500"]]]`, nil, true},
+		{`["map",[[1,1500]]]`, nil, true},
+		{`"rx_bytes"`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCounters(json.RawMessage(tt.cell))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCounters(%s) error = %v, want error %t", tt.cell, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCounters(%s) = %v, want %v", tt.cell, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package ovs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Tunnel is a tunnel interface of some bridge with its BFD session
+type Tunnel struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	BFD  bool   `json:"bfd"`
+	// BFDStatus is the bfd_status column, its state key is up, down,
+	// init or admin_down
+	BFDStatus map[string]string `json:"bfdStatus,omitempty"`
+}
+
+// AddTunnelPort ovs-vsctl --may-exist add-port br0 vxlan0 -- set interface vxlan0 type=vxlan options:remote_ip=10.0.0.2
+// The type, options and BFD are set again on an existing port, so a changed
+// config is applied on the next ADD.
+func (sw *Switch) AddTunnelPort(name, tunnelType string, options map[string]string, bfd bool) error {
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	args := []string{"--may-exist", "add-port", sw.bridgeName, name,
+		"--", "set", "interface", name, "type=" + tunnelType,
+		fmt.Sprintf("bfd:enable=%t", bfd)}
+	for _, key := range keys {
+		args = append(args, fmt.Sprintf("options:%s=%s", key, strconv.Quote(options[key])))
+	}
+	if _, err := sw.vsctl(args...); err != nil {
+		return fmt.Errorf("failed to add tunnel port %q: %v", name, err)
+	}
+	return nil
+}
+
+// ListTunnels returns the VXLAN, GENEVE and GRE interfaces of all bridges
+func ListTunnels() ([]Tunnel, error) {
+	rows, err := listTable("interface", "name", "type", "bfd", "bfd_status")
+	if err != nil {
+		return nil, err
+	}
+	var tunnels []Tunnel
+	for _, row := range rows {
+		var t Tunnel
+		if err := json.Unmarshal(row[0], &t.Name); err != nil {
+			return nil, fmt.Errorf("failed to parse interface name: %v", err)
+		}
+		if err := json.Unmarshal(row[1], &t.Type); err != nil {
+			return nil, fmt.Errorf("failed to parse type of %q: %v", t.Name, err)
+		}
+		switch t.Type {
+		case "vxlan", "geneve", "gre":
+		default:
+			continue
+		}
+		bfd, err := parseMapColumn(row[2])
+		if err != nil {
+			return nil, err
+		}
+		t.BFD = bfd["enable"] == "true"
+		if t.BFDStatus, err = parseMapColumn(row[3]); err != nil {
+			return nil, err
+		}
+		if len(t.BFDStatus) == 0 {
+			t.BFDStatus = nil
+		}
+		tunnels = append(tunnels, t)
+	}
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Name < tunnels[j].Name })
+	return tunnels, nil
+}
@@ -0,0 +1,87 @@
+package ovs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// VSwitchdOtherConfig ovs-vsctl --if-exists get Open_vSwitch . other_config:key
+// It returns "" if key is unset.
+func VSwitchdOtherConfig(key string) (string, error) {
+	out, err := run("ovs-vsctl", "--if-exists", "get", "Open_vSwitch", ".", "other_config:"+key)
+	if err != nil {
+		return "", fmt.Errorf("failed to get other_config:%s: %v", key, err)
+	}
+	value := string(out)
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		value = unquoted
+	}
+	return value, nil
+}
+
+// SetVSwitchdOtherConfig sets other_config:key of ovs-vswitchd unless it
+// already holds value. These settings apply to the whole node.
+func SetVSwitchdOtherConfig(key, value string) error {
+	current, err := VSwitchdOtherConfig(key)
+	if err != nil {
+		return err
+	}
+	if current == value {
+		return nil
+	}
+	if _, err := run("ovs-vsctl", "set", "Open_vSwitch", ".", fmt.Sprintf("other_config:%s=%s", key, strconv.Quote(value))); err != nil {
+		return fmt.Errorf("failed to set other_config:%s: %v", key, err)
+	}
+	return nil
+}
+
+// SetSSL ovs-vsctl set-ssl key.pem cert.pem cacert.pem
+// The SSL settings are shared by every controller of the node.
+func SetSSL(privateKey, certificate, caCert string) error {
+	if _, err := run("ovs-vsctl", "set-ssl", privateKey, certificate, caCert); err != nil {
+		return fmt.Errorf("failed to set ssl: %v", err)
+	}
+	return nil
+}
+
+// DPDKInitialized ovs-vsctl get Open_vSwitch . dpdk_initialized
+// OVS before 2.10 lacks the column and fails.
+func DPDKInitialized() (bool, error) {
+	out, err := run("ovs-vsctl", "get", "Open_vSwitch", ".", "dpdk_initialized")
+	if err != nil {
+		return false, fmt.Errorf("failed to get dpdk_initialized: %v", err)
+	}
+	return string(out) == "true", nil
+}
+
+// DatapathTypes ovs-vsctl get Open_vSwitch . datapath_types
+// It is empty until ovs-vswitchd filled it in.
+func DatapathTypes() ([]string, error) {
+	out, err := run("ovs-vsctl", "get", "Open_vSwitch", ".", "datapath_types")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get datapath_types: %v", err)
+	}
+	// e.g. [netdev, system]
+	var types []string
+	for _, t := range strings.Split(strings.Trim(string(out), "[]"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	return types, nil
+}
+
+// SystemID ovs-vsctl --if-exists get Open_vSwitch . external_ids:system-id
+// It returns "" if the system-id is unset.
+func SystemID() (string, error) {
+	out, err := run("ovs-vsctl", "--if-exists", "get", "Open_vSwitch", ".", "external_ids:system-id")
+	if err != nil {
+		return "", fmt.Errorf("failed to get system-id: %v", err)
+	}
+	id := string(out)
+	if unquoted, err := strconv.Unquote(id); err == nil {
+		id = unquoted
+	}
+	return id, nil
+}
@@ -0,0 +1,102 @@
+package ovsconf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadNetConfSecondaryBridge(t *testing.T) {
+	n, _, err := LoadNetConf([]byte(`{
+		"cniVersion": "0.3.1",
+		"name": "net",
+		"type": "ovsbridge",
+		"bridge": "br-int",
+		"controller": "tcp:10.1.14.2:6653",
+		"failMode": "secure",
+		"protocols": ["OpenFlow13"],
+		"qosType": "linux-hfsc",
+		"bandwidth": {"maxRate": 1000000},
+		"device": "eth1",
+		"secondaryBridge": {
+			"bridge": "br-ex",
+			"controller": "tcp:10.1.14.3:6653",
+			"failMode": "standalone",
+			"rstp": true
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("LoadNetConf: %v", err)
+	}
+	if n.BrName != "br-int" || n.Controller != "tcp:10.1.14.2:6653" || n.FailMode != "secure" {
+		t.Errorf("primary bridge = %q, controller %q, failMode %q", n.BrName, n.Controller, n.FailMode)
+	}
+	if n.RSTP {
+		t.Errorf("rstp of the secondary bridge applied to the primary one")
+	}
+	sb := n.SecondaryBridge
+	if sb == nil {
+		t.Fatal("no secondary bridge")
+	}
+	if sb.BrName != "br-ex" || sb.Controller != "tcp:10.1.14.3:6653" || sb.FailMode != "standalone" || !sb.RSTP {
+		t.Errorf("secondary bridge = %q, controller %q, failMode %q, rstp %t", sb.BrName, sb.Controller, sb.FailMode, sb.RSTP)
+	}
+	if len(sb.Protocols) != 0 {
+		t.Errorf("secondary bridge inherited protocols %v", sb.Protocols)
+	}
+	if n.Bandwidth.QoSType != QoSTypeHFSC {
+		t.Errorf("bandwidth qosType = %q, want the bridge's %q", n.Bandwidth.QoSType, QoSTypeHFSC)
+	}
+}
+
+func TestLoadNetConfSingleBridge(t *testing.T) {
+	n, _, err := LoadNetConf([]byte(`{
+		"cniVersion": "0.3.1",
+		"name": "net",
+		"type": "ovsbridge",
+		"bridge": "br0",
+		"controller": "tcp:10.1.14.2:6653",
+		"bandwidth": {"maxRate": 1000000},
+		"device": "eth1"
+	}`))
+	if err != nil {
+		t.Fatalf("LoadNetConf: %v", err)
+	}
+	if n.Controller != "tcp:10.1.14.2:6653" || n.SecondaryBridge != nil {
+		t.Errorf("controller %q, secondary bridge %v", n.Controller, n.SecondaryBridge)
+	}
+	if n.Bandwidth.QoSType != QoSTypeHTB {
+		t.Errorf("bandwidth qosType = %q, want %q", n.Bandwidth.QoSType, QoSTypeHTB)
+	}
+}
+
+func TestValidateSecondaryBridge(t *testing.T) {
+	tests := []struct {
+		name      string
+		secondary string
+		err       string
+	}{
+		{"valid", `{"bridge": "br-ex", "controller": "tcp:10.1.14.3:6653"}`, ""},
+		{"no bridge", `{"controller": "tcp:10.1.14.3:6653"}`, "needs a bridge other than"},
+		{"same bridge", `{"bridge": "br-int"}`, "needs a bridge other than"},
+		{"bad fail mode", `{"bridge": "br-ex", "failMode": "open"}`, `unknown failMode "open"`},
+		{"qos type", `{"bridge": "br-ex", "qosType": "linux-htb"}`, "has no container queues"},
+		{"datapath", `{"bridge": "br-ex", "datapathType": "netdev"}`, "patch ports need the datapathType"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := LoadNetConf([]byte(`{
+				"cniVersion": "0.3.1",
+				"name": "net",
+				"type": "ovsbridge",
+				"bridge": "br-int",
+				"secondaryBridge": ` + tt.secondary + `
+			}`))
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error = %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
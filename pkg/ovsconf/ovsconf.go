@@ -0,0 +1,1172 @@
+// Package ovsconf holds the network configuration of the ovsbridge plugin so
+// tooling outside the plugin can load and validate it with the same rules.
+package ovsconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/digitalocean/go-openvswitch/ovs"
+)
+
+// DefaultBrName is the bridge used when the config does not name one
+const DefaultBrName = "ovsbr0"
+
+// DefaultStateDir is where the plugin keeps its node local state
+const DefaultStateDir = "/var/lib/cni/cnie"
+
+// DefaultVethRetries is how often the veth pair is retried if the config
+// does not say
+const DefaultVethRetries = 10
+
+// DefaultAddTimeout is the AddTimeout if the config does not set one
+const DefaultAddTimeout = 30000
+
+// DefaultOFPortTimeout is the OFPortTimeout if the config does not set one
+const DefaultOFPortTimeout = 10
+
+// HostConfPath is the node local file holding the HostConf. Network configs
+// cannot point elsewhere, so tenants cannot bypass it.
+var HostConfPath = "/etc/cni/cnie/host.json"
+
+// HostConf holds guardrails the node operator sets for every network config
+type HostConf struct {
+	// ForbiddenVlans are infrastructure VLANs containers may not be put on
+	ForbiddenVlans []int `json:"forbiddenVlans"`
+	// MaxPortsPerBridge caps the container ports of a bridge, 0 for no cap
+	MaxPortsPerBridge int `json:"maxPortsPerBridge"`
+	// BridgeProfiles are bridge settings network configs refer to by name
+	// with bridgeProfile
+	BridgeProfiles map[string]*BridgeProfile `json:"bridgeProfiles"`
+}
+
+// BridgeProfile holds the bridge settings shared by the network configs
+// naming it. A key set in the network config overrides the profile's.
+type BridgeProfile struct {
+	BridgeConf
+}
+
+// LoadHostConf reads the HostConf at path, a missing file is an empty one
+func LoadHostConf(path string) (*HostConf, error) {
+	h := &HostConf{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host config: %v", err)
+	}
+	if err := json.Unmarshal(data, h); err != nil {
+		return nil, fmt.Errorf("failed to load host config %q: %v", path, err)
+	}
+	return h, nil
+}
+
+// Check fails if n asks for something the host config forbids. Only ADD
+// checks, so a DEL still works after the host config got stricter.
+func (h *HostConf) Check(n *NetConf) error {
+	for _, vlan := range h.ForbiddenVlans {
+		if n.Vlan != 0 && n.Vlan == vlan {
+			return fmt.Errorf("vlan %d is reserved on this node", vlan)
+		}
+		if n.NativeVlan != 0 && n.NativeVlan == vlan {
+			return fmt.Errorf("nativeVlan %d is reserved on this node", vlan)
+		}
+		if n.PNICVlan != 0 && n.PNICVlan == vlan {
+			return fmt.Errorf("pnicVlan %d is reserved on this node", vlan)
+		}
+	}
+	return nil
+}
+
+// Port types connecting the container to the bridge
+const (
+	PortTypeVeth = "veth"
+	PortTypeTap  = "tap"
+	PortTypeVF   = "vf"
+	// macvlan and ipvlan are created over Device and bypass the bridge
+	PortTypeMacvlan = "macvlan"
+	PortTypeIPVlan  = "ipvlan"
+)
+
+// pciAddrRe matches a PCI address such as 0000:03:00.2
+var pciAddrRe = regexp.MustCompile(`^[0-9a-fA-F]{4}:[0-9a-fA-F]{2}:[0-9a-fA-F]{2}\.[0-7]$`)
+
+// portGroupRe matches the names allowed for portGroup
+var portGroupRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,63}$`)
+
+// Policies for a port left on the bridge by an earlier ADD of the same
+// container id and ifname
+const (
+	StaleReplace = "replace"
+	StaleReuse   = "reuse"
+)
+
+// Policies for a container interface whose host end is a port of another
+// bridge, they apply to foreignDevice as well
+const (
+	ForeignPortError    = "error"
+	ForeignPortReattach = "reattach"
+)
+
+// Policies for an interface of another plugin already in the container
+// netns under the container interface's name
+const (
+	IfNameCollisionError  = "error"
+	IfNameCollisionRename = "rename"
+	IfNameCollisionReuse  = "reuse"
+)
+
+// Policies for a plugin lacking the capabilities it needs
+const (
+	CapabilityCheckError = "error"
+	CapabilityCheckWarn  = "warn"
+	CapabilityCheckOff   = "off"
+)
+
+// Policies for members of a bond or team device that disagree on their MTU
+const (
+	BondMismatchError = "error"
+	BondMismatchWarn  = "warn"
+)
+
+// Kinds of bridge the host veth end is connected to
+const (
+	HostBridgeOVS   = "ovs"
+	HostBridgeLinux = "linux"
+)
+
+// Admin states the container interface is left in
+const (
+	LinkStateUp   = "up"
+	LinkStateDown = "down"
+)
+
+// Ways of attaching Device to the bridge
+const (
+	// DeviceAttachDefault adds Device as a port and leaves its addresses
+	DeviceAttachDefault = "default"
+	// DeviceAttachSeamless moves the addresses and routes of Device to the
+	// bridge interface around adding it, so the host stays reachable
+	DeviceAttachSeamless = "seamless"
+)
+
+// DefaultControllerProtocols are the protocols of a bridge with a controller
+// whose config does not list any, so the controller can negotiate the
+// version it needs
+var DefaultControllerProtocols = []string{"OpenFlow10", "OpenFlow11", "OpenFlow12", "OpenFlow13", "OpenFlow14", "OpenFlow15"}
+
+// BridgeConf holds the settings applied to an OVS bridge. It is embedded in
+// NetConf so a single-bridge config keeps these keys at the top level.
+type BridgeConf struct {
+	Controller string   `json:"controller"`
+	FailMode   string   `json:"failMode"`
+	Protocols  []string `json:"protocols"`
+	// L2Normal makes the bridge a plain learning switch whatever the state
+	// of its controller: fail mode standalone and a table-miss NORMAL flow
+	L2Normal bool `json:"l2Normal"`
+	// DatapathType is set on a new bridge and required of an existing one
+	DatapathType string `json:"datapathType"`
+	// controller connection tuning in milliseconds
+	ControllerInactivityProbe int `json:"controllerInactivityProbe"`
+	ControllerMaxBackoff      int `json:"controllerMaxBackoff"`
+	// paths of the TLS files used for an ssl: controller
+	ControllerPrivateKey  string `json:"controllerPrivateKey"`
+	ControllerCertificate string `json:"controllerCertificate"`
+	ControllerCACert      string `json:"controllerCACert"`
+	// Tunnels are added to the bridge as ports
+	Tunnels []TunnelConf `json:"tunnels"`
+	// TunnelCsum is the csum of tunnels that do not set their own, nil keeps
+	// the OVS default
+	TunnelCsum *bool `json:"tunnelCsum"`
+	// RSTP turns on rapid spanning tree on the bridge, which the stp and
+	// uplinkSTP port settings are for
+	RSTP bool `json:"rstp"`
+	// QoSType is the scheduler of the bridge's QoS record for the bandwidth
+	// configs that do not set their own
+	QoSType string `json:"qosType"`
+}
+
+// SecondaryBridgeConf is an OVS bridge set up next to the container's one
+// with settings of its own, e.g. an external bridge with another controller,
+// and connected to it by a pair of patch ports
+type SecondaryBridgeConf struct {
+	BrName string `json:"bridge"`
+	BridgeConf
+}
+
+// TunnelConf is a VXLAN, GENEVE or GRE port of the bridge
+type TunnelConf struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	RemoteIP string `json:"remoteIP"`
+	// Key is the VNI or GRE key, a number or "flow"
+	Key string `json:"key"`
+	// Csum computes the checksum of the outer header on transmit
+	Csum *bool `json:"csum"`
+	// BFD runs a BFD session over a VXLAN or GENEVE tunnel
+	BFD bool `json:"bfd"`
+}
+
+// BandwidthConf guarantees and caps the traffic a container sends out of the
+// uplink device, in bits per second. A zero rate is left unset.
+type BandwidthConf struct {
+	MinRate uint64 `json:"minRate"`
+	MaxRate uint64 `json:"maxRate"`
+	// QoSType is the scheduler of the bridge's QoS record, QoSTypeHTB if
+	// empty
+	QoSType string `json:"qosType"`
+}
+
+// Schedulers a QoS record can use
+const (
+	QoSTypeHTB  = "linux-htb"
+	QoSTypeHFSC = "linux-hfsc"
+	QoSTypeSFQ  = "linux-sfq"
+)
+
+// MeterConf polices the traffic a container sends with an OpenFlow meter
+type MeterConf struct {
+	// Rate is in kbit/s
+	Rate uint64 `json:"rate"`
+	// Burst is in kbit, 0 leaves it to the datapath
+	Burst uint64 `json:"burst"`
+}
+
+// PortSTPConf are the RSTP settings of a port, nil keeps the OVS default
+type PortSTPConf struct {
+	// Priority is 0 to 240 in steps of 16, lower wins the tie-break
+	Priority *int `json:"priority"`
+	// PathCost is 1 to 200000000, by default derived from the link speed
+	PathCost *int `json:"pathCost"`
+	// AdminEdge declares the port an edge port, facing no other bridge
+	AdminEdge *bool `json:"adminEdge"`
+	// AutoEdge lets RSTP detect whether the port is an edge port
+	AutoEdge *bool `json:"autoEdge"`
+}
+
+// OtherConfig returns the port other_config keys of c
+func (c *PortSTPConf) OtherConfig() map[string]string {
+	config := map[string]string{}
+	if c.Priority != nil {
+		config["rstp-port-priority"] = strconv.Itoa(*c.Priority)
+	}
+	if c.PathCost != nil {
+		config["rstp-path-cost"] = strconv.Itoa(*c.PathCost)
+	}
+	if c.AdminEdge != nil {
+		config["rstp-port-admin-edge"] = strconv.FormatBool(*c.AdminEdge)
+	}
+	if c.AutoEdge != nil {
+		config["rstp-port-auto-edge"] = strconv.FormatBool(*c.AutoEdge)
+	}
+	return config
+}
+
+func (c *PortSTPConf) validate(key string) error {
+	if p := c.Priority; p != nil && (*p < 0 || *p > 240 || *p%16 != 0) {
+		return fmt.Errorf("%s priority %d must be 0 to 240 in steps of 16", key, *p)
+	}
+	if p := c.PathCost; p != nil && (*p < 1 || *p > 200000000) {
+		return fmt.Errorf("%s pathCost %d must be 1 to 200000000", key, *p)
+	}
+	return nil
+}
+
+// NeighborConf is a static ARP or NDP entry of the container interface
+type NeighborConf struct {
+	IP  string `json:"ip"`
+	MAC string `json:"mac"`
+}
+
+// SyslogConf sends the plugin's log to the local syslog
+type SyslogConf struct {
+	// Facility is local0 to local7, local0 if empty
+	Facility string `json:"facility"`
+	// Only stops logging to stderr as well
+	Only bool `json:"only"`
+}
+
+// TracingConf exports a trace of each ADD and DEL to an OpenTelemetry
+// collector
+type TracingConf struct {
+	// Endpoint is the OTLP/HTTP traces URL, e.g.
+	// http://localhost:4318/v1/traces
+	Endpoint string `json:"endpoint"`
+	// ServiceName is the service.name of the spans, cnie if empty
+	ServiceName string `json:"serviceName"`
+	// Timeout bounds the export in milliseconds, 1000 if zero
+	Timeout int `json:"timeout"`
+}
+
+// EgressNATConf masquerades the container's IPv4 traffic with OVS conntrack
+type EgressNATConf struct {
+	// ExternalIP is the source address traffic leaves with, the bridge
+	// interface's IPv4 address if empty
+	ExternalIP string `json:"externalIP"`
+}
+
+// VSwitchdConf holds ovs-vswitchd settings. They are node global rather than
+// per pod, so they are only applied when Enable is set.
+type VSwitchdConf struct {
+	Enable bool `json:"enable"`
+	// FlowLimit caps the datapath flows, MaxIdle (ms) is how long an idle
+	// datapath flow is kept
+	FlowLimit int `json:"flowLimit"`
+	MaxIdle   int `json:"maxIdle"`
+	// EnableStatistics makes ovs-vswitchd collect its system statistics
+	EnableStatistics bool `json:"enableStatistics"`
+}
+
+// NetConf is the network configuration of the ovsbridge plugin
+type NetConf struct {
+	types.NetConf
+	BrName string `json:"bridge"`
+	MTU    int    `json:"mtu"`
+	// HostMTU is the MTU of the host veth end, MTU if zero
+	HostMTU int    `json:"hostMTU"`
+	Device  string `json:"device"`
+	// DeviceFallback are tried in order when Device is missing on the node
+	DeviceFallback []string `json:"deviceFallback"`
+	// DeviceOptional leaves the bridge without an uplink rather than failing
+	// the ADD when neither Device nor a fallback exists
+	DeviceOptional bool `json:"deviceOptional"`
+	// DeviceMTU is set on a bond or team Device and all its members
+	DeviceMTU int `json:"deviceMTU"`
+	// DevicePromisc puts Device, and the members of a bond or team Device,
+	// in promiscuous mode
+	DevicePromisc bool `json:"devicePromisc"`
+	// BondMismatch is the policy for members of a bond or team Device that
+	// disagree on their MTU, error by default
+	BondMismatch string `json:"bondMismatch"`
+	// PortType is veth by default, tap for a netdev datapath bridge, vf
+	// for the SR-IOV VF at DeviceID, or macvlan or ipvlan over Device
+	PortType string `json:"portType"`
+	// DeviceID is the PCI address of the VF the SR-IOV device plugin
+	// allocated, also accepted in runtimeConfig
+	DeviceID      string `json:"deviceID"`
+	RuntimeConfig struct {
+		DeviceID string `json:"deviceID"`
+		// Routes are added after those of IPAM
+		Routes []*types.Route `json:"routes"`
+	} `json:"runtimeConfig"`
+	// StalePorts is the policy for stale ports, replace by default
+	StalePorts string `json:"stalePorts"`
+	// ForeignPort is the policy for a container interface already attached
+	// to another bridge, error by default
+	ForeignPort string `json:"foreignPort"`
+	// ForeignDevice is the policy for a Device that is already a port of
+	// another OVS bridge, error by default
+	ForeignDevice string `json:"foreignDevice"`
+	// IfNameCollision is the policy for an interface already in the
+	// container netns under the container interface's name, error by default
+	IfNameCollision string `json:"ifNameCollision"`
+	// ContainerInterfaceName replaces the interface name the runtime asks for
+	ContainerInterfaceName string `json:"containerInterfaceName"`
+	// IfAlias is the alias template of the container interface
+	IfAlias string `json:"ifAlias"`
+	// HostVethPrefix starts the host veth names, veth by default
+	HostVethPrefix string `json:"hostVethPrefix"`
+	// VethRetries bounds how often creating the veth pair is retried after a
+	// host name clash or a transient netlink error, 10 by default
+	VethRetries int `json:"vethRetries"`
+	// HostBridgeType makes BrName a Linux bridge the host veth end is
+	// enslaved to rather than an OVS bridge, HostBridgeOVS if empty
+	HostBridgeType string `json:"hostBridgeType"`
+	// LinkState is the admin state the container interface is left in,
+	// LinkStateUp if empty
+	LinkState string `json:"linkState"`
+	// SafeBringup drops the container's traffic until its addresses,
+	// routes and flows are in place
+	SafeBringup bool `json:"safeBringup"`
+	// ClampMSS caps the MTU and TCP MSS of the container's routes to the
+	// smaller of the container interface's and the uplink's MTU
+	ClampMSS bool `json:"clampMSS"`
+	// TxQueueLen is set on both veth ends, zero keeps the kernel default
+	TxQueueLen int `json:"txQueueLen"`
+	// OffloadFeatures turns offloads of both veth ends on or off, keyed by
+	// their ethtool -K name
+	OffloadFeatures map[string]bool `json:"offloadFeatures"`
+	// OVSNetns is the path of the netns the bridge lives in, if not the
+	// plugin's own
+	OVSNetns string `json:"ovsNetns"`
+	// ForceDetachPNIC allows detaching Device from a Linux bridge or bond
+	ForceDetachPNIC bool `json:"forceDetachPNIC"`
+	// PNICVlan attaches the sub-interface of Device for that VLAN instead of
+	// Device itself, creating it if needed
+	PNICVlan int `json:"pnicVlan"`
+	// NativeVlan is the VLAN of the untagged frames of a trunk Device. The
+	// uplink port carries it untagged and all other VLANs tagged.
+	NativeVlan int `json:"nativeVlan"`
+	// DeviceAttach is how Device is attached, DeviceAttachDefault if empty
+	DeviceAttach string `json:"deviceAttach"`
+	// GARPCount gratuitous ARPs are sent GARPInterval milliseconds apart
+	GARPCount    int `json:"garpCount"`
+	GARPInterval int `json:"garpInterval"`
+	// AddTimeout bounds the OVS commands of an ADD, in milliseconds from its
+	// start, 30s by default and no bound if zero. Netlink, IPAM and the
+	// link up wait are not bounded by it.
+	AddTimeout int `json:"addTimeout"`
+	// LinkUpTimeout bounds how long ADD waits, in milliseconds, for Device
+	// to be up; zero does not wait
+	LinkUpTimeout int `json:"linkUpTimeout"`
+	// OFPortTimeout bounds how long ADD waits, in seconds, for OVS to give
+	// the container port an ofport before flows use it; zero does not wait
+	OFPortTimeout int `json:"ofportTimeout"`
+	// StateDir is where the plugin keeps its node local state
+	StateDir string `json:"stateDir"`
+	// IPAMCache keeps the IPAM allocation of a failed ADD under StateDir for
+	// the retry, until DEL releases it
+	IPAMCache bool `json:"ipamCache"`
+	// Verbose logs the Open vSwitch version of each invocation and a summary
+	// of each DEL's teardown
+	Verbose bool `json:"verbose"`
+	// Syslog sends the log to syslog, it goes to stderr only if unset
+	Syslog *SyslogConf `json:"syslog"`
+	// CapabilityCheck is the policy for a plugin running without
+	// CAP_NET_ADMIN or CAP_SYS_ADMIN, error by default
+	CapabilityCheck string `json:"capabilityCheck"`
+	// Tracing exports a trace of each invocation, also enabled by
+	// CNIE_OTLP_ENDPOINT
+	Tracing *TracingConf `json:"tracing"`
+	// DebugDir keeps the config and result of every ADD for debugging
+	DebugDir string `json:"debugDir"`
+	// LockFile serializes the ADDs and DELs of the bridge, by default
+	// locks/<bridge>.lock under StateDir
+	LockFile string `json:"lockFile"`
+	// OVSBinDir holds ovs-vsctl and ovs-ofctl when they are not in PATH
+	OVSBinDir string `json:"ovsBinDir"`
+	// OVSDB is the database ovs-vsctl connects to, the local one if empty
+	OVSDB string `json:"ovsdb"`
+	// OVSSystemID is the external_ids:system-id the Open vSwitch ADD talks
+	// to must have, any if empty
+	OVSSystemID string `json:"ovsSystemID"`
+	// paths of the TLS files used for an ssl: OVSDB
+	OVSDBPrivateKey  string `json:"ovsdbPrivateKey"`
+	OVSDBCertificate string `json:"ovsdbCertificate"`
+	OVSDBCACert      string `json:"ovsdbCACert"`
+	// PortGroup tags the container port for ACL controllers
+	PortGroup string `json:"portGroup"`
+	// Vlan makes the container port an access port of that VLAN
+	Vlan int `json:"vlan"`
+	// Isolate installs flows keeping the container within Vlan
+	Isolate bool `json:"isolate"`
+	// Protected keeps the container from reaching other protected ports
+	// directly
+	Protected bool `json:"protected"`
+	// MAC pins the MAC address of the container interface
+	MAC string `json:"mac"`
+	// MACPrefix is the OUI of MACs generated from the attachment when MAC
+	// is not set
+	MACPrefix string `json:"macPrefix"`
+	// StickyMAC generates the MAC from the pod's namespace and name instead
+	// of the attachment, under MACPrefix if set
+	StickyMAC bool `json:"stickyMAC"`
+	// RejectDuplicateMAC fails the ADD if another container on the bridge
+	// already uses MAC
+	RejectDuplicateMAC bool `json:"rejectDuplicateMAC"`
+	// SkipDAD makes the container's IPv6 addresses usable without duplicate
+	// address detection
+	SkipDAD bool `json:"skipDAD"`
+	// AcceptRA is accept_ra of the container interface. It defaults to 0
+	// when IPAM assigns an IPv6 address and to the kernel's otherwise.
+	AcceptRA *int `json:"acceptRA"`
+	// Autoconf is whether the container interface configures SLAAC
+	// addresses from RAs
+	Autoconf *bool `json:"autoconf"`
+	// ProxyARP makes the container interface answer ARP for the addresses
+	// it routes
+	ProxyARP bool `json:"proxyARP"`
+	// GatewayMAC installs a permanent neighbor entry for the IPAM gateway
+	GatewayMAC string `json:"gatewayMAC"`
+	// Neighbors are permanent neighbor entries added in the container
+	Neighbors []NeighborConf `json:"neighbors"`
+	// SetupLoopback brings lo up in the container for runtimes that do not
+	SetupLoopback bool `json:"setupLoopback"`
+	// DrainGrace is how many seconds DEL lets established connections run
+	// after blocking new ones
+	DrainGrace int `json:"drainGrace"`
+	// VerifyDel makes DEL check that the port and interface are really gone
+	VerifyDel bool `json:"verifyDel"`
+	// QuarantineDel is for debugging only: DEL releases the address but
+	// leaves the port blocked on the bridge until gc reaps it
+	QuarantineDel bool `json:"quarantineDel"`
+	// ReconfigureOnChange makes a repeated ADD whose config only changed
+	// port settings apply them to the existing port instead of failing
+	ReconfigureOnChange bool `json:"reconfigureOnChange"`
+	// Meter rate limits the container port with an OpenFlow meter
+	Meter *MeterConf `json:"meter"`
+	// DSCP marks the IP traffic the container sends with this codepoint
+	DSCP *int `json:"dscp"`
+	// EgressUplink is the port of the bridge the container's IP traffic
+	// leaves through, whichever uplink NORMAL switching would pick
+	EgressUplink string `json:"egressUplink"`
+	// EgressDeny are the CIDRs the container may not send IP traffic to.
+	// EgressAllow, if not empty, are the only ones it may, unless denied.
+	EgressDeny  []string `json:"egressDeny"`
+	EgressAllow []string `json:"egressAllow"`
+	// STP are the RSTP settings of the container port
+	STP *PortSTPConf `json:"stp"`
+	// UplinkSTP are the RSTP settings of the port of Device
+	UplinkSTP *PortSTPConf `json:"uplinkSTP"`
+	// PinFlows installs flows for the container port that never time out
+	// and are evicted last, see ovs.Flows.PinPort
+	PinFlows bool `json:"pinFlows"`
+	// FlowsFile is a file of flows installed for the container port, see
+	// ovs.LoadFlowsTemplate
+	FlowsFile string `json:"flowsFile"`
+	// EgressNAT installs per-port SNAT flows
+	EgressNAT *EgressNATConf `json:"egressNAT"`
+	// CTZone is the conntrack zone of the container's ct() flows, the Vlan
+	// (zone 0 without one) if unset. See ConntrackZone.
+	CTZone *int `json:"ctZone"`
+	// VSwitchd tunes ovs-vswitchd for the whole node
+	VSwitchd *VSwitchdConf `json:"vswitchd"`
+	// Bandwidth gives the container its own queue on Device
+	Bandwidth *BandwidthConf `json:"bandwidth"`
+	// BridgeProfile names the HostConf bridge profile the bridge settings
+	// default to
+	BridgeProfile string `json:"bridgeProfile"`
+	// BridgeConf are the settings of the primary bridge, BrName
+	BridgeConf
+	// SecondaryBridge is patched to the primary bridge
+	SecondaryBridge *SecondaryBridgeConf `json:"secondaryBridge"`
+}
+
+// LoadNetConf parses bytes into a NetConf with defaults applied and validates
+// it. It also returns the requested CNI version.
+func LoadNetConf(bytes []byte) (*NetConf, string, error) {
+	n := &NetConf{
+		BrName:         DefaultBrName,
+		HostVethPrefix: "veth",
+		VethRetries:    DefaultVethRetries,
+		AddTimeout:     DefaultAddTimeout,
+		OFPortTimeout:  DefaultOFPortTimeout,
+		StateDir:       DefaultStateDir,
+		GARPCount:      1,
+	}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
+	}
+	profile, err := n.bridgeProfile()
+	if err != nil {
+		return nil, "", err
+	}
+	if profile != nil {
+		// the profile goes first, the keys of the config then override it
+		n.BridgeConf = profile.BridgeConf
+		if err := json.Unmarshal(bytes, n); err != nil {
+			return nil, "", fmt.Errorf("failed to load netconf: %v", err)
+		}
+	}
+	if n.DeviceID == "" {
+		n.DeviceID = n.RuntimeConfig.DeviceID
+	}
+	if n.Bandwidth != nil && n.Bandwidth.QoSType == "" {
+		n.Bandwidth.QoSType = QoSTypeHTB
+		if n.QoSType != "" {
+			n.Bandwidth.QoSType = n.QoSType
+		}
+	}
+	if err := n.Validate(); err != nil {
+		return nil, "", err
+	}
+	return n, n.CNIVersion, nil
+}
+
+// bridgeProfile returns the profile of the host config n names, nil if it
+// names none
+func (n *NetConf) bridgeProfile() (*BridgeProfile, error) {
+	if n.BridgeProfile == "" {
+		return nil, nil
+	}
+	h, err := LoadHostConf(HostConfPath)
+	if err != nil {
+		return nil, err
+	}
+	profile := h.BridgeProfiles[n.BridgeProfile]
+	if profile == nil {
+		return nil, fmt.Errorf("bridgeProfile %q is not defined in %s", n.BridgeProfile, HostConfPath)
+	}
+	return profile, nil
+}
+
+// ConntrackZone is the zone the container's connections are tracked in:
+// CTZone if set, else the Vlan, so tenants on different VLANs get separate
+// connection tables without configuring anything
+func (n *NetConf) ConntrackZone() int {
+	if n.CTZone != nil {
+		return *n.CTZone
+	}
+	return n.Vlan
+}
+
+// ovsPortSettings tells which of the settings applied to the container's
+// OVS port n sets
+func (n *NetConf) ovsPortSettings() map[string]bool {
+	return map[string]bool{
+		"vlan":                n.Vlan != 0,
+		"isolate":             n.Isolate,
+		"protected":           n.Protected,
+		"portGroup":           n.PortGroup != "",
+		"bandwidth":           n.Bandwidth != nil,
+		"meter":               n.Meter != nil,
+		"dscp":                n.DSCP != nil,
+		"egressNAT":           n.EgressNAT != nil,
+		"egressUplink":        n.EgressUplink != "",
+		"egressAllow":         len(n.EgressAllow) > 0,
+		"egressDeny":          len(n.EgressDeny) > 0,
+		"quarantineDel":       n.QuarantineDel,
+		"reconfigureOnChange": n.ReconfigureOnChange,
+		"safeBringup":         n.SafeBringup,
+		"drainGrace":          n.DrainGrace != 0,
+		"flowsFile":           n.FlowsFile != "",
+		"pinFlows":            n.PinFlows,
+		"stp":                 n.STP != nil,
+	}
+}
+
+// setKeys returns the keys of settings that are set, sorted
+func setKeys(settings map[string]bool) []string {
+	var keys []string
+	for key, set := range settings {
+		if set {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validateLinuxBridge rejects the settings a Linux bridge cannot apply,
+// they all configure the OVS bridge or port
+func (n *NetConf) validateLinuxBridge() error {
+	ovsOnly := n.ovsPortSettings()
+	ovsOnly["portType"] = n.PortType != "" && n.PortType != PortTypeVeth
+	ovsOnly["device"] = n.Device != ""
+	ovsOnly["controller"] = n.Controller != ""
+	ovsOnly["tunnels"] = len(n.Tunnels) > 0
+	ovsOnly["ovsdb"] = n.OVSDB != ""
+	ovsOnly["bridgeProfile"] = n.BridgeProfile != ""
+	ovsOnly["rstp"] = n.RSTP
+	ovsOnly["qosType"] = n.QoSType != ""
+	ovsOnly["secondaryBridge"] = n.SecondaryBridge != nil
+	if keys := setKeys(ovsOnly); len(keys) > 0 {
+		return fmt.Errorf("hostBridgeType linux cannot apply %s, they need an OVS bridge", strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// validateSubLink checks a macvlan or ipvlan port type. The link hangs off
+// Device rather than a port of the bridge, so there is no port to apply the
+// port settings to.
+func (n *NetConf) validateSubLink() error {
+	if n.Device == "" {
+		return fmt.Errorf("portType %s requires device, the pNIC to create the link over", n.PortType)
+	}
+	if len(n.DeviceFallback) > 0 || n.DeviceOptional {
+		return fmt.Errorf("portType %s cannot use deviceFallback or deviceOptional, the link needs device", n.PortType)
+	}
+	settings := n.ovsPortSettings()
+	settings["nativeVlan"] = n.NativeVlan != 0
+	settings["pnicVlan"] = n.PNICVlan != 0
+	settings["uplinkSTP"] = n.UplinkSTP != nil
+	settings["devicePromisc"] = n.DevicePromisc
+	if keys := setKeys(settings); len(keys) > 0 {
+		return fmt.Errorf("portType %s cannot apply %s, they need an OVS port", n.PortType, strings.Join(keys, ", "))
+	}
+	// an ipvlan has the MAC of its parent
+	if n.PortType == PortTypeIPVlan && (n.MAC != "" || n.MACPrefix != "" || n.StickyMAC) {
+		return fmt.Errorf("portType ipvlan cannot set mac, macPrefix or stickyMAC, it shares the MAC of device")
+	}
+	return nil
+}
+
+// ApplyEnv overrides the few keys that are safe to change for a single
+// invocation with the CNIE_* variables getenv returns, so an operator can
+// debug one ADD without editing the network config. The variables take
+// precedence over the config, which takes precedence over the defaults.
+// Validate still has to pass afterwards.
+func (n *NetConf) ApplyEnv(getenv func(string) string) error {
+	if v := getenv("CNIE_OVS_BIN_DIR"); v != "" {
+		n.OVSBinDir = v
+	}
+	if v := getenv("CNIE_DEBUG_DIR"); v != "" {
+		n.DebugDir = v
+	}
+	if v := getenv("CNIE_VERBOSE"); v != "" {
+		verbose, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid CNIE_VERBOSE %q: %v", v, err)
+		}
+		n.Verbose = verbose
+	}
+	if v := getenv("CNIE_OTLP_ENDPOINT"); v != "" {
+		if n.Tracing == nil {
+			n.Tracing = &TracingConf{}
+		}
+		n.Tracing.Endpoint = v
+	}
+	if v := getenv("CNIE_LINK_UP_TIMEOUT"); v != "" {
+		timeout, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid CNIE_LINK_UP_TIMEOUT %q: %v", v, err)
+		}
+		n.LinkUpTimeout = timeout
+	}
+	return nil
+}
+
+// Validate checks that the config only holds values the plugin can apply
+func (n *NetConf) Validate() error {
+	if n.GARPCount < 0 || n.GARPInterval < 0 {
+		return fmt.Errorf("garpCount and garpInterval must not be negative")
+	}
+	if name := n.ContainerInterfaceName; name != "" {
+		// IFNAMSIZ is 16 including the terminating NUL
+		if len(name) > 15 || strings.ContainsAny(name, "/: \t\n") || name == "." || name == ".." {
+			return fmt.Errorf("containerInterfaceName %q is not a valid interface name", name)
+		}
+	}
+	switch n.PortType {
+	case "", PortTypeVeth:
+	case PortTypeTap:
+		if n.DatapathType != "netdev" {
+			return fmt.Errorf("portType tap requires datapathType netdev")
+		}
+	case PortTypeVF:
+		if !pciAddrRe.MatchString(n.DeviceID) {
+			return fmt.Errorf("portType vf requires a PCI address as deviceID, got %q", n.DeviceID)
+		}
+	case PortTypeMacvlan, PortTypeIPVlan:
+		if err := n.validateSubLink(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown portType %q", n.PortType)
+	}
+	switch n.ForeignPort {
+	case "", ForeignPortError, ForeignPortReattach:
+	default:
+		return fmt.Errorf("unknown foreignPort policy %q", n.ForeignPort)
+	}
+	switch n.ForeignDevice {
+	case "", ForeignPortError, ForeignPortReattach:
+	default:
+		return fmt.Errorf("unknown foreignDevice policy %q", n.ForeignDevice)
+	}
+	switch n.CapabilityCheck {
+	case "", CapabilityCheckError, CapabilityCheckWarn, CapabilityCheckOff:
+	default:
+		return fmt.Errorf("unknown capabilityCheck policy %q", n.CapabilityCheck)
+	}
+	switch n.IfNameCollision {
+	case "", IfNameCollisionError, IfNameCollisionRename:
+	case IfNameCollisionReuse:
+		// the existing veth is taken as it is
+		if n.HostBridgeType == HostBridgeLinux || (n.PortType != "" && n.PortType != PortTypeVeth) {
+			return fmt.Errorf("ifNameCollision reuse needs a veth port on an OVS bridge")
+		}
+		if n.MAC != "" || n.MACPrefix != "" || n.StickyMAC {
+			return fmt.Errorf("ifNameCollision reuse cannot set mac, macPrefix or stickyMAC, the interface keeps its MAC")
+		}
+	default:
+		return fmt.Errorf("unknown ifNameCollision policy %q", n.IfNameCollision)
+	}
+	switch n.StalePorts {
+	case "", StaleReplace, StaleReuse:
+	default:
+		return fmt.Errorf("unknown stalePorts policy %q", n.StalePorts)
+	}
+	if n.LinkUpTimeout < 0 || n.DrainGrace < 0 || n.OFPortTimeout < 0 {
+		return fmt.Errorf("linkUpTimeout, drainGrace and ofportTimeout must not be negative")
+	}
+	if n.DeviceMTU < 0 {
+		return fmt.Errorf("deviceMTU must not be negative")
+	}
+	switch n.BondMismatch {
+	case "", BondMismatchError, BondMismatchWarn:
+	default:
+		return fmt.Errorf("unknown bondMismatch policy %q", n.BondMismatch)
+	}
+	// 68 is the smallest MTU IPv4 allows, 65535 the largest of a veth
+	for key, mtu := range map[string]int{"mtu": n.MTU, "hostMTU": n.HostMTU} {
+		if mtu != 0 && (mtu < 68 || mtu > 65535) {
+			return fmt.Errorf("%s %d must be between 68 and 65535", key, mtu)
+		}
+	}
+	if n.QuarantineDel && n.PortType == PortTypeVF {
+		return fmt.Errorf("quarantineDel cannot keep a VF, it goes back to the host with the container's netns")
+	}
+	if n.HostMTU != 0 && n.PortType != "" && n.PortType != PortTypeVeth {
+		return fmt.Errorf("hostMTU requires portType veth, the host end of a %s is not configured separately", n.PortType)
+	}
+	for name := range n.OffloadFeatures {
+		switch name {
+		case "rx", "tx", "sg", "tso", "gso", "gro":
+		default:
+			return fmt.Errorf("unknown offload feature %q, want rx, tx, sg, tso, gso or gro", name)
+		}
+	}
+	// 8 random hex digits follow within IFNAMSIZ
+	if p := n.HostVethPrefix; p == "" || len(p) > 7 || strings.ContainsAny(p, "/: \t\n") {
+		return fmt.Errorf("hostVethPrefix %q must be 1 to 7 characters valid in an interface name", p)
+	}
+	switch n.HostBridgeType {
+	case "", HostBridgeOVS:
+	case HostBridgeLinux:
+		if err := n.validateLinuxBridge(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown hostBridgeType %q, want ovs or linux", n.HostBridgeType)
+	}
+	switch n.LinkState {
+	case "", LinkStateUp, LinkStateDown:
+	default:
+		return fmt.Errorf("unknown linkState %q, want up or down", n.LinkState)
+	}
+	if n.AddTimeout < 0 {
+		return fmt.Errorf("addTimeout must not be negative")
+	}
+	if n.VethRetries < 0 {
+		return fmt.Errorf("vethRetries must not be negative")
+	}
+	if n.TxQueueLen < 0 {
+		return fmt.Errorf("txQueueLen must not be negative")
+	}
+	dbTLS := []string{n.OVSDBPrivateKey, n.OVSDBCertificate, n.OVSDBCACert}
+	if strings.HasPrefix(n.OVSDB, "ssl:") {
+		for _, path := range dbTLS {
+			if path == "" {
+				return fmt.Errorf("an ssl ovsdb requires ovsdbPrivateKey, ovsdbCertificate and ovsdbCACert")
+			}
+		}
+	} else if strings.Join(dbTLS, "") != "" {
+		return fmt.Errorf("ovsdb TLS files require an ssl: ovsdb")
+	}
+	if (len(n.DeviceFallback) > 0 || n.DeviceOptional) && n.Device == "" {
+		return fmt.Errorf("deviceFallback and deviceOptional require a device")
+	}
+	switch n.DeviceAttach {
+	case "", DeviceAttachDefault:
+	case DeviceAttachSeamless:
+		if n.Device == "" {
+			return fmt.Errorf("deviceAttach %q requires a device", n.DeviceAttach)
+		}
+		// nothing would forward the host's traffic until a controller
+		// installs flows
+		if ovs.FailMode(n.FailMode) == ovs.FailModeSecure {
+			return fmt.Errorf("deviceAttach %q cannot be combined with failMode secure", n.DeviceAttach)
+		}
+	default:
+		return fmt.Errorf("unknown deviceAttach %q, want default or seamless", n.DeviceAttach)
+	}
+	if n.PortGroup != "" && !portGroupRe.MatchString(n.PortGroup) {
+		return fmt.Errorf("portGroup %q must be 1-63 letters, digits, '-', '_' or '.'", n.PortGroup)
+	}
+	if n.PNICVlan != 0 {
+		if n.PNICVlan < 1 || n.PNICVlan > 4094 {
+			return fmt.Errorf("pnicVlan %d is out of range 1-4094", n.PNICVlan)
+		}
+		if n.Device == "" {
+			return fmt.Errorf("pnicVlan requires a device")
+		}
+	}
+	if n.NativeVlan != 0 {
+		if n.NativeVlan < 1 || n.NativeVlan > 4094 {
+			return fmt.Errorf("nativeVlan %d is out of range 1-4094", n.NativeVlan)
+		}
+		if n.Device == "" {
+			return fmt.Errorf("nativeVlan requires a device")
+		}
+		// the sub-interface is an access port already
+		if n.PNICVlan != 0 {
+			return fmt.Errorf("nativeVlan cannot be combined with pnicVlan, the sub-interface only carries one VLAN")
+		}
+	}
+	if n.Vlan < 0 || n.Vlan > 4094 {
+		return fmt.Errorf("vlan %d is out of range 0-4094", n.Vlan)
+	}
+	if n.Isolate && n.Vlan == 0 {
+		return fmt.Errorf("isolate requires a vlan")
+	}
+	if n.MAC != "" {
+		mac, err := net.ParseMAC(n.MAC)
+		if err != nil {
+			return fmt.Errorf("invalid mac %q: %v", n.MAC, err)
+		}
+		if len(mac) != 6 || mac[0]&1 != 0 {
+			return fmt.Errorf("mac %q is not a unicast ethernet address", n.MAC)
+		}
+	}
+	if n.AcceptRA != nil && (*n.AcceptRA < 0 || *n.AcceptRA > 2) {
+		return fmt.Errorf("acceptRA must be 0, 1 or 2, got %d", *n.AcceptRA)
+	}
+	if n.GatewayMAC != "" {
+		mac, err := net.ParseMAC(n.GatewayMAC)
+		if err != nil {
+			return fmt.Errorf("invalid gatewayMAC %q: %v", n.GatewayMAC, err)
+		}
+		if len(mac) != 6 || mac[0]&1 != 0 {
+			return fmt.Errorf("gatewayMAC %q is not a unicast ethernet address", n.GatewayMAC)
+		}
+	}
+	for _, nb := range n.Neighbors {
+		if net.ParseIP(nb.IP) == nil {
+			return fmt.Errorf("invalid neighbor ip %q", nb.IP)
+		}
+		mac, err := net.ParseMAC(nb.MAC)
+		if err != nil {
+			return fmt.Errorf("invalid mac %q of neighbor %s: %v", nb.MAC, nb.IP, err)
+		}
+		if len(mac) != 6 || mac[0]&1 != 0 {
+			return fmt.Errorf("mac %q of neighbor %s is not a unicast ethernet address", nb.MAC, nb.IP)
+		}
+	}
+	if n.StickyMAC && n.MAC != "" {
+		return fmt.Errorf("mac and stickyMAC are mutually exclusive")
+	}
+	if n.MACPrefix != "" {
+		if n.MAC != "" {
+			return fmt.Errorf("mac and macPrefix are mutually exclusive")
+		}
+		oui, err := ParseOUI(n.MACPrefix)
+		if err != nil {
+			return err
+		}
+		if oui[0]&1 != 0 {
+			return fmt.Errorf("macPrefix %q is a multicast prefix", n.MACPrefix)
+		}
+	}
+	if b := n.Bandwidth; b != nil {
+		if n.Device == "" {
+			return fmt.Errorf("bandwidth requires a device to shape traffic on")
+		}
+		if b.MinRate == 0 && b.MaxRate == 0 {
+			return fmt.Errorf("bandwidth needs minRate or maxRate")
+		}
+		if b.MaxRate > 0 && b.MinRate > b.MaxRate {
+			return fmt.Errorf("bandwidth minRate %d exceeds maxRate %d", b.MinRate, b.MaxRate)
+		}
+		if err := validateQoSType("bandwidth", b.QoSType); err != nil {
+			return err
+		}
+	}
+	if n.EgressUplink != "" && (n.EgressNAT != nil || n.DSCP != nil || n.Meter != nil) {
+		return fmt.Errorf("egressUplink cannot be combined with egressNAT, dscp or meter")
+	}
+	if _, err := ParseCIDRs("egressDeny", n.EgressDeny); err != nil {
+		return err
+	}
+	if _, err := ParseCIDRs("egressAllow", n.EgressAllow); err != nil {
+		return err
+	}
+	// the allowed traffic goes to NORMAL, bypassing their flows
+	if len(n.EgressAllow) > 0 && (n.EgressUplink != "" || n.EgressNAT != nil || n.DSCP != nil || n.Meter != nil || n.Bandwidth != nil) {
+		return fmt.Errorf("egressAllow cannot be combined with egressUplink, egressNAT, dscp, meter or bandwidth")
+	}
+	if m := n.Meter; m != nil {
+		if m.Rate == 0 {
+			return fmt.Errorf("meter rate must be positive")
+		}
+		if n.EgressNAT != nil {
+			return fmt.Errorf("meter cannot be combined with egressNAT")
+		}
+		if len(n.Protocols) > 0 && !containsString(n.Protocols, "OpenFlow13") {
+			return fmt.Errorf("meter requires OpenFlow13 in the bridge protocols")
+		}
+	}
+	if n.PinFlows && len(n.Protocols) > 0 && !containsString(n.Protocols, "OpenFlow14") {
+		return fmt.Errorf("pinFlows requires OpenFlow14 in the bridge protocols")
+	}
+	if n.DSCP != nil {
+		if *n.DSCP < 0 || *n.DSCP > 63 {
+			return fmt.Errorf("dscp %d is out of range 0-63", *n.DSCP)
+		}
+		// the NAT flows take the container's traffic before the marking
+		if n.EgressNAT != nil {
+			return fmt.Errorf("dscp cannot be combined with egressNAT")
+		}
+	}
+	if e := n.EgressNAT; e != nil && e.ExternalIP != "" {
+		if ip := net.ParseIP(e.ExternalIP); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("egressNAT externalIP %q is not an IPv4 address", e.ExternalIP)
+		}
+	}
+	if n.CTZone != nil {
+		if *n.CTZone < 0 || *n.CTZone > 65535 {
+			return fmt.Errorf("ctZone %d is out of range 0-65535", *n.CTZone)
+		}
+		if n.EgressNAT == nil {
+			return fmt.Errorf("ctZone requires egressNAT, the only feature using conntrack")
+		}
+	}
+	if s := n.Syslog; s != nil && s.Facility != "" {
+		if len(s.Facility) != 6 || !strings.HasPrefix(s.Facility, "local") || s.Facility[5] < '0' || s.Facility[5] > '7' {
+			return fmt.Errorf("syslog facility %q must be local0 to local7", s.Facility)
+		}
+	}
+	if t := n.Tracing; t != nil {
+		u, err := url.Parse(t.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("tracing endpoint %q must be an http or https URL", t.Endpoint)
+		}
+		if t.Timeout < 0 {
+			return fmt.Errorf("tracing timeout must not be negative")
+		}
+	}
+	if v := n.VSwitchd; v != nil && (v.FlowLimit < 0 || v.MaxIdle < 0) {
+		return fmt.Errorf("vswitchd flowLimit and maxIdle must not be negative")
+	}
+	if n.STP != nil {
+		if err := n.STP.validate("stp"); err != nil {
+			return err
+		}
+	}
+	if n.UplinkSTP != nil {
+		if n.Device == "" {
+			return fmt.Errorf("uplinkSTP requires a device")
+		}
+		if err := n.UplinkSTP.validate("uplinkSTP"); err != nil {
+			return err
+		}
+	}
+	if err := n.BridgeConf.Validate(); err != nil {
+		return fmt.Errorf("invalid bridge %q config: %v", n.BrName, err)
+	}
+	if sb := n.SecondaryBridge; sb != nil {
+		if sb.BrName == "" || sb.BrName == n.BrName {
+			return fmt.Errorf("secondaryBridge needs a bridge other than %q", n.BrName)
+		}
+		if err := sb.BridgeConf.Validate(); err != nil {
+			return fmt.Errorf("invalid bridge %q config: %v", sb.BrName, err)
+		}
+		// the queues of the containers are all on the primary bridge
+		if sb.QoSType != "" {
+			return fmt.Errorf("secondaryBridge %q has no container queues, qosType only applies to bridge %q", sb.BrName, n.BrName)
+		}
+		if sb.DatapathType != "" && sb.DatapathType != n.DatapathType {
+			return fmt.Errorf("secondaryBridge %q has datapathType %s, patch ports need the datapathType of bridge %q", sb.BrName, sb.DatapathType, n.BrName)
+		}
+	}
+	return nil
+}
+
+// validateQoSType checks the qosType of the config key
+func validateQoSType(key, qosType string) error {
+	switch qosType {
+	case "", QoSTypeHTB, QoSTypeHFSC:
+	case QoSTypeSFQ:
+		return fmt.Errorf("%s qosType %s has no queues to give the container its rates", key, qosType)
+	default:
+		return fmt.Errorf("unknown %s qosType %q, want %s or %s", key, qosType, QoSTypeHTB, QoSTypeHFSC)
+	}
+	return nil
+}
+
+// ParseCIDRs parses the CIDRs of the config key
+func ParseCIDRs(key string, cidrs []string) ([]*net.IPNet, error) {
+	var subnets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %v", key, cidr, err)
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
+
+// ParseOUI parses a 3 byte MAC prefix such as "0a:58:0a"
+func ParseOUI(s string) ([]byte, error) {
+	mac, err := net.ParseMAC(s + ":00:00:00")
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("invalid macPrefix %q, want 3 bytes such as 0a:58:0a", s)
+	}
+	return mac[:3], nil
+}
+
+// Validate checks the bridge settings
+func (c *BridgeConf) Validate() error {
+	switch ovs.FailMode(c.FailMode) {
+	case "", ovs.FailModeStandalone, ovs.FailModeSecure:
+	default:
+		return fmt.Errorf("unknown failMode %q", c.FailMode)
+	}
+	if c.L2Normal && ovs.FailMode(c.FailMode) == ovs.FailModeSecure {
+		return fmt.Errorf("l2Normal requires failMode standalone")
+	}
+	switch c.DatapathType {
+	case "", "system", "netdev":
+	default:
+		return fmt.Errorf("unknown datapathType %q", c.DatapathType)
+	}
+	for i := range c.Tunnels {
+		if err := c.Tunnels[i].Validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateQoSType("bridge", c.QoSType); err != nil {
+		return err
+	}
+	if c.ControllerInactivityProbe < 0 || c.ControllerMaxBackoff < 0 {
+		return fmt.Errorf("controllerInactivityProbe and controllerMaxBackoff must be positive")
+	}
+	if (c.ControllerInactivityProbe > 0 || c.ControllerMaxBackoff > 0) && c.Controller == "" {
+		return fmt.Errorf("controller options require a controller")
+	}
+	tlsFiles := []string{c.ControllerPrivateKey, c.ControllerCertificate, c.ControllerCACert}
+	if strings.HasPrefix(c.Controller, "ssl:") {
+		for _, path := range tlsFiles {
+			if path == "" {
+				return fmt.Errorf("an ssl controller requires controllerPrivateKey, controllerCertificate and controllerCACert")
+			}
+		}
+	} else if strings.Join(tlsFiles, "") != "" {
+		return fmt.Errorf("controller TLS files require an ssl: controller")
+	}
+	return nil
+}
+
+// Validate checks the tunnel settings
+func (t *TunnelConf) Validate() error {
+	if t.Name == "" || len(t.Name) > 15 || strings.ContainsAny(t.Name, "/: \t\n") {
+		return fmt.Errorf("tunnel name %q is not a valid interface name", t.Name)
+	}
+	switch t.Type {
+	case "vxlan", "geneve", "gre":
+	default:
+		return fmt.Errorf("tunnel %q has unknown type %q", t.Name, t.Type)
+	}
+	if t.BFD && t.Type == "gre" {
+		return fmt.Errorf("tunnel %q: bfd is only supported on vxlan and geneve tunnels", t.Name)
+	}
+	if t.RemoteIP != "flow" && net.ParseIP(t.RemoteIP) == nil {
+		return fmt.Errorf("tunnel %q has invalid remoteIP %q", t.Name, t.RemoteIP)
+	}
+	if t.Key != "" && t.Key != "flow" {
+		if _, err := strconv.ParseUint(t.Key, 0, 32); err != nil {
+			return fmt.Errorf("tunnel %q has invalid key %q", t.Name, t.Key)
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package ovsconf
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHostConfCheck(t *testing.T) {
+	h := &HostConf{ForbiddenVlans: []int{1, 4000}}
+	tests := []struct {
+		name string
+		n    NetConf
+		err  string
+	}{
+		{"no vlan", NetConf{}, ""},
+		{"allowed vlans", NetConf{Vlan: 100, NativeVlan: 200, PNICVlan: 300}, ""},
+		{"vlan", NetConf{Vlan: 4000}, "vlan 4000 is reserved"},
+		{"nativeVlan", NetConf{Vlan: 100, NativeVlan: 1}, "nativeVlan 1 is reserved"},
+		{"pnicVlan", NetConf{Vlan: 100, PNICVlan: 4000}, "pnicVlan 4000 is reserved"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := h.Check(&tt.n)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error = %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+	if err := (&HostConf{}).Check(&NetConf{Vlan: 1}); err != nil {
+		t.Errorf("empty host config: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+		err  string
+	}{
+		{"defaults", ``, ""},
+		{"vlan", `"vlan": 100, "mtu": 1400`, ""},
+		{"negative garp", `"garpCount": -1`, "garpCount and garpInterval must not be negative"},
+		{"long ifname", `"containerInterfaceName": "averyverylongname"`, "is not a valid interface name"},
+		{"tap on system", `"portType": "tap"`, "portType tap requires datapathType netdev"},
+		{"tap on netdev", `"portType": "tap", "datapathType": "netdev"`, ""},
+		{"vf without pci", `"portType": "vf", "deviceID": "eth1"`, "requires a PCI address"},
+		{"unknown port type", `"portType": "vhost"`, `unknown portType "vhost"`},
+		{"unknown stale policy", `"stalePorts": "keep"`, `unknown stalePorts policy "keep"`},
+		{"reuse with mac", `"ifNameCollision": "reuse", "mac": "02:00:00:00:00:01"`, "ifNameCollision reuse cannot set mac"},
+		{"small mtu", `"mtu": 60`, "mtu 60 must be between 68 and 65535"},
+		{"large host mtu", `"hostMTU": 70000`, "hostMTU 70000 must be between 68 and 65535"},
+		{"unknown offload", `"offloadFeatures": {"lro": false}`, `unknown offload feature "lro"`},
+		{"long veth prefix", `"hostVethPrefix": "containr"`, "must be 1 to 7 characters"},
+		{"unknown host bridge", `"hostBridgeType": "macvtap"`, `unknown hostBridgeType "macvtap"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := `{"cniVersion": "0.3.1", "name": "net", "type": "ovsbridge"`
+			if tt.conf != "" {
+				conf += ", " + tt.conf
+			}
+			_, _, err := LoadNetConf([]byte(conf + "}"))
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error = %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name          string
+		env           map[string]string
+		verbose       bool
+		linkUpTimeout int
+		endpoint      string
+		err           string
+	}{
+		{"no env", nil, false, 5, "", ""},
+		{"env wins", map[string]string{"CNIE_VERBOSE": "true", "CNIE_LINK_UP_TIMEOUT": "9", "CNIE_OTLP_ENDPOINT": "otel:4317"}, true, 9, "otel:4317", ""},
+		{"bad verbose", map[string]string{"CNIE_VERBOSE": "loud"}, false, 5, "", `invalid CNIE_VERBOSE "loud"`},
+		{"bad timeout", map[string]string{"CNIE_LINK_UP_TIMEOUT": "5s"}, false, 5, "", `invalid CNIE_LINK_UP_TIMEOUT "5s"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &NetConf{LinkUpTimeout: 5}
+			err := n.ApplyEnv(func(key string) string { return tt.env[key] })
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error = %v, want it to contain %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if n.Verbose != tt.verbose || n.LinkUpTimeout != tt.linkUpTimeout {
+				t.Errorf("verbose %t, linkUpTimeout %d, want %t and %d", n.Verbose, n.LinkUpTimeout, tt.verbose, tt.linkUpTimeout)
+			}
+			var endpoint string
+			if n.Tracing != nil {
+				endpoint = n.Tracing.Endpoint
+			}
+			if endpoint != tt.endpoint {
+				t.Errorf("tracing endpoint %q, want %q", endpoint, tt.endpoint)
+			}
+		})
+	}
+}
+
+func TestParseOUI(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    []byte
+		wantErr bool
+	}{
+		{"0a:58:0a", []byte{0x0a, 0x58, 0x0a}, false},
+		{"02:42:AC", []byte{0x02, 0x42, 0xac}, false},
+		{"0a:58", nil, true},
+		{"0a:58:0a:01", nil, true},
+		{"zz:58:0a", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseOUI(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseOUI(%q) error = %v, want error %t", tt.s, err, tt.wantErr)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("ParseOUI(%q) = %x, want %x", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/linkernetworks/cni/pkg/ovs"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+	"github.com/vishvananda/netlink"
+)
+
+// ethtoolGSet is ETHTOOL_GSET, reading the link settings
+const ethtoolGSet = 0x1
+
+// iffLowerUp is IFF_LOWER_UP, the carrier flag of a link
+const iffLowerUp = 0x10000
+
+// ethtoolCmd is struct ethtool_cmd of linux/ethtool.h
+type ethtoolCmd struct {
+	cmd           uint32
+	supported     uint32
+	advertising   uint32
+	speed         uint16
+	duplex        uint8
+	port          uint8
+	phyAddress    uint8
+	transceiver   uint8
+	autoneg       uint8
+	mdioSupport   uint8
+	maxtxpkt      uint32
+	maxrxpkt      uint32
+	speedHi       uint16
+	ethTpMdix     uint8
+	ethTpMdixCtrl uint8
+	lpAdvertising uint32
+	reserved      [2]uint32
+}
+
+// linkSpeed returns the speed of ifName in the current netns in Mb/s, 0 if
+// the driver does not know it
+func linkSpeed(ifName string) (uint32, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_IP)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open ethtool socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	cmd := ethtoolCmd{cmd: ethtoolGSet}
+	ifr := ethtoolIfreq{data: uintptr(unsafe.Pointer(&cmd))}
+	copy(ifr.name[:], ifName)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), siocEthtool, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return 0, fmt.Errorf("failed to get link settings of %q: %v", ifName, errno)
+	}
+	speed := uint32(cmd.speedHi)<<16 | uint32(cmd.speed)
+	// SPEED_UNKNOWN
+	if speed == 0xffffffff {
+		speed = 0
+	}
+	return speed, nil
+}
+
+// cmdCheck reports the link state of an attachment: the container
+// interface's operational state, carrier and speed, and whether the host
+// end is still a port of the bridge with its link up. It is run as
+// `ovsbridge check -config net.conf -container-id ID -ifname IF -netns PATH`
+// outside of the CNI protocol, whose version here has no CHECK. It fails
+// naming the problems if the attachment is not healthy.
+func cmdCheck(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	config := flags.String("config", "", "network config the attachment was added with")
+	containerID := flags.String("container-id", "", "container id of the attachment")
+	ifName := flags.String("ifname", "", "interface name the runtime asked for")
+	netns := flags.String("netns", "", "netns path of the container")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *config == "" || *containerID == "" || *ifName == "" || *netns == "" {
+		return fmt.Errorf("check: -config, -container-id, -ifname and -netns are required")
+	}
+	data, err := ioutil.ReadFile(*config)
+	if err != nil {
+		return fmt.Errorf("check: failed to read config: %v", err)
+	}
+	cargs := &skel.CmdArgs{
+		ContainerID: *containerID,
+		Netns:       *netns,
+		IfName:      *ifName,
+		StdinData:   data,
+	}
+	n, _, err := loadNetConf(cargs)
+	if err != nil {
+		return err
+	}
+	return checkAttachment(cargs, n)
+}
+
+// checkAttachment prints the link diagnostics of the attachment and fails
+// if the container interface or the host port is not up
+func checkAttachment(args *skel.CmdArgs, n *ovsconf.NetConf) error {
+	if n.OVSBinDir != "" {
+		if err := ovs.SetBinDir(n.OVSBinDir); err != nil {
+			return err
+		}
+	}
+	if n.OVSDB != "" {
+		if err := ovs.SetDB(n.OVSDB, n.OVSDBPrivateKey, n.OVSDBCertificate, n.OVSDBCACert); err != nil {
+			return err
+		}
+	}
+	ifName := containerIfName(args, n)
+	var problems []string
+
+	if err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("container interface %q: %v", ifName, err)
+		}
+		attrs := link.Attrs()
+		carrier := attrs.RawFlags&iffLowerUp != 0
+		speed, err := linkSpeed(ifName)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("container interface %s: %s, carrier %t, speed %dMb/s\n", ifName, attrs.OperState, carrier, speed)
+		// an interface left down on purpose is healthy
+		if n.LinkState != ovsconf.LinkStateDown && (attrs.OperState != netlink.OperUp || !carrier) {
+			problems = append(problems, fmt.Sprintf("container interface %q is %s", ifName, attrs.OperState))
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("check: %v", err)
+	}
+
+	ovsNS, err := openOVSNetNS(n.OVSNetns)
+	if err != nil {
+		return err
+	}
+	defer ovsNS.Close()
+	port, err := findHostPort(args, n, ovsNS)
+	if err != nil {
+		return err
+	}
+	if port == "" {
+		return fmt.Errorf("check: the host end of %s is gone", attachmentID(args))
+	}
+
+	if n.HostBridgeType == ovsconf.HostBridgeLinux {
+		var master string
+		if err := ovsNS.Do(func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName(port)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", port, err)
+			}
+			if index := link.Attrs().MasterIndex; index != 0 {
+				m, err := netlink.LinkByIndex(index)
+				if err != nil {
+					return fmt.Errorf("failed to lookup master of %q: %v", port, err)
+				}
+				master = m.Attrs().Name
+			}
+			fmt.Printf("host port %s: %s, bridge %q\n", port, link.Attrs().OperState, master)
+			if link.Attrs().OperState != netlink.OperUp {
+				problems = append(problems, fmt.Sprintf("host port %q is %s", port, link.Attrs().OperState))
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("check: %v", err)
+		}
+		if master != n.BrName {
+			problems = append(problems, fmt.Sprintf("host port %q is detached from Linux bridge %q", port, n.BrName))
+		}
+	} else {
+		bridge, err := ovs.PortBridge(port)
+		if err != nil {
+			return err
+		}
+		if bridge != n.BrName {
+			fmt.Printf("host port %s: not on bridge %q\n", port, n.BrName)
+			problems = append(problems, fmt.Sprintf("host port %q is detached from bridge %q", port, n.BrName))
+		} else {
+			state, err := ovs.OpenSwitch(bridge).InterfaceLinkState(port)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("host port %s: link %s, bridge %q\n", port, state, bridge)
+			if n.LinkState != ovsconf.LinkStateDown && state != "up" {
+				problems = append(problems, fmt.Sprintf("link of host port %q is %q in OVS", port, state))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("check: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/linkernetworks/cni/pkg/ovs"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+)
+
+// cleanupIntent records what a failed rollback left behind, so a later gc
+// run can finish removing it
+type cleanupIntent struct {
+	ContainerID string `json:"containerId"`
+	IfName      string `json:"ifName"`
+	Bridge      string `json:"bridge"`
+	OVSNetns    string `json:"ovsNetns,omitempty"`
+	// LockFile is the lock of the bridge if the config set its own
+	LockFile string    `json:"lockFile,omitempty"`
+	Created  time.Time `json:"created"`
+	// Cookie of flows still installed, they are looked up by owner
+	Cookie uint64 `json:"cookie,omitempty"`
+	// Meter still on the bridge
+	Meter uint32 `json:"meter,omitempty"`
+	// Queue is set while the attachment still has a QoS queue
+	Queue bool `json:"queue,omitempty"`
+	// Port still on the bridge
+	Port string `json:"port,omitempty"`
+	// Veth is the host end of a veth pair still present
+	Veth string `json:"veth,omitempty"`
+	// Quarantined is set for a port a quarantineDel DEL left for inspection,
+	// gc leaves it alone until the quarantine TTL is over
+	Quarantined bool `json:"quarantined,omitempty"`
+}
+
+func (c *cleanupIntent) empty() bool {
+	return c.Cookie == 0 && c.Meter == 0 && !c.Queue && c.Port == "" && c.Veth == ""
+}
+
+func (c *cleanupIntent) owner() string {
+	return c.ContainerID + "/" + c.IfName
+}
+
+func intentPath(stateDir, containerID, ifName string) string {
+	return filepath.Join(stateDir, "cleanup", containerID+"-"+ifName+".json")
+}
+
+func writeIntent(stateDir string, c *cleanupIntent) error {
+	path := intentPath(stateDir, c.ContainerID, c.IfName)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create %q: %v", filepath.Dir(path), err)
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write cleanup intent %q: %v", path, err)
+	}
+	return nil
+}
+
+func removeIntent(stateDir, containerID, ifName string) error {
+	err := os.Remove(intentPath(stateDir, containerID, ifName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove cleanup intent: %v", err)
+	}
+	return nil
+}
+
+// readIntent returns the intent recorded for the attachment, nil if there
+// is none
+func readIntent(stateDir, containerID, ifName string) (*cleanupIntent, error) {
+	path := intentPath(stateDir, containerID, ifName)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cleanup intent %q: %v", path, err)
+	}
+	c := &cleanupIntent{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("failed to parse cleanup intent %q: %v", path, err)
+	}
+	return c, nil
+}
+
+func readIntents(stateDir string) ([]*cleanupIntent, error) {
+	paths, err := filepath.Glob(filepath.Join(stateDir, "cleanup", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var intents []*cleanupIntent
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cleanup intent %q: %v", path, err)
+		}
+		c := &cleanupIntent{}
+		if err := json.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("failed to parse cleanup intent %q: %v", path, err)
+		}
+		intents = append(intents, c)
+	}
+	return intents, nil
+}
+
+// finish removes what is left of the attachment. Whatever it still cannot
+// remove stays in c, the error is the first failure.
+func (c *cleanupIntent) finish() error {
+	var errs []string
+	br := ovs.OpenSwitch(c.Bridge)
+
+	if c.Cookie != 0 {
+		if err := br.Flows(c.owner()).Delete(); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			c.Cookie = 0
+		}
+	}
+	if c.Meter != 0 {
+		if err := br.DeleteMeter(c.Meter); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			c.Meter = 0
+		}
+	}
+	if c.Queue {
+		if err := br.DeletePortQueue(c.Port, c.owner()); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			c.Queue = false
+		}
+	}
+	if c.Port != "" {
+		if err := br.DeletePort(c.Port); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			c.Port = ""
+		}
+	}
+	if c.Veth != "" {
+		ovsNS, err := openOVSNetNS(c.OVSNetns)
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			err = ovsNS.Do(func(_ ns.NetNS) error {
+				if err := ip.DelLinkByName(c.Veth); err != nil && err != ip.ErrLinkNotFound {
+					return err
+				}
+				return nil
+			})
+			ovsNS.Close()
+			if err != nil {
+				errs = append(errs, err.Error())
+			} else {
+				c.Veth = ""
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// rollbackVeth deletes the veth pair a failed ADD created before connecting
+// it, through its container end ifName in netns or else its host end in
+// ovsNS. If both fail the host end is recorded as a cleanup intent for the
+// gc mode.
+func rollbackVeth(args *skel.CmdArgs, n *ovsconf.NetConf, netns, ovsNS ns.NetNS, ifName, hostName string) {
+	err := netns.Do(func(_ ns.NetNS) error {
+		return ip.DelLinkByName(ifName)
+	})
+	if err != nil && err != ip.ErrLinkNotFound {
+		err = ovsNS.Do(func(_ ns.NetNS) error {
+			return ip.DelLinkByName(hostName)
+		})
+	}
+	if err == nil || err == ip.ErrLinkNotFound {
+		return
+	}
+	log.Printf("rollback of %s failed to delete veth %q: %v", attachmentID(args), hostName, err)
+	c := &cleanupIntent{
+		ContainerID: args.ContainerID,
+		IfName:      args.IfName,
+		Bridge:      n.BrName,
+		OVSNetns:    n.OVSNetns,
+		LockFile:    n.LockFile,
+		Created:     time.Now(),
+		Veth:        hostName,
+	}
+	if err := writeIntent(n.StateDir, c); err != nil {
+		log.Printf("rollback of %s: %v", attachmentID(args), err)
+	}
+}
+
+// rollbackAdd undoes a failed ADD once the veth pair exists. Whatever it
+// fails to remove is recorded as a cleanup intent for the gc mode.
+func rollbackAdd(args *skel.CmdArgs, n *ovsconf.NetConf, br *ovs.Switch, hostIfName string, ipamDone bool) {
+	// a VF is handed back rather than deleted, under the name the port
+	// recorded before the port goes
+	var vfName string
+	if n.PortType == ovsconf.PortTypeVF {
+		vfName, _ = br.PortExternalID(hostIfName, vfNameKey)
+	}
+
+	c := &cleanupIntent{
+		ContainerID: args.ContainerID,
+		IfName:      args.IfName,
+		Bridge:      br.BridgeName(),
+		OVSNetns:    n.OVSNetns,
+		LockFile:    n.LockFile,
+		Created:     time.Now(),
+		Cookie:      ovs.Cookie(attachmentID(args)),
+		Queue:       n.Bandwidth != nil,
+		Port:        hostIfName,
+	}
+	if n.Meter != nil {
+		c.Meter = meterID(args)
+	}
+	if n.PortType == "" || n.PortType == ovsconf.PortTypeVeth {
+		c.Veth = hostIfName
+	}
+	if err := c.finish(); err != nil {
+		log.Printf("rollback of %s left resources behind: %v", attachmentID(args), err)
+	}
+
+	if n.PortType == ovsconf.PortTypeVF {
+		ovsNS, err := openOVSNetNS(n.OVSNetns)
+		if err == nil {
+			err = releaseVF(args.Netns, ovsNS, containerIfName(args, n), n.DeviceID, vfName)
+			ovsNS.Close()
+		}
+		if err != nil {
+			log.Printf("rollback of %s failed to release VF %s: %v", attachmentID(args), n.DeviceID, err)
+		}
+	}
+
+	// a cached allocation is kept for the retry
+	if ipamDone && !n.IPAMCache {
+		if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+			log.Printf("rollback of %s failed to release IPAM: %v", attachmentID(args), err)
+		}
+	}
+
+	if c.empty() {
+		return
+	}
+	if err := writeIntent(n.StateDir, c); err != nil {
+		log.Printf("rollback of %s: %v", attachmentID(args), err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/linkernetworks/cni/pkg/ovs"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+	"github.com/vishvananda/netlink"
+)
+
+// asidePrefix starts the name an interface in the way of the container
+// interface is renamed to under the rename policy
+const asidePrefix = "cnie"
+
+// handleIfNameCollision deals with an interface named ifName already in the
+// container netns, e.g. one an earlier plugin of the chain created, as the
+// ifNameCollision policy says. It runs after the stale and foreign port
+// handling, which remove what an earlier ADD of cnie left. It returns true
+// if the interface is to be reused rather than a new one created.
+func handleIfNameCollision(netns ns.NetNS, ifName string, n *ovsconf.NetConf) (bool, error) {
+	reuse := false
+	err := netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return nil
+			}
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		switch n.IfNameCollision {
+		case ovsconf.IfNameCollisionReuse:
+			if link.Type() != "veth" {
+				return fmt.Errorf("container interface %q already exists and is a %s, only a veth can be reused", ifName, link.Type())
+			}
+			log.Printf("reusing existing container interface %q", ifName)
+			reuse = true
+			return nil
+		case ovsconf.IfNameCollisionRename:
+			return renameAside(link)
+		default:
+			return fmt.Errorf("container interface %q already exists (%s, index %d), e.g. created by an earlier plugin of the chain; set ifNameCollision to rename or reuse to handle it",
+				ifName, link.Type(), link.Attrs().Index)
+		}
+	})
+	return reuse, err
+}
+
+// renameAside renames link in the current netns to a free name, so the
+// container interface can take its name. Its admin state is kept.
+func renameAside(link netlink.Link) error {
+	name := link.Attrs().Name
+	aside, err := randomVethName(asidePrefix)
+	if err != nil {
+		return err
+	}
+	up := link.Attrs().Flags&net.FlagUp != 0
+	if up {
+		if err := netlink.LinkSetDown(link); err != nil {
+			return fmt.Errorf("failed to set %q down: %v", name, err)
+		}
+	}
+	if err := netlink.LinkSetName(link, aside); err != nil {
+		return fmt.Errorf("failed to rename %q to %q: %v", name, aside, err)
+	}
+	if up {
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", aside, err)
+		}
+	}
+	log.Printf("WARNING: container interface %q already existed, renamed it to %q", name, aside)
+	return nil
+}
+
+// reuseVeth connects the host end of the veth ifName already in the
+// container netns to the bridge. The host end has to be in ovsNS.
+func reuseVeth(netns, ovsNS ns.NetNS, br *ovs.Switch, ifName string) (*current.Interface, *current.Interface, error) {
+	hostName, err := hostVethName(netns.Path(), ovsNS, ifName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hostName == "" {
+		return nil, nil, fmt.Errorf("the peer of container interface %q is not in the netns of the bridge, it cannot be reused", ifName)
+	}
+	contIface := &current.Interface{Name: ifName, Sandbox: netns.Path()}
+	if err := netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		contIface.Mac = link.Attrs().HardwareAddr.String()
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	if err := br.AddPort(hostName); err != nil {
+		return nil, nil, fmt.Errorf("failed to connect %q to bridge %v: %v", hostName, br.BridgeName(), err)
+	}
+	return &current.Interface{Name: hostName}, contIface, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// debugRecord is what writeDebugRecord keeps of an ADD
+type debugRecord struct {
+	Config json.RawMessage `json:"config"`
+	Result types.Result    `json:"result"`
+}
+
+func debugPath(dir, containerID, ifName string) string {
+	return filepath.Join(dir, containerID+"-"+ifName+".json")
+}
+
+// writeDebugRecord saves the config of the ADD and the result it printed
+// under dir. It is best effort: failures are logged to stderr and never
+// change the ADD's outcome or output.
+func writeDebugRecord(dir string, args *skel.CmdArgs, result types.Result, cniVersion string) {
+	printed, err := result.GetAsVersion(cniVersion)
+	if err != nil {
+		log.Printf("debug record: %v", err)
+		return
+	}
+	rec := debugRecord{Result: printed}
+	if json.Valid(args.StdinData) {
+		rec.Config = args.StdinData
+	}
+	data, err := json.MarshalIndent(rec, "", "    ")
+	if err != nil {
+		log.Printf("debug record: %v", err)
+		return
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Printf("debug record: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(debugPath(dir, args.ContainerID, args.IfName), data, 0600); err != nil {
+		log.Printf("debug record: %v", err)
+	}
+}
+
+// removeDebugRecord drops the record of the attachment, best effort as well
+func removeDebugRecord(dir, containerID, ifName string) {
+	if err := os.Remove(debugPath(dir, containerID, ifName)); err != nil && !os.IsNotExist(err) {
+		log.Printf("debug record: %v", err)
+	}
+}
+
+// delSummary is what a verbose DEL logs about the teardown it did
+type delSummary struct {
+	ContainerID string `json:"containerId"`
+	IfName      string `json:"ifName"`
+	Bridge      string `json:"bridge"`
+	// Unmanaged is set when cnie never configured the attachment and the
+	// DEL did nothing
+	Unmanaged bool `json:"unmanaged"`
+	// Port is the host side port found for the attachment, "" if none
+	Port         string `json:"port"`
+	IPAMReleased bool   `json:"ipamReleased"`
+	Drained      bool   `json:"drained"`
+	FlowsRemoved bool   `json:"flowsRemoved"`
+	MeterRemoved bool   `json:"meterRemoved"`
+	QueueRemoved bool   `json:"queueRemoved"`
+	PortRemoved  bool   `json:"portRemoved"`
+	// DuplicatesRemoved counts the other ports of the attachment removed
+	DuplicatesRemoved int `json:"duplicatesRemoved"`
+	// IfaceRemoved is false when the container interface was already gone
+	IfaceRemoved bool `json:"ifaceRemoved"`
+	// LeftForGC is set when OVS leftovers were recorded for gc
+	LeftForGC bool `json:"leftForGC"`
+}
+
+// log writes the summary as one JSON line to stderr, which the runtime does
+// not parse as the plugin's result
+func (s *delSummary) log() {
+	data, err := json.Marshal(s)
+	if err != nil {
+		log.Printf("del summary: %v", err)
+		return
+	}
+	log.Printf("del summary: %s", data)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/linkernetworks/cni/pkg/ovs"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+	"github.com/vishvananda/netlink"
+)
+
+// drift is one difference between an attachment and its config that repair
+// would reconcile
+type drift struct {
+	// Kind is bridge, uplink, port, vlan, external-id, flows or ip
+	Kind   string `json:"kind"`
+	Object string `json:"object"`
+	Want   string `json:"want"`
+	Have   string `json:"have"`
+}
+
+// attachmentDrift compares the bridge, the uplink and the attachment's port,
+// flows and addresses with n and the result the ADD recorded, changing
+// nothing. It is the dry run of repairAttachment.
+func attachmentDrift(args *skel.CmdArgs, n *ovsconf.NetConf) ([]drift, error) {
+	result, err := readResult(n.StateDir, args.ContainerID, args.IfName)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil || len(result.Interfaces) < 3 {
+		return nil, fmt.Errorf("repair: no ADD of %s recorded under %q", attachmentID(args), n.StateDir)
+	}
+	mac := result.Interfaces[2].Mac
+
+	if n.OVSBinDir != "" {
+		if err := ovs.SetBinDir(n.OVSBinDir); err != nil {
+			return nil, err
+		}
+	}
+	if n.OVSDB != "" {
+		if err := ovs.SetDB(n.OVSDB, n.OVSDBPrivateKey, n.OVSDBCertificate, n.OVSDBCACert); err != nil {
+			return nil, err
+		}
+	}
+	var drifts []drift
+	add := func(kind, object, want, have string) {
+		drifts = append(drifts, drift{Kind: kind, Object: object, Want: want, Have: have})
+	}
+
+	bridges, err := ovs.ListBridges()
+	if err != nil {
+		return nil, err
+	}
+	exists := false
+	for _, name := range bridges {
+		exists = exists || name == n.BrName
+	}
+	if !exists {
+		// everything else is gone with it
+		add("bridge", n.BrName, "present", "missing")
+		return drifts, nil
+	}
+
+	ovsNS, err := openOVSNetNS(n.OVSNetns)
+	if err != nil {
+		return nil, err
+	}
+	defer ovsNS.Close()
+
+	if n.Device != "" {
+		if err := ovsNS.Do(func(_ ns.NetNS) error {
+			return resolveDevice(n)
+		}); err != nil {
+			return nil, err
+		}
+		if device := uplinkPort(n); device != "" {
+			bridge, err := ovs.PortBridge(device)
+			if err != nil {
+				return nil, err
+			}
+			if bridge != n.BrName {
+				add("uplink", device, "on "+n.BrName, onBridge(bridge))
+			}
+		}
+	}
+
+	port, err := findHostPort(args, n, ovsNS)
+	if err != nil {
+		return nil, err
+	}
+	if port == "" {
+		return nil, fmt.Errorf("repair: the container interface of %s is gone, it needs a new ADD", attachmentID(args))
+	}
+	br := ovs.OpenSwitch(n.BrName)
+	bridge, err := ovs.PortBridge(port)
+	if err != nil {
+		return nil, err
+	}
+	if bridge != n.BrName {
+		add("port", port, "on "+n.BrName, onBridge(bridge))
+	} else {
+		tag, err := br.PortTag(port)
+		if err != nil {
+			return nil, err
+		}
+		if tag != n.Vlan {
+			add("vlan", port, strconv.Itoa(n.Vlan), strconv.Itoa(tag))
+		}
+		ids := [][2]string{
+			{ovs.ContainerIDKey, args.ContainerID},
+			{ovs.IfNameKey, args.IfName},
+			{ovs.MACKey, mac},
+		}
+		if n.PortGroup != "" {
+			ids = append(ids, [2]string{ovs.PortGroupKey, n.PortGroup})
+		}
+		if uplink := uplinkName(n); uplink != "" {
+			ids = append(ids, [2]string{ovs.UplinkKey, uplink})
+		}
+		for _, id := range ids {
+			have, err := br.PortExternalID(port, id[0])
+			if err != nil {
+				return nil, err
+			}
+			if have != id[1] {
+				add("external-id", port+" "+id[0], id[1], have)
+			}
+		}
+
+		flows, err := br.Flows(attachmentID(args)).Dump()
+		if err != nil {
+			return nil, err
+		}
+		if len(flows) == 0 && needsFlows(n) {
+			add("flows", port, "installed", "none")
+		}
+	}
+
+	var have []string
+	if err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		ifName := containerIfName(args, n)
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return fmt.Errorf("failed to list addresses of %q: %v", ifName, err)
+		}
+		for _, addr := range addrs {
+			have = append(have, addr.IPNet.String())
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	for _, ipc := range result.IPs {
+		want := ipc.Address
+		if !hasAddress(have, &want) {
+			add("ip", containerIfName(args, n), want.String(), "missing")
+		}
+	}
+	return drifts, nil
+}
+
+// needsFlows tells whether n installs flows of the attachment that stay
+// after the ADD
+func needsFlows(n *ovsconf.NetConf) bool {
+	return n.Isolate || n.Meter != nil || n.DSCP != nil || n.EgressNAT != nil ||
+		n.EgressUplink != "" || len(n.EgressAllow) > 0 || len(n.EgressDeny) > 0 || n.FlowsFile != "" ||
+		n.PinFlows
+}
+
+func hasAddress(addrs []string, want *net.IPNet) bool {
+	for _, addr := range addrs {
+		if addr == want.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func onBridge(bridge string) string {
+	if bridge == "" {
+		return "detached"
+	}
+	return "on " + bridge
+}
+
+// printDrift prints the drifts as a table or, with asJSON, as JSON
+func printDrift(drifts []drift, asJSON bool) error {
+	if asJSON {
+		if drifts == nil {
+			drifts = []drift{}
+		}
+		return json.NewEncoder(os.Stdout).Encode(drifts)
+	}
+	if len(drifts) == 0 {
+		fmt.Println("no drift, repair would only reinstall the attachment's flows")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tOBJECT\tWANT\tHAVE")
+	for _, d := range drifts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.Kind, d.Object, d.Want, d.Have)
+	}
+	return w.Flush()
+}
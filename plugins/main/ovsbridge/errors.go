@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// errInvalidConfig is the CNI error code of a network config the plugin
+// cannot use
+const errInvalidConfig = 7
+
+// errInternal is the code of every other failure, the one skel reports for
+// a plain error
+const errInternal = 100
+
+// Classes of a structured error, telling tooling where an ADD or DEL failed
+const (
+	classConfig   = "config"
+	classNetns    = "netns"
+	classIPAM     = "ipam"
+	classRetry    = "retry"
+	classRuntime  = "runtime"
+	classInternal = "internal"
+)
+
+// classedError is an error of a known class, reported with its code when
+// CNIE_STRUCTURED_ERRORS is set and as a plain error otherwise
+type classedError struct {
+	class string
+	code  uint
+	err   error
+}
+
+func (e *classedError) Error() string {
+	return e.err.Error()
+}
+
+// classify marks err, if not nil, as being of class
+func classify(class string, code uint, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classedError{class: class, code: code, err: err}
+}
+
+// structuredError is the CNI error the plugin prints with
+// CNIE_STRUCTURED_ERRORS set. Class is an addition runtimes ignore.
+type structuredError struct {
+	types.Error
+	Class string `json:"class"`
+}
+
+// toStructuredError turns an error of cmdAdd or cmdDel into the error
+// printed for it
+func toStructuredError(err error) *structuredError {
+	switch e := err.(type) {
+	case *classedError:
+		s := &structuredError{Error: types.Error{Code: e.code, Msg: e.err.Error()}, Class: e.class}
+		if inner, ok := e.err.(*types.Error); ok {
+			s.Error = *inner
+		}
+		return s
+	case *types.Error:
+		s := &structuredError{Error: *e, Class: classInternal}
+		if e.Code == errTryAgainLater {
+			s.Class = classRetry
+		}
+		return s
+	}
+	return &structuredError{Error: types.Error{Code: errInternal, Msg: err.Error()}, Class: classInternal}
+}
+
+// structuredErrors tells whether CNIE_STRUCTURED_ERRORS asks for classified
+// errors
+func structuredErrors() bool {
+	v := os.Getenv("CNIE_STRUCTURED_ERRORS")
+	return v != "" && v != "0" && v != "false"
+}
+
+// pluginMainStructured is skel.PluginMain printing every failure as a
+// structuredError on stdout, so tooling can tell a bad config from a
+// missing netns or an IPAM failure by its class rather than by the message
+func pluginMainStructured(cmdAdd, cmdDel func(*skel.CmdArgs) error) {
+	var cmdErr error
+	record := func(cmd func(*skel.CmdArgs) error) func(*skel.CmdArgs) error {
+		return func(args *skel.CmdArgs) error {
+			cmdErr = cmd(args)
+			return cmdErr
+		}
+	}
+	e := skel.PluginMainWithError(record(cmdAdd), record(cmdDel), version.All)
+	if e == nil {
+		return
+	}
+	s := &structuredError{Error: *e, Class: classRuntime}
+	// skel fails for the environment or the version before calling a command
+	if cmdErr != nil {
+		s = toStructuredError(cmdErr)
+	}
+	data, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode error: %v\n", err)
+	} else {
+		os.Stdout.Write(data)
+	}
+	os.Exit(1)
+}
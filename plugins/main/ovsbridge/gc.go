@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/linkernetworks/cni/pkg/ovs"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+)
+
+// cmdGC finishes the cleanups that failed rollbacks recorded. It is run as
+// `ovsbridge gc [-state-dir dir] [-retention 168h] [-quarantine-ttl 24h]
+// [-qos=false]` outside of the CNI protocol. Intents older than the retention
+// are dropped unfinished, quarantined ports are only removed after their
+// TTL.
+// Then the QoS and queue rows cnie created and no port uses anymore are
+// destroyed.
+func cmdGC(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	stateDir := flags.String("state-dir", ovsconf.DefaultStateDir, "directory holding the cleanup intents")
+	retention := flags.Duration("retention", 7*24*time.Hour, "how long to keep retrying an intent, 0 for ever")
+	binDir := flags.String("ovs-bin-dir", "", "directory holding ovs-vsctl if it is not in PATH")
+	qos := flags.Bool("qos", true, "destroy the orphaned QoS and queue rows of cnie")
+	quarantineTTL := flags.Duration("quarantine-ttl", 24*time.Hour, "how long ports quarantined by DEL are kept")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *binDir != "" {
+		if err := ovs.SetBinDir(*binDir); err != nil {
+			return err
+		}
+	}
+
+	intents, err := readIntents(*stateDir)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, c := range intents {
+		if c.Quarantined && time.Since(c.Created) < *quarantineTTL {
+			continue
+		}
+		// finish changes the same shared records as ADD and DEL do
+		unlock, err := lockBridge(&ovsconf.NetConf{
+			BrName:   c.Bridge,
+			StateDir: *stateDir,
+			LockFile: c.LockFile,
+		})
+		if err != nil {
+			return err
+		}
+		err = c.finish()
+		unlock()
+		switch {
+		case err == nil && c.Quarantined:
+			log.Printf("gc: reaped quarantined %s", c.owner())
+		case err == nil:
+			log.Printf("gc: cleaned up %s", c.owner())
+		case *retention > 0 && time.Since(c.Created) > *retention:
+			log.Printf("gc: giving up on %s after %v: %v", c.owner(), *retention, err)
+		default:
+			failed++
+			log.Printf("gc: %s: %v", c.owner(), err)
+			if err := writeIntent(*stateDir, c); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := removeIntent(*stateDir, c.ContainerID, c.IfName); err != nil {
+			return err
+		}
+	}
+
+	if *qos {
+		if err := collectQoS(*stateDir); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("gc: %d of %d cleanups still pending", failed, len(intents))
+	}
+	return nil
+}
+
+// collectQoS destroys the orphaned QoS and queue rows with every bridge
+// locked, as the queues of any bridge may be among them. That is the default
+// lock of every bridge and the own lockFile of every attachment or cleanup
+// intent recorded under stateDir. Locks are taken in path order, so two gc runs cannot
+// deadlock.
+func collectQoS(stateDir string) error {
+	bridges, err := ovs.ListBridges()
+	if err != nil {
+		return err
+	}
+	confs := map[string]*ovsconf.NetConf{}
+	for _, name := range bridges {
+		n := &ovsconf.NetConf{BrName: name, StateDir: stateDir}
+		confs[lockPath(n)] = n
+	}
+	recorded, err := recordedConfs(stateDir)
+	if err != nil {
+		return err
+	}
+	intents, err := readIntents(stateDir)
+	if err != nil {
+		return err
+	}
+	for _, c := range intents {
+		recorded = append(recorded, &ovsconf.NetConf{BrName: c.Bridge, StateDir: stateDir, LockFile: c.LockFile})
+	}
+	for _, n := range recorded {
+		if n.LockFile != "" {
+			confs[lockPath(n)] = n
+		}
+	}
+	paths := make([]string, 0, len(confs))
+	for path := range confs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		unlock, err := lockBridge(confs[path])
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	removed, err := ovs.CollectQoS()
+	for _, r := range removed {
+		log.Printf("gc: destroyed orphaned %s", r)
+	}
+	if err != nil {
+		return fmt.Errorf("gc: %v", err)
+	}
+	return nil
+}
+
+// recordedConfs returns the configs the attachments under stateDir were
+// added with
+func recordedConfs(stateDir string) ([]*ovsconf.NetConf, error) {
+	paths, err := filepath.Glob(filepath.Join(stateDir, "configs", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var confs []*ovsconf.NetConf
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read recorded config %q: %v", path, err)
+		}
+		n, _, err := ovsconf.LoadNetConf(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse recorded config %q: %v", path, err)
+		}
+		if err := n.ApplyEnv(os.Getenv); err != nil {
+			return nil, err
+		}
+		confs = append(confs, n)
+	}
+	return confs, nil
+}
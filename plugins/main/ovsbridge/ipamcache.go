@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+)
+
+// With ipamCache a failed ADD keeps its IPAM allocation and records it, so
+// the runtime's retry gets the same addresses instead of a new allocation.
+// The record goes when DEL releases the allocation.
+
+func ipamCachePath(stateDir, containerID, ifName string) string {
+	return filepath.Join(stateDir, "ipam", containerID+"-"+ifName+".json")
+}
+
+// execIPAM runs the IPAM plugin, or with ipamCache returns the allocation an
+// earlier ADD of the attachment got
+func execIPAM(args *skel.CmdArgs, n *ovsconf.NetConf) (_ *current.Result, err error) {
+	s := startSpan("ipam")
+	defer func() { s.finish(err) }()
+	path := ipamCachePath(n.StateDir, args.ContainerID, args.IfName)
+	if n.IPAMCache {
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			result := &current.Result{}
+			if err := json.Unmarshal(data, result); err != nil {
+				return nil, fmt.Errorf("failed to parse cached IPAM result %q: %v", path, err)
+			}
+			return result, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read cached IPAM result: %v", err)
+		}
+	}
+
+	r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+	if err != nil {
+		return nil, classify(classIPAM, errInternal, err)
+	}
+	// Convert whatever the IPAM result was into the current Result type
+	result, err := current.NewResultFromResult(r)
+	if err != nil {
+		return nil, err
+	}
+	if !n.IPAMCache {
+		return result, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %q: %v", filepath.Dir(path), err)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write cached IPAM result %q: %v", path, err)
+	}
+	return result, nil
+}
+
+func removeIPAMCache(stateDir, containerID, ifName string) error {
+	err := os.Remove(ipamCachePath(stateDir, containerID, ifName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove cached IPAM result: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/j-keck/arping"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+	"github.com/vishvananda/netlink"
+)
+
+// setupLinuxBridge returns the Linux bridge named name in the current
+// netns, creating it and setting it up if it does not exist yet
+func setupLinuxBridge(name string, mtu int) (*netlink.Bridge, error) {
+	link, err := netlink.LinkByName(name)
+	if err == nil {
+		br, ok := link.(*netlink.Bridge)
+		if !ok {
+			return nil, fmt.Errorf("%q is a %s, not a Linux bridge", name, link.Type())
+		}
+		return br, nil
+	}
+	if _, ok := err.(netlink.LinkNotFoundError); !ok {
+		return nil, fmt.Errorf("failed to lookup %q: %v", name, err)
+	}
+
+	br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name, MTU: mtu}}
+	if err := netlink.LinkAdd(br); err != nil {
+		return nil, fmt.Errorf("failed to create Linux bridge %q: %v", name, err)
+	}
+	if err := netlink.LinkSetUp(br); err != nil {
+		return nil, fmt.Errorf("failed to set %q up: %v", name, err)
+	}
+	log.Printf("created Linux bridge %q", name)
+	// re-fetch for the MAC the kernel assigned
+	link, err = netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", name, err)
+	}
+	return link.(*netlink.Bridge), nil
+}
+
+// addLinuxResult is the ADD of hostBridgeType linux: the host veth end is
+// enslaved to the Linux bridge n.BrName instead of being added to OVS, so
+// none of the OVS port settings apply. addResult holds the bridge lock.
+func addLinuxResult(args *skel.CmdArgs, n *ovsconf.NetConf) (_ *current.Result, err error) {
+	hostNS, err := openOVSNetNS(n.OVSNetns)
+	if err != nil {
+		return nil, err
+	}
+	defer hostNS.Close()
+
+	var br *netlink.Bridge
+	if err := hostNS.Do(func(_ ns.NetNS) error {
+		br, err = setupLinuxBridge(n.BrName, n.MTU)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	brInterface := &current.Interface{Name: n.BrName, Mac: br.Attrs().HardwareAddr.String()}
+
+	netns, err := openNetNS(args.Netns)
+	if err != nil {
+		return nil, err
+	}
+	defer netns.Close()
+
+	if err := assignMAC(args, n); err != nil {
+		return nil, err
+	}
+	ifName := containerIfName(args, n)
+	if _, err := handleIfNameCollision(netns, ifName, n); err != nil {
+		return nil, err
+	}
+	hostInterface, containerInterface, err := createVeth(args, netns, hostNS, ifName, "", n)
+	if err != nil {
+		return nil, err
+	}
+
+	// from here on a failed ADD removes what it created. Deleting the
+	// container end takes the host end with it.
+	ipamDone := false
+	defer func() {
+		if err == nil {
+			return
+		}
+		// a cached allocation is kept for the retry
+		if ipamDone && !n.IPAMCache {
+			if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+				log.Printf("rollback of %s failed to release IPAM allocation: %v", attachmentID(args), err)
+			}
+		}
+		if err := netns.Do(func(_ ns.NetNS) error {
+			return ip.DelLinkByName(ifName)
+		}); err != nil && err != ip.ErrLinkNotFound {
+			log.Printf("rollback of %s failed to delete %q: %v", attachmentID(args), ifName, err)
+		}
+	}()
+
+	if err := hostNS.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(hostInterface.Name)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", hostInterface.Name, err)
+		}
+		if err := netlink.LinkSetMaster(link, br); err != nil {
+			return fmt.Errorf("failed to connect %q to Linux bridge %q: %v", hostInterface.Name, n.BrName, err)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	result, err := execIPAM(args, n)
+	if err != nil {
+		return nil, err
+	}
+	ipamDone = true
+	if len(result.IPs) == 0 {
+		return nil, errors.New("IPAM plugin returned missing IP config")
+	}
+	result.Routes = resultRoutes(result.IPs, result.Routes, n.RuntimeConfig.Routes)
+	result.Interfaces = []*current.Interface{brInterface, hostInterface, containerInterface}
+	if err := ipInterfaces(result, ifName, args.Netns); err != nil {
+		return nil, err
+	}
+
+	if err := netns.Do(func(_ ns.NetNS) error {
+		if n.SetupLoopback {
+			if err := setupLoopback(); err != nil {
+				return err
+			}
+		}
+		if err := configureIface(ifName, result); err != nil {
+			return err
+		}
+		contVeth, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return err
+		}
+		for _, ipc := range result.IPs {
+			if ipc.Version == "4" {
+				_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contVeth)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// delLinuxAttachment is the DEL of hostBridgeType linux after the IPAM
+// release. The Linux bridge stays, like an OVS bridge does.
+func delLinuxAttachment(args *skel.CmdArgs, n *ovsconf.NetConf) error {
+	if args.Netns == "" {
+		return nil
+	}
+	ifName := containerIfName(args, n)
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		if err := ip.DelLinkByName(ifName); err != nil && err != ip.ErrLinkNotFound {
+			return fmt.Errorf("failed to delete %q: %v", ifName, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/linkernetworks/cni/pkg/ovs"
+)
+
+// cmdList prints the container ports cnie manages on this node. It is run
+// as `ovsbridge list [-json]` outside of the CNI protocol.
+func cmdList(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the attachments as JSON")
+	portGroup := flags.String("port-group", "", "only print the attachments of this port group")
+	binDir := flags.String("ovs-bin-dir", "", "directory holding ovs-vsctl if it is not in PATH")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *binDir != "" {
+		if err := ovs.SetBinDir(*binDir); err != nil {
+			return err
+		}
+	}
+
+	attachments, err := ovs.ListAttachments()
+	if err != nil {
+		return err
+	}
+	if *portGroup != "" {
+		var members []ovs.Attachment
+		for _, a := range attachments {
+			if a.PortGroup == *portGroup {
+				members = append(members, a)
+			}
+		}
+		attachments = members
+	}
+
+	if *asJSON {
+		if attachments == nil {
+			attachments = []ovs.Attachment{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		return enc.Encode(attachments)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BRIDGE\tPORT\tCONTAINER ID\tIFNAME\tIPS\tPORT GROUP\tUPLINK")
+	for _, a := range attachments {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", a.Bridge, a.Port, a.ContainerID, a.IfName, a.IPs, a.PortGroup, a.Uplink)
+	}
+	return w.Flush()
+}
+
+// cmdTunnels prints the tunnel interfaces of this node with the state of
+// their BFD sessions. It is run as `ovsbridge tunnels [-json]`.
+func cmdTunnels(args []string) error {
+	flags := flag.NewFlagSet("tunnels", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the tunnels as JSON")
+	binDir := flags.String("ovs-bin-dir", "", "directory holding ovs-vsctl if it is not in PATH")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *binDir != "" {
+		if err := ovs.SetBinDir(*binDir); err != nil {
+			return err
+		}
+	}
+
+	tunnels, err := ovs.ListTunnels()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		if tunnels == nil {
+			tunnels = []ovs.Tunnel{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		return enc.Encode(tunnels)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tBFD\tSTATE\tDIAGNOSTIC")
+	for _, t := range tunnels {
+		state := "-"
+		if t.BFD {
+			state = t.BFDStatus["state"]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%s\n", t.Name, t.Type, t.BFD, state, t.BFDStatus["diagnostic"])
+	}
+	return w.Flush()
+}
+
+// cmdStats prints the traffic counters of the bridges of this node, added up
+// over their interfaces, and the system statistics of ovs-vswitchd if it
+// collects them. It is run as `ovsbridge stats [-bridge name] [-json]`.
+func cmdStats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	bridge := flags.String("bridge", "", "only print the counters of this bridge")
+	asJSON := flags.Bool("json", false, "print the statistics as JSON")
+	binDir := flags.String("ovs-bin-dir", "", "directory holding ovs-vsctl if it is not in PATH")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *binDir != "" {
+		if err := ovs.SetBinDir(*binDir); err != nil {
+			return err
+		}
+	}
+
+	bridges := []string{*bridge}
+	if *bridge == "" {
+		var err error
+		if bridges, err = ovs.ListBridges(); err != nil {
+			return err
+		}
+	}
+	stats := []*ovs.BridgeStats{}
+	for _, name := range bridges {
+		s, err := ovs.OpenSwitch(name).Stats()
+		if err != nil {
+			return err
+		}
+		stats = append(stats, s)
+	}
+	system, err := ovs.VSwitchdStatistics()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		return enc.Encode(struct {
+			Bridges  []*ovs.BridgeStats `json:"bridges"`
+			VSwitchd map[string]string  `json:"vswitchd,omitempty"`
+		}{stats, system})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BRIDGE\tIFACES\tRX PACKETS\tRX BYTES\tRX DROPPED\tRX ERRORS\tTX PACKETS\tTX BYTES\tTX DROPPED\tTX ERRORS")
+	for _, s := range stats {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", s.Bridge, s.Interfaces,
+			s.RxPackets, s.RxBytes, s.RxDropped, s.RxErrors, s.TxPackets, s.TxBytes, s.TxDropped, s.TxErrors)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(system) > 0 {
+		keys := make([]string, 0, len(system))
+		for key := range system {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Println()
+		for _, key := range keys {
+			fmt.Printf("%s: %s\n", key, system[key])
+		}
+	}
+	return nil
+}
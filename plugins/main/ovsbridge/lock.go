@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+)
+
+// lockBridge takes the node wide lock of the bridge n uses, so concurrent
+// ADDs and DELs do not interleave their changes to shared records such as
+// the uplink or the QoS. The returned func releases it; the kernel drops the
+// lock with the file if the process dies or panics first.
+func lockBridge(n *ovsconf.NetConf) (func(), error) {
+	path := lockPath(n)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %q: %v", filepath.Dir(path), err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock %q: %v", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %q: %v", path, err)
+	}
+	return func() { f.Close() }, nil
+}
+
+// lockPath is the lock file of the bridge n uses: the config's own lockFile,
+// or the bridge's lock under stateDir
+func lockPath(n *ovsconf.NetConf) string {
+	if n.LockFile != "" {
+		return n.LockFile
+	}
+	return filepath.Join(n.StateDir, "locks", n.BrName+".lock")
+}
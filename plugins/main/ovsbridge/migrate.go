@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/linkernetworks/cni/pkg/ovs"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+	"github.com/vishvananda/netlink"
+)
+
+// migration records what cmdMigrate moved from a Linux bridge to the OVS
+// bridge, so -revert can move it back
+type migration struct {
+	LinuxBridge string `json:"linuxBridge"`
+	Bridge      string `json:"bridge"`
+	// Ports are the container ports, moved before the uplinks
+	Ports   []string `json:"ports"`
+	Uplinks []string `json:"uplinks"`
+	// Addrs and Routes of the Linux bridge interface
+	Addrs  []string `json:"addrs"`
+	Routes []route  `json:"routes"`
+}
+
+type route struct {
+	Dst string `json:"dst,omitempty"`
+	Gw  string `json:"gw,omitempty"`
+	Src string `json:"src,omitempty"`
+}
+
+func migrationPath(stateDir, linuxBridge string) string {
+	return filepath.Join(stateDir, "migrations", linuxBridge+".json")
+}
+
+// cmdMigrate moves the ports of a Linux bridge onto the OVS bridge, then its
+// uplink and its addresses and routes. It is run as
+// `ovsbridge migrate -linux-bridge br0 [-bridge ovsbr0] [-dry-run] [-revert]`
+// outside of the CNI protocol.
+func cmdMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	linuxBridge := flags.String("linux-bridge", "", "Linux bridge to migrate from")
+	bridge := flags.String("bridge", ovsconf.DefaultBrName, "OVS bridge to migrate to")
+	device := flags.String("device", "", "uplink of the Linux bridge, physical NICs and bonds if empty")
+	stateDir := flags.String("state-dir", ovsconf.DefaultStateDir, "directory recording the migration for -revert")
+	dryRun := flags.Bool("dry-run", false, "print what would be moved without moving it")
+	revert := flags.Bool("revert", false, "move everything back to the Linux bridge")
+	binDir := flags.String("ovs-bin-dir", "", "directory holding ovs-vsctl if it is not in PATH")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *linuxBridge == "" {
+		return fmt.Errorf("migrate: -linux-bridge is required")
+	}
+	if *binDir != "" {
+		if err := ovs.SetBinDir(*binDir); err != nil {
+			return err
+		}
+	}
+
+	path := migrationPath(*stateDir, *linuxBridge)
+	if *revert {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("migrate: no migration of %q to revert: %v", *linuxBridge, err)
+		}
+		m := &migration{}
+		if err := json.Unmarshal(data, m); err != nil {
+			return fmt.Errorf("migrate: failed to parse %q: %v", path, err)
+		}
+		printMigration(m, "revert")
+		if *dryRun {
+			return nil
+		}
+		if err := revertMigration(m); err != nil {
+			return err
+		}
+		return os.Remove(path)
+	}
+
+	m, err := planMigration(*linuxBridge, *bridge, *device)
+	if err != nil {
+		return err
+	}
+	printMigration(m, "migrate")
+	if *dryRun {
+		return nil
+	}
+
+	// recorded first, so a migration failing halfway can still be reverted
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create %q: %v", filepath.Dir(path), err)
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write migration %q: %v", path, err)
+	}
+	return runMigration(m)
+}
+
+// planMigration lists the ports, addresses and routes of the Linux bridge
+func planMigration(linuxBridge, bridge, device string) (*migration, error) {
+	lb, err := netlink.LinkByName(linuxBridge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", linuxBridge, err)
+	}
+	if lb.Type() != "bridge" {
+		return nil, fmt.Errorf("%q is a %s, not a Linux bridge", linuxBridge, lb.Type())
+	}
+
+	m := &migration{LinuxBridge: linuxBridge, Bridge: bridge}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	for _, link := range links {
+		if link.Attrs().MasterIndex != lb.Attrs().Index {
+			continue
+		}
+		name := link.Attrs().Name
+		uplink := name == device
+		if device == "" {
+			uplink = link.Type() == "device" || link.Type() == "bond"
+		}
+		if uplink {
+			m.Uplinks = append(m.Uplinks, name)
+		} else {
+			m.Ports = append(m.Ports, name)
+		}
+	}
+	if device != "" && len(m.Uplinks) == 0 {
+		return nil, fmt.Errorf("%q is not a port of %q", device, linuxBridge)
+	}
+
+	addrs, err := netlink.AddrList(lb, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of %q: %v", linuxBridge, err)
+	}
+	for _, addr := range addrs {
+		if addr.Scope == int(netlink.SCOPE_LINK) {
+			continue
+		}
+		m.Addrs = append(m.Addrs, addr.IPNet.String())
+	}
+	routes, err := netlink.RouteList(lb, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes of %q: %v", linuxBridge, err)
+	}
+	for _, r := range routes {
+		// the kernel adds the subnet routes of the addresses itself
+		if r.Protocol == syscall.RTPROT_KERNEL {
+			continue
+		}
+		rt := route{}
+		if r.Dst != nil {
+			rt.Dst = r.Dst.String()
+		}
+		if r.Gw != nil {
+			rt.Gw = r.Gw.String()
+		}
+		if r.Src != nil {
+			rt.Src = r.Src.String()
+		}
+		m.Routes = append(m.Routes, rt)
+	}
+	return m, nil
+}
+
+func printMigration(m *migration, verb string) {
+	fmt.Printf("%s %q <-> OVS bridge %q\n", verb, m.LinuxBridge, m.Bridge)
+	fmt.Printf("  ports:   %v\n", m.Ports)
+	fmt.Printf("  uplinks: %v\n", m.Uplinks)
+	fmt.Printf("  addrs:   %v\n", m.Addrs)
+	fmt.Printf("  routes:  %v\n", m.Routes)
+}
+
+// runMigration moves m from the Linux bridge to the OVS bridge. Containers
+// lose connectivity from their port's move until the uplinks and addresses
+// are moved too.
+func runMigration(m *migration) error {
+	br, err := ovs.NewSwitch(m.Bridge, "")
+	if err != nil {
+		return fmt.Errorf("failed to create bridge %q: %v", m.Bridge, err)
+	}
+	for _, name := range append(m.Ports, m.Uplinks...) {
+		log.Printf("migrate: moving %q to %q", name, m.Bridge)
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", name, err)
+		}
+		if err := netlink.LinkSetNoMaster(link); err != nil {
+			return fmt.Errorf("failed to detach %q from %q: %v", name, m.LinuxBridge, err)
+		}
+		if err := br.AddPort(name); err != nil {
+			return err
+		}
+	}
+	return moveAddrs(m, m.LinuxBridge, m.Bridge)
+}
+
+// revertMigration moves m back from the OVS bridge to the Linux bridge, the
+// uplinks first
+func revertMigration(m *migration) error {
+	if err := moveAddrs(m, m.Bridge, m.LinuxBridge); err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(m.LinuxBridge)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", m.LinuxBridge, err)
+	}
+	lb, ok := link.(*netlink.Bridge)
+	if !ok {
+		return fmt.Errorf("%q is a %s, not a Linux bridge", m.LinuxBridge, link.Type())
+	}
+	br := ovs.OpenSwitch(m.Bridge)
+	for _, name := range append(m.Uplinks, m.Ports...) {
+		link, err := netlink.LinkByName(name)
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			// the container went away since, and its veth with it
+			log.Printf("migrate: %q is gone", name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", name, err)
+		}
+		log.Printf("migrate: moving %q back to %q", name, m.LinuxBridge)
+		if err := br.DeletePort(name); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetMaster(link, lb); err != nil {
+			return fmt.Errorf("failed to attach %q to %q: %v", name, m.LinuxBridge, err)
+		}
+	}
+	return nil
+}
+
+// moveAddrs moves the addresses and then the routes of m from one interface
+// to the other and brings the target up
+func moveAddrs(m *migration, from, to string) error {
+	src, err := netlink.LinkByName(from)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", from, err)
+	}
+	dst, err := netlink.LinkByName(to)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", to, err)
+	}
+	if err := netlink.LinkSetUp(dst); err != nil {
+		return fmt.Errorf("failed to set %q up: %v", to, err)
+	}
+	for _, a := range m.Addrs {
+		addr, err := netlink.ParseAddr(a)
+		if err != nil {
+			return err
+		}
+		if err := netlink.AddrDel(src, addr); err != nil && err != syscall.EADDRNOTAVAIL {
+			return fmt.Errorf("failed to remove %s from %q: %v", a, from, err)
+		}
+		if err := netlink.AddrReplace(dst, addr); err != nil {
+			return fmt.Errorf("failed to add %s to %q: %v", a, to, err)
+		}
+	}
+	for _, rt := range m.Routes {
+		r := &netlink.Route{LinkIndex: dst.Attrs().Index}
+		if rt.Dst != "" {
+			_, dstNet, err := net.ParseCIDR(rt.Dst)
+			if err != nil {
+				return err
+			}
+			r.Dst = dstNet
+		}
+		r.Gw = net.ParseIP(rt.Gw)
+		r.Src = net.ParseIP(rt.Src)
+		if err := netlink.RouteReplace(r); err != nil {
+			return fmt.Errorf("failed to add route %v to %q: %v", rt, to, err)
+		}
+	}
+	return nil
+}
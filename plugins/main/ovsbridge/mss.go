@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// TCP/IP header sizes without options, subtracted from the MTU for the MSS
+const (
+	ipv4TCPHeaders = 20 + 20
+	ipv6TCPHeaders = 40 + 20
+)
+
+// mssForMTU is the TCP MSS fitting a segment into a packet of mtu bytes
+func mssForMTU(mtu int, ipv6 bool) (int, error) {
+	mss := mtu - ipv4TCPHeaders
+	if ipv6 {
+		mss = mtu - ipv6TCPHeaders
+	}
+	if mss <= 0 {
+		return 0, fmt.Errorf("MTU %d leaves no room for TCP payload", mtu)
+	}
+	return mss, nil
+}
+
+// clampMSS caps the MTU and advertised MSS of every route through ifName in
+// the current netns to pathMTU, so TCP never relies on path MTU discovery
+// to fit the path. The routes go away with the interface.
+func clampMSS(ifName string, pathMTU int) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		mss, err := mssForMTU(pathMTU, family == netlink.FAMILY_V6)
+		if err != nil {
+			return err
+		}
+		routes, err := netlink.RouteList(link, family)
+		if err != nil {
+			return fmt.Errorf("failed to list routes of %q: %v", ifName, err)
+		}
+		for _, r := range routes {
+			r.MTU = pathMTU
+			r.AdvMSS = mss
+			if err := netlink.RouteReplace(&r); err != nil {
+				return fmt.Errorf("failed to clamp MSS of route %v to %d: %v", r, mss, err)
+			}
+		}
+	}
+	return nil
+}
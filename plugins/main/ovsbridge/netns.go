@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"syscall"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// Every netlink, sysctl and ethtool call acts on the netns of the thread it
+// runs on. The main goroutine is locked to the main thread, which stays in
+// the netns the plugin was started in. A call for the container or the OVS
+// netns runs in that netns's Do, which runs it on a locked thread of its
+// own and discards the thread afterwards, so nested Do calls and goroutines
+// the runtime starts meanwhile cannot leave a thread in the wrong netns.
+// Helpers that take an interface name expect their caller to be in the
+// right Do already; the rest open the netns they need themselves.
+
+// pidNetnsRe matches the netns paths runtimes build from a process id, as
+// opposed to a netns bind mounted to a file such as /var/run/netns/<name>
+var pidNetnsRe = regexp.MustCompile(`^/proc/[0-9]+(/task/[0-9]+)?/ns/net$`)
+
+// netnsKind names the style of a netns path for the log
+func netnsKind(path string) string {
+	if pidNetnsRe.MatchString(path) {
+		return "pid path"
+	}
+	return "bind mount"
+}
+
+// openNetNS opens the container netns, explaining a failure by the style
+// of the path
+func openNetNS(path string) (ns.NetNS, error) {
+	netns, err := ns.GetNS(path)
+	if err == nil {
+		return netns, nil
+	}
+	if _, ok := err.(ns.NSPathNotExistErr); ok && pidNetnsRe.MatchString(path) {
+		return nil, classify(classNetns, errInternal, fmt.Errorf("failed to open netns %q: the process is gone: %v", path, err))
+	}
+	return nil, classify(classNetns, errInternal, fmt.Errorf("failed to open netns %q (%s): %v", path, netnsKind(path), err))
+}
+
+// delNetns is the netns path DEL should clean up in, "" if there is
+// nothing left there. The netns of an exited process takes the container
+// interface with it. A pid path may also have been reused by a process in
+// the plugin's own netns, which DEL must not touch.
+func delNetns(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	netns, err := ns.GetNS(path)
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		log.Printf("netns %q (%s) is gone, nothing to remove in it", path, netnsKind(path))
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to open netns %q (%s): %v", path, netnsKind(path), err)
+	}
+	netns.Close()
+	if !pidNetnsRe.MatchString(path) {
+		return path, nil
+	}
+	same, err := sameFile(path, "/proc/self/ns/net")
+	if err != nil {
+		return "", err
+	}
+	if same {
+		log.Printf("WARNING: netns %q is the plugin's own, its process is gone and the pid reused; not removing anything in it", path)
+		return "", nil
+	}
+	return path, nil
+}
+
+// sameFile tells whether a and b are the same inode, e.g. the same netns
+func sameFile(a, b string) (bool, error) {
+	var sa, sb syscall.Stat_t
+	if err := syscall.Stat(a, &sa); err != nil {
+		return false, fmt.Errorf("failed to stat %q: %v", a, err)
+	}
+	if err := syscall.Stat(b, &sb); err != nil {
+		return false, fmt.Errorf("failed to stat %q: %v", b, err)
+	}
+	return sa.Dev == sb.Dev && sa.Ino == sb.Ino, nil
+}
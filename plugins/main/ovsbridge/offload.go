@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"syscall"
+	"unsafe"
+)
+
+// ethtool ioctl commands setting a single offload, see linux/ethtool.h. The
+// vendored ethtool package can only read features.
+var offloadCmds = map[string]uint32{
+	"rx":  0x15, // ETHTOOL_SRXCSUM
+	"tx":  0x17, // ETHTOOL_STXCSUM
+	"sg":  0x19, // ETHTOOL_SSG
+	"tso": 0x1f, // ETHTOOL_STSO
+	"gso": 0x24, // ETHTOOL_SGSO
+	"gro": 0x2c, // ETHTOOL_SGRO
+}
+
+const siocEthtool = 0x8946
+
+type ethtoolValue struct {
+	cmd  uint32
+	data uint32
+}
+
+type ethtoolIfreq struct {
+	name [16]byte
+	data uintptr
+}
+
+// setOffloads turns the offloads of ifName in the current netns on or off,
+// like ethtool -K. The socket has to be opened in the netns of the link.
+func setOffloads(ifName string, features map[string]bool) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_IP)
+	if err != nil {
+		return fmt.Errorf("failed to open ethtool socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	names := make([]string, 0, len(features))
+	for name := range features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := ethtoolValue{cmd: offloadCmds[name]}
+		if features[name] {
+			value.data = 1
+		}
+		ifr := ethtoolIfreq{data: uintptr(unsafe.Pointer(&value))}
+		copy(ifr.name[:], ifName)
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), siocEthtool, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+			return fmt.Errorf("failed to set %s %t on %q: %v", name, features[name], ifName, errno)
+		}
+	}
+	return nil
+}
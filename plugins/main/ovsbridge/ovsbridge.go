@@ -1,11 +1,17 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"log"
 	"net"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
@@ -14,17 +20,16 @@ import (
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/j-keck/arping"
+	"github.com/linkernetworks/cni/pkg/ovs"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+	"github.com/vishvananda/netlink"
 )
 
-const defaultBrName = "ovsbr0"
-
-type NetConf struct {
-	types.NetConf
-	BrName string `json:"bridge"`
-	MTU    int    `json:"mtu"`
-	Device string `json:"device"`
-}
+// prevMasterKey is the device port external-id recording the master that
+// cnie detached the device from
+const prevMasterKey = "cnie-prev-master"
 
 func init() {
 	// this ensures that main runs only on main thread (thread group leader).
@@ -33,168 +38,1980 @@ func init() {
 	runtime.LockOSThread()
 }
 
-func loadNetConf(bytes []byte) (*NetConf, string, error) {
-	n := &NetConf{
-		BrName: defaultBrName,
+// setupVeth creates the veth pair and connects its host end to the bridge.
+// If hostName is set the host end is renamed to it, taking over the OVS port
+// record of that name. A pair it fails to connect is removed again.
+func setupVeth(args *skel.CmdArgs, netns, ovsNS ns.NetNS, br *ovs.Switch, ifName, hostName string, n *ovsconf.NetConf) (*current.Interface, *current.Interface, error) {
+	hostIface, contIface, err := createVeth(args, netns, ovsNS, ifName, hostName, n)
+	if err != nil {
+		return nil, nil, err
 	}
-	if err := json.Unmarshal(bytes, n); err != nil {
-		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
+
+	// connect host veth end to the bridge
+	if err := br.AddPort(hostIface.Name); err != nil {
+		rollbackVeth(args, n, netns, ovsNS, ifName, hostIface.Name)
+		return nil, nil, fmt.Errorf("failed to connect %q to bridge %v: %v", hostIface.Name, br.BridgeName(), err)
 	}
-	return n, n.CNIVersion, nil
+
+	return hostIface, contIface, nil
 }
 
-func setupVeth(netns ns.NetNS, br *OVSSwitch, ifName string, mtu int) (*current.Interface, *current.Interface, error) {
+// createVeth creates and configures the veth pair, leaving its host end in
+// ovsNS unattached. hostName renames the host end like for setupVeth. If a
+// step after creating the pair fails the pair is removed again.
+func createVeth(args *skel.CmdArgs, netns, ovsNS ns.NetNS, ifName, hostName string, n *ovsconf.NetConf) (_ *current.Interface, _ *current.Interface, err error) {
+	s := startSpan("veth")
+	defer func() { s.finish(err) }()
 	contIface := &current.Interface{}
 	hostIface := &current.Interface{}
+	defer func() {
+		if err != nil && hostIface.Name != "" {
+			rollbackVeth(args, n, netns, ovsNS, ifName, hostIface.Name)
+		}
+	}()
 
-	err := netns.Do(func(hostNS ns.NetNS) error {
-		// create the veth pair in the container and move host end into host netns
-		hostVeth, containerVeth, err := ip.SetupVeth(ifName, mtu, hostNS)
+	err = netns.Do(func(_ ns.NetNS) error {
+		// create the veth pair in the container and move host end into the
+		// netns of the bridge
+		hostVeth, containerVeth, err := setupVethPair(ifName, n.HostVethPrefix, n.MTU, n.VethRetries, ovsNS)
 		if err != nil {
 			return err
 		}
+		hostIface.Name = hostVeth.Name
+		if n.MAC != "" {
+			mac, _ := net.ParseMAC(n.MAC)
+			if err := setHardwareAddr(ifName, mac); err != nil {
+				return err
+			}
+			containerVeth.HardwareAddr = mac
+		}
+		if n.TxQueueLen > 0 {
+			if err := setTxQueueLen(ifName, n.TxQueueLen); err != nil {
+				return err
+			}
+		}
+		if len(n.OffloadFeatures) > 0 {
+			if err := setOffloads(ifName, n.OffloadFeatures); err != nil {
+				return err
+			}
+		}
 		contIface.Name = containerVeth.Name
 		contIface.Mac = containerVeth.HardwareAddr.String()
 		contIface.Sandbox = netns.Path()
-		hostIface.Name = hostVeth.Name
 		return nil
 	})
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// connect host veth end to the bridge
-	if err := br.addPort(hostIface.Name); err != nil {
-		return nil, nil, fmt.Errorf("failed to connect %q to bridge %v: %v", hostIface.Name, br.bridgeName, err)
+	if hostName != "" {
+		if err := ovsNS.Do(func(_ ns.NetNS) error {
+			return renameHostVeth(hostIface.Name, hostName)
+		}); err != nil {
+			return nil, nil, err
+		}
+		hostIface.Name = hostName
+	}
+
+	if n.HostMTU > 0 || n.TxQueueLen > 0 || len(n.OffloadFeatures) > 0 {
+		if err := ovsNS.Do(func(_ ns.NetNS) error {
+			// the pair was created with the container's MTU
+			if n.HostMTU > 0 && n.HostMTU != n.MTU {
+				if err := setMTU(hostIface.Name, n.HostMTU); err != nil {
+					return err
+				}
+			}
+			if n.TxQueueLen > 0 {
+				if err := setTxQueueLen(hostIface.Name, n.TxQueueLen); err != nil {
+					return err
+				}
+			}
+			if len(n.OffloadFeatures) > 0 {
+				return setOffloads(hostIface.Name, n.OffloadFeatures)
+			}
+			return nil
+		}); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	return hostIface, contIface, nil
 }
 
-func setupBridge(n *NetConf) (*OVSSwitch, *current.Interface, error) {
-	// create bridge if necessary
-	ovs, err := NewOVSSwitch(n.BrName)
+// setHardwareAddr sets the MAC of ifName in the current netns
+func setHardwareAddr(ifName string, mac net.HardwareAddr) error {
+	link, err := netlink.LinkByName(ifName)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create bridge %q: %v", n.BrName, err)
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
 	}
+	if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+		return fmt.Errorf("failed to set MAC %v on %q: %v", mac, ifName, err)
+	}
+	return nil
+}
 
-	return ovs, &current.Interface{
-		Name: n.BrName,
-	}, nil
+// setMTU sets the MTU of ifName in the current netns
+func setMTU(ifName string, mtu int) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("failed to set MTU %d on %q: %v", mtu, ifName, err)
+	}
+	return nil
+}
+
+// setTxQueueLen sets the transmit queue length of ifName in the current netns
+func setTxQueueLen(ifName string, qlen int) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	if err := netlink.LinkSetTxQLen(link, qlen); err != nil {
+		return fmt.Errorf("failed to set txqueuelen %d on %q: %v", qlen, ifName, err)
+	}
+	return nil
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
-	n, cniVersion, err := loadNetConf(args.StdinData)
+// errTryAgainLater is the CNI error code telling the runtime to retry
+const errTryAgainLater = 11
+
+// checkPortLimit fails with a try again later error once bridge holds max
+// container ports of other attachments
+func checkPortLimit(args *skel.CmdArgs, bridge string, max int) error {
+	attachments, err := ovs.ListAttachments()
 	if err != nil {
 		return err
 	}
+	count := 0
+	for _, a := range attachments {
+		if a.Bridge == bridge && !(a.ContainerID == args.ContainerID && a.IfName == args.IfName) {
+			count++
+		}
+	}
+	if count >= max {
+		return &types.Error{
+			Code: errTryAgainLater,
+			Msg:  fmt.Sprintf("bridge %q already has %d of at most %d container ports", bridge, count, max),
+		}
+	}
+	return nil
+}
 
-	br, brInterface, err := setupBridge(n)
+// checkDuplicateMAC fails if another container on the bridge already uses mac
+func checkDuplicateMAC(br *ovs.Switch, mac, containerID string) error {
+	ports, err := br.FindPorts(ovs.MACKey, mac)
 	if err != nil {
 		return err
 	}
+	for _, port := range ports {
+		owner, err := br.PortExternalID(port, ovs.ContainerIDKey)
+		if err != nil {
+			return err
+		}
+		if owner != containerID {
+			return fmt.Errorf("MAC %s is already used by container %q on port %q of bridge %q", mac, owner, port, br.BridgeName())
+		}
+	}
+	return nil
+}
 
-	if n.Device != "" {
-		if err := br.addPort(n.Device); err != nil {
+func configureBridge(br *ovs.Switch, conf *ovsconf.BridgeConf) error {
+	failMode := conf.FailMode
+	if conf.L2Normal {
+		failMode = "standalone"
+	}
+	if failMode != "" {
+		if err := br.SetFailMode(failMode); err != nil {
+			return err
+		}
+	}
+	if conf.L2Normal {
+		if err := br.AddNormalFlow(); err != nil {
+			return err
+		}
+	}
+	protocols := conf.Protocols
+	if len(protocols) == 0 && conf.Controller != "" {
+		// older ovs-vswitchd only speak OpenFlow 1.0 to a controller
+		// wanting a later version
+		protocols = ovsconf.DefaultControllerProtocols
+	}
+	if len(protocols) > 0 {
+		if err := br.SetProtocols(protocols); err != nil {
+			return err
+		}
+	}
+	if conf.ControllerPrivateKey != "" {
+		for _, path := range []string{conf.ControllerPrivateKey, conf.ControllerCertificate, conf.ControllerCACert} {
+			if err := checkReadable(path); err != nil {
+				return err
+			}
+		}
+		if err := ovs.SetSSL(conf.ControllerPrivateKey, conf.ControllerCertificate, conf.ControllerCACert); err != nil {
+			return err
+		}
+	}
+	if conf.Controller != "" {
+		if err := br.SetController(conf.Controller); err != nil {
+			return err
+		}
+		if conf.ControllerInactivityProbe > 0 || conf.ControllerMaxBackoff > 0 {
+			if err := br.SetControllerOptions(conf.ControllerInactivityProbe, conf.ControllerMaxBackoff); err != nil {
+				return err
+			}
+		}
+	}
+	if conf.RSTP {
+		if err := br.SetRSTP(true); err != nil {
+			return err
+		}
+	}
+	for i := range conf.Tunnels {
+		if err := addTunnelPort(br, &conf.Tunnels[i], conf.TunnelCsum); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	netns, err := ns.GetNS(args.Netns)
-	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+// addTunnelPort adds the tunnel to the bridge, with defaultCsum unless the
+// tunnel sets its own csum
+func addTunnelPort(br *ovs.Switch, t *ovsconf.TunnelConf, defaultCsum *bool) error {
+	options := map[string]string{
+		"remote_ip": t.RemoteIP,
 	}
-	defer netns.Close()
+	if t.Key != "" {
+		options["key"] = t.Key
+	}
+	csum := t.Csum
+	if csum == nil {
+		csum = defaultCsum
+	}
+	if csum != nil {
+		options["csum"] = strconv.FormatBool(*csum)
+	}
+	return br.AddTunnelPort(t.Name, t.Type, options, t.BFD)
+}
 
-	hostInterface, containerInterface, err := setupVeth(netns, br, args.IfName, n.MTU)
+// checkReadable fails unless path is a file this process can read
+func checkReadable(path string) error {
+	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return fmt.Errorf("cannot read %q: %v", path, err)
 	}
-
-	// run the IPAM plugin and get back the config to apply
-	r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+	defer f.Close()
+	fi, err := f.Stat()
 	if err != nil {
-		return err
+		return fmt.Errorf("cannot stat %q: %v", path, err)
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%q is a directory", path)
+	}
+	return nil
+}
+
+// configureVSwitchd applies the node global ovs-vswitchd settings
+func configureVSwitchd(conf *ovsconf.VSwitchdConf) error {
+	if conf.FlowLimit > 0 {
+		if err := ovs.SetVSwitchdOtherConfig("flow-limit", strconv.Itoa(conf.FlowLimit)); err != nil {
+			return err
+		}
+	}
+	if conf.MaxIdle > 0 {
+		if err := ovs.SetVSwitchdOtherConfig("max-idle", strconv.Itoa(conf.MaxIdle)); err != nil {
+			return err
+		}
+	}
+	if conf.EnableStatistics {
+		if err := ovs.SetVSwitchdOtherConfig("enable-statistics", "true"); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// Convert whatever the IPAM result was into the current Result type
-	result, err := current.NewResultFromResult(r)
+// checkVethDatapath refuses to attach a veth to a bridge of a DPDK enabled
+// userspace datapath, which would only reach it through a slow AF_PACKET
+// socket if at all, and warns about it on a plain netdev bridge
+func checkVethDatapath(br *ovs.Switch) error {
+	datapath, err := br.DatapathType()
 	if err != nil {
 		return err
 	}
-
-	if len(result.IPs) == 0 {
-		return errors.New("IPAM plugin returned missing IP config")
+	if datapath != "netdev" {
+		return nil
+	}
+	dpdk, err := ovs.DPDKInitialized()
+	if err != nil {
+		log.Printf("WARNING: cannot tell whether DPDK is initialized: %v", err)
+	}
+	if dpdk {
+		return fmt.Errorf("bridge %q is a DPDK netdev bridge, use portType tap instead of a kernel veth", br.BridgeName())
 	}
+	log.Printf("WARNING: attaching a kernel veth to netdev bridge %q, traffic goes through AF_PACKET; consider portType tap", br.BridgeName())
+	return nil
+}
 
-	result.Interfaces = []*current.Interface{brInterface, hostInterface, containerInterface}
+// ovsDatapathFamily is the generic netlink family of the openvswitch kernel
+// module, registered while the module is loaded or built in
+const ovsDatapathFamily = "ovs_datapath"
 
-	if err := netns.Do(func(_ ns.NetNS) error {
-		contVeth, err := net.InterfaceByName(args.IfName)
+// checkDatapath fails early, saying what is missing, when the datapath the
+// bridge uses is not available: the kernel datapath needs the openvswitch
+// module, the userspace one an ovs-vswitchd built with it. An existing
+// bridge is checked for the datapath it has unless datapathType is set.
+func checkDatapath(n *ovsconf.NetConf) error {
+	datapath := n.DatapathType
+	if datapath == "" {
+		bridges, err := ovs.ListBridges()
 		if err != nil {
 			return err
 		}
+		for _, name := range bridges {
+			if name != n.BrName {
+				continue
+			}
+			if datapath, err = ovs.OpenSwitch(name).DatapathType(); err != nil {
+				return err
+			}
+		}
+	}
+	// an empty datapath_type is the kernel datapath
+	if datapath == "" {
+		datapath = "system"
+	}
 
-		// Add the IP to the interface
-		// 0 -> bridge itself
-		// 1 -> veth endpoint
-		// 2 -> interface in container
-		// All IPs currently refer to the container interface
-		for _, ipc := range result.IPs {
-			ipc.Interface = current.Int(2)
+	supported, err := ovs.DatapathTypes()
+	if err != nil {
+		log.Printf("WARNING: cannot tell the datapath types ovs-vswitchd supports: %v", err)
+	}
+	if len(supported) > 0 {
+		found := false
+		for _, t := range supported {
+			found = found || t == datapath
+		}
+		if !found {
+			return fmt.Errorf("ovs-vswitchd does not support datapath type %q of bridge %q, only %s", datapath, n.BrName, strings.Join(supported, ", "))
 		}
-		if err := ipam.ConfigureIface(args.IfName, result); err != nil {
+	}
+	if datapath == "system" {
+		if _, err := netlink.GenlFamilyGet(ovsDatapathFamily); err != nil {
+			return fmt.Errorf("bridge %q needs the openvswitch kernel module for datapath type system, and it is not loaded (%v); run modprobe openvswitch or set datapathType netdev", n.BrName, err)
+		}
+	}
+	return nil
+}
+
+// checkFeatures fails early, naming the Open vSwitch release needed, when n
+// uses a feature the running OVS is too old for
+func checkFeatures(n *ovsconf.NetConf) error {
+	var features []string
+	if n.Protected {
+		features = append(features, "protected")
+	}
+	if n.Meter != nil {
+		features = append(features, "meter")
+	}
+	for _, feature := range features {
+		if err := ovs.RequireFeature(feature); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		// Send a gratuitous arp
-		for _, ipc := range result.IPs {
-			if ipc.Version == "4" {
-				_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contVeth)
-			}
+func setupBridge(n *ovsconf.NetConf) (_ *ovs.Switch, _ *current.Interface, err error) {
+	s := startSpan("bridge")
+	defer func() { s.finish(err) }()
+	if err := checkDatapath(n); err != nil {
+		return nil, nil, err
+	}
+	// create bridge if necessary
+	br, err := ovs.NewSwitch(n.BrName, n.DatapathType)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create bridge %q: %v", n.BrName, err)
+	}
+
+	if err := configureBridge(br, &n.BridgeConf); err != nil {
+		return nil, nil, fmt.Errorf("failed to configure bridge %q: %v", n.BrName, err)
+	}
+	if n.SecondaryBridge != nil {
+		if err := setupSecondaryBridge(br, n); err != nil {
+			return nil, nil, err
 		}
-		return nil
-	}); err != nil {
-		return err
 	}
 
-	return types.PrintResult(result, cniVersion)
+	return br, &current.Interface{
+		Name: n.BrName,
+	}, nil
+}
+
+// patchPortName is the patch port on one bridge leading to bridge peer
+func patchPortName(peer string) string {
+	return "patch-" + peer
 }
 
-func cmdDel(args *skel.CmdArgs) error {
-	n, _, err := loadNetConf(args.StdinData)
+// setupSecondaryBridge creates the secondary bridge of n if necessary,
+// applies its own settings and patches it to the primary bridge br
+func setupSecondaryBridge(br *ovs.Switch, n *ovsconf.NetConf) error {
+	sb := n.SecondaryBridge
+	// patch ports only connect bridges of the same datapath
+	other, err := ovs.NewSwitch(sb.BrName, n.DatapathType)
 	if err != nil {
+		return fmt.Errorf("failed to create bridge %q: %v", sb.BrName, err)
+	}
+	if err := configureBridge(other, &sb.BridgeConf); err != nil {
+		return fmt.Errorf("failed to configure bridge %q: %v", sb.BrName, err)
+	}
+	if err := br.AddPatchPort(patchPortName(sb.BrName), patchPortName(n.BrName)); err != nil {
 		return err
 	}
+	return other.AddPatchPort(patchPortName(n.BrName), patchPortName(sb.BrName))
+}
 
-	if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
-		return err
+// setupDevice puts the device in promiscuous mode with devicePromisc and
+// makes the members of a bond or team device agree on their MTU. The device
+// does not hand either on to members reliably, so both are set on every
+// member. With deviceMTU the bond and all members get it, otherwise members
+// that disagree fail the ADD unless bondMismatch is warn, since the smaller
+// MTU silently drops frames.
+func setupDevice(n *ovsconf.NetConf) error {
+	device, err := netlink.LinkByName(n.Device)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", n.Device, err)
+	}
+	links := []netlink.Link{device}
+	var members []netlink.Link
+	bonded := device.Type() == "bond" || device.Type() == "team"
+	if bonded {
+		all, err := netlink.LinkList()
+		if err != nil {
+			return fmt.Errorf("failed to list links: %v", err)
+		}
+		for _, link := range all {
+			if link.Attrs().MasterIndex == device.Attrs().Index {
+				members = append(members, link)
+			}
+		}
+		links = append(members, device)
+	}
+
+	if n.DevicePromisc {
+		for _, link := range links {
+			if link.Attrs().Promisc != 0 {
+				continue
+			}
+			if err := netlink.SetPromiscOn(link); err != nil {
+				return fmt.Errorf("failed to set %q promiscuous: %v", link.Attrs().Name, err)
+			}
+		}
+	} else if len(members) > 1 {
+		for _, link := range members[1:] {
+			first := members[0].Attrs()
+			if (link.Attrs().Promisc != 0) != (first.Promisc != 0) {
+				log.Printf("WARNING: members of %s %q disagree on promiscuous mode: %q has %t, %q has %t; set devicePromisc to align them",
+					device.Type(), n.Device, first.Name, first.Promisc != 0, link.Attrs().Name, link.Attrs().Promisc != 0)
+				break
+			}
+		}
 	}
 
-	if args.Netns == "" {
+	if !bonded {
+		return nil
+	}
+	if n.DeviceMTU > 0 {
+		for _, link := range links {
+			if link.Attrs().MTU == n.DeviceMTU {
+				continue
+			}
+			if err := netlink.LinkSetMTU(link, n.DeviceMTU); err != nil {
+				return fmt.Errorf("failed to set MTU %d on %q: %v", n.DeviceMTU, link.Attrs().Name, err)
+			}
+		}
 		return nil
 	}
 
-	// There is a netns so try to clean up. Delete can be called multiple times
-	// so don't return an error if the device is already removed.
-	// If the device isn't there then don't try to clean up IP masq either.
-	var ipnets []*net.IPNet
-	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		var err error
-		ipnets, err = ip.DelLinkByNameAddr(args.IfName)
-		if err != nil && err == ip.ErrLinkNotFound {
+	for _, link := range members {
+		first := members[0].Attrs()
+		if link.Attrs().MTU == first.MTU {
+			continue
+		}
+		if n.BondMismatch == ovsconf.BondMismatchWarn {
+			log.Printf("WARNING: members of %s %q disagree on MTU: %q has %d, %q has %d; frames above %d are dropped",
+				device.Type(), n.Device, first.Name, first.MTU, link.Attrs().Name, link.Attrs().MTU, minMTU(members))
+			return nil
+		}
+		return fmt.Errorf("members of %s %q disagree on MTU: %q has %d, %q has %d; set deviceMTU to align them",
+			device.Type(), n.Device, first.Name, first.MTU, link.Attrs().Name, link.Attrs().MTU)
+	}
+	return nil
+}
+
+// minMTU is the smallest MTU of links
+func minMTU(links []netlink.Link) int {
+	mtu := links[0].Attrs().MTU
+	for _, link := range links[1:] {
+		if link.Attrs().MTU < mtu {
+			mtu = link.Attrs().MTU
+		}
+	}
+	return mtu
+}
+
+// resolveDevice sets n.Device to the first of the device and its fallbacks
+// present on the node. Without any, it fails unless the device is optional,
+// then n.Device is cleared and the bridge goes without an uplink.
+func resolveDevice(n *ovsconf.NetConf) error {
+	for _, name := range append([]string{n.Device}, n.DeviceFallback...) {
+		_, err := netlink.LinkByName(name)
+		if err == nil {
+			if name != n.Device {
+				log.Printf("WARNING: device %q not found, using fallback %q", n.Device, name)
+				n.Device = name
+			}
 			return nil
 		}
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return fmt.Errorf("failed to lookup device %q: %v", name, err)
+		}
+	}
+	if !n.DeviceOptional {
+		return fmt.Errorf("device %q not found", n.Device)
+	}
+	log.Printf("WARNING: device %q not found, bridge %q has no uplink", n.Device, n.BrName)
+	n.Device = ""
+	return nil
+}
+
+// attachDevice adds the physical NIC to the bridge. A NIC already enslaved to
+// a Linux bridge or bond is only detached from that master when force is set,
+// one on another OVS bridge is only moved under the reattach policy.
+func attachDevice(br *ovs.Switch, device string, force bool, policy string) error {
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", device, err)
+	}
+
+	var master netlink.Link
+	if idx := link.Attrs().MasterIndex; idx != 0 {
+		master, err = netlink.LinkByIndex(idx)
+		if err != nil {
+			return fmt.Errorf("failed to lookup master of device %q: %v", device, err)
+		}
+		// ports of an OVS bridge are enslaved to the ovs-system datapath
+		if master.Type() == "openvswitch" {
+			master = nil
+			if err := moveForeignDevice(br, device, policy); err != nil {
+				return err
+			}
+		}
+	}
+
+	if master != nil {
+		masterName := master.Attrs().Name
+		if !force {
+			return fmt.Errorf("device %q is enslaved to %q, set forceDetachPNIC to detach it", device, masterName)
+		}
+		log.Printf("WARNING: detaching device %q from %q to attach it to bridge %q", device, masterName, br.BridgeName())
+		if err := netlink.LinkSetNoMaster(link); err != nil {
+			return fmt.Errorf("failed to detach device %q from %q: %v", device, masterName, err)
+		}
+		if err := br.AddPort(device); err != nil {
+			return err
+		}
+		return br.SetPortExternalID(device, prevMasterKey, masterName)
+	}
+
+	return br.AddPort(device)
+}
+
+// uplinkPort is the port of the bridge n.Device is attached as: the device
+// itself, or its VLAN sub-interface with pnicVlan. n.Device stays the
+// configured trunk, resolved against its fallbacks; it is "" without an
+// uplink.
+func uplinkPort(n *ovsconf.NetConf) string {
+	if n.Device != "" && n.PNICVlan != 0 {
+		return pnicVlanName(n.Device, n.PNICVlan)
+	}
+	return n.Device
+}
+
+// attachUplink attaches n.Device, or its VLAN n.PNICVlan, to br as the port
+// uplinkPort names, creating the sub-interface if needed
+func attachUplink(br *ovs.Switch, n *ovsconf.NetConf) error {
+	if n.PNICVlan == 0 {
+		if err := attachUplinkDevice(br, n, n.Device); err != nil {
+			return err
+		}
+		return configureUplinkPort(br, n)
+	}
+	name, created, err := setupPNICVlan(n.Device, n.PNICVlan)
+	if err != nil {
+		return err
+	}
+	if err := attachUplinkDevice(br, n, name); err != nil {
+		if created {
+			if link, lerr := netlink.LinkByName(name); lerr == nil {
+				netlink.LinkDel(link)
+			}
+		}
+		return err
+	}
+	if created {
+		if err := br.SetPortExternalID(name, pnicVlanKey, "true"); err != nil {
+			return err
+		}
+	}
+	return configureUplinkPort(br, n)
+}
+
+// configureUplinkPort applies the settings of the uplink port uplinkPort
+// names: the trunk's native VLAN and the port's RSTP settings
+func configureUplinkPort(br *ovs.Switch, n *ovsconf.NetConf) error {
+	port := uplinkPort(n)
+	if n.NativeVlan != 0 {
+		if err := br.SetPortNativeVlan(port, n.NativeVlan); err != nil {
+			return err
+		}
+	}
+	if n.UplinkSTP != nil {
+		return br.SetPortOtherConfig(port, n.UplinkSTP.OtherConfig())
+	}
+	return nil
+}
+
+// attachUplinkDevice attaches device to br the way n.DeviceAttach asks for
+func attachUplinkDevice(br *ovs.Switch, n *ovsconf.NetConf, device string) error {
+	if n.DeviceAttach != ovsconf.DeviceAttachSeamless {
+		return attachDevice(br, device, n.ForceDetachPNIC, n.ForeignDevice)
+	}
+	// an earlier ADD moved the addresses already, touch nothing
+	bridge, err := ovs.PortBridge(device)
+	if err != nil {
 		return err
+	}
+	if bridge == br.BridgeName() {
+		return nil
+	}
+	return attachDeviceSeamless(br, device, func() error {
+		return attachDevice(br, device, n.ForceDetachPNIC, n.ForeignDevice)
 	})
+}
 
+// attachDeviceSeamless runs attach with the host's addresses of device
+// moved to the bridge interface around it. The bridge interface is brought
+// up and given the addresses first, so the host always has them on an
+// interface that is up: on device until attach, on the bridge after it.
+// The routes through device are moved last.
+func attachDeviceSeamless(br *ovs.Switch, device string, attach func() error) error {
+	name := br.BridgeName()
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", device, err)
+	}
+	brLink, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup bridge interface %q: %v", name, err)
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of %q: %v", device, err)
+	}
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
 	if err != nil {
+		return fmt.Errorf("failed to list routes of %q: %v", device, err)
+	}
+
+	if err := netlink.LinkSetMTU(brLink, link.Attrs().MTU); err != nil {
+		return fmt.Errorf("failed to set MTU of %q: %v", name, err)
+	}
+	if err := netlink.LinkSetUp(brLink); err != nil {
+		return fmt.Errorf("failed to set %q up: %v", name, err)
+	}
+	var moved []netlink.Addr
+	for _, addr := range addrs {
+		// the kernel gives every interface its own link-local address
+		if addr.Scope == int(netlink.SCOPE_LINK) {
+			continue
+		}
+		a := netlink.Addr{IPNet: addr.IPNet, Flags: addr.Flags}
+		if err := netlink.AddrReplace(brLink, &a); err != nil {
+			return fmt.Errorf("failed to add %s to %q: %v", addr.IPNet, name, err)
+		}
+		moved = append(moved, a)
+	}
+
+	if err := attach(); err != nil {
+		for _, a := range moved {
+			netlink.AddrDel(brLink, &a)
+		}
 		return err
 	}
 
-	return err
+	for _, a := range moved {
+		if err := netlink.AddrDel(link, &a); err != nil && err != syscall.EADDRNOTAVAIL {
+			return fmt.Errorf("failed to remove %s from %q: %v", a.IPNet, device, err)
+		}
+	}
+	for _, r := range routes {
+		// the kernel adds the subnet routes of the addresses itself
+		if r.Protocol == syscall.RTPROT_KERNEL {
+			continue
+		}
+		r.LinkIndex = brLink.Attrs().Index
+		if err := netlink.RouteReplace(&r); err != nil {
+			return fmt.Errorf("failed to move route %v to %q: %v", r, name, err)
+		}
+	}
+	if len(moved) > 0 {
+		log.Printf("moved %d addresses and the routes of %q to %q", len(moved), device, name)
+	}
+	return nil
 }
 
-func main() {
+// moveForeignDevice removes device from the OVS bridge it is a port of if
+// that is not br, which ovs-vsctl would otherwise refuse to add it to
+func moveForeignDevice(br *ovs.Switch, device, policy string) error {
+	bridge, err := ovs.PortBridge(device)
+	if err != nil || bridge == "" || bridge == br.BridgeName() {
+		return err
+	}
+	if policy != ovsconf.ForeignPortReattach {
+		return fmt.Errorf("device %q is a port of bridge %q, not of %q; set foreignDevice to reattach to move it",
+			device, bridge, br.BridgeName())
+	}
+	log.Printf("WARNING: moving device %q from bridge %q to %q", device, bridge, br.BridgeName())
+	return ovs.OpenSwitch(bridge).DeletePort(device)
+}
+
+// releaseDevice gives the physical NIC back to the master it was detached
+// from once it is the last port left on the bridge.
+func releaseDevice(br *ovs.Switch, device string) error {
+	masterName, err := br.PortExternalID(device, prevMasterKey)
+	if err != nil || masterName == "" {
+		return err
+	}
+
+	ports, err := br.ListPorts()
+	if err != nil {
+		return err
+	}
+	for _, port := range ports {
+		if port != device {
+			return nil
+		}
+	}
+
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", device, err)
+	}
+	master, err := netlink.LinkByName(masterName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup master %q of device %q: %v", masterName, device, err)
+	}
+
+	log.Printf("WARNING: restoring device %q to its previous master %q", device, masterName)
+	if err := br.DeletePort(device); err != nil {
+		return err
+	}
+	if err := netlink.LinkSetMasterByIndex(link, master.Attrs().Index); err != nil {
+		return fmt.Errorf("failed to restore device %q to %q: %v", device, masterName, err)
+	}
+	return nil
+}
+
+// waitLinkUp polls until device is operationally up. Running out of time is
+// only logged, a device without carrier does not fail the ADD.
+func waitLinkUp(device string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		link, err := netlink.LinkByName(device)
+		if err != nil {
+			return fmt.Errorf("failed to lookup device %q: %v", device, err)
+		}
+		if link.Attrs().OperState == netlink.OperUp {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			log.Printf("WARNING: device %q is still %s after %v", device, link.Attrs().OperState, timeout)
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// disableDAD keeps the kernel from running duplicate address detection on
+// the IPv6 addresses added to ifName, so they are usable at once
+func disableDAD(ifName string, result *current.Result) error {
+	for _, ipc := range result.IPs {
+		if ipc.Version == "6" {
+			name := fmt.Sprintf("net.ipv6.conf.%s.accept_dad", ifName)
+			if _, err := sysctl.Sysctl(name, "0"); err != nil {
+				return fmt.Errorf("failed to set %s: %v", name, err)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// addGatewayNeigh adds a permanent neighbor entry mapping the gateways of
+// result to mac, so the container never ARPs or solicits for them
+func addGatewayNeigh(ifName string, result *current.Result, mac string) error {
+	// validated by LoadNetConf
+	hwAddr, _ := net.ParseMAC(mac)
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	for _, ipc := range result.IPs {
+		if ipc.Gateway == nil {
+			continue
+		}
+		if err := netlink.NeighSet(&netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			State:        netlink.NUD_PERMANENT,
+			IP:           ipc.Gateway,
+			HardwareAddr: hwAddr,
+		}); err != nil {
+			return fmt.Errorf("failed to add neighbor %s for gateway %s: %v", mac, ipc.Gateway, err)
+		}
+	}
+	return nil
+}
+
+// addNeighbors adds the permanent neighbor entries of the config to ifName
+func addNeighbors(ifName string, neighbors []ovsconf.NeighborConf) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	for _, nb := range neighbors {
+		// validated by LoadNetConf
+		hwAddr, _ := net.ParseMAC(nb.MAC)
+		if err := netlink.NeighSet(&netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			State:        netlink.NUD_PERMANENT,
+			IP:           net.ParseIP(nb.IP),
+			HardwareAddr: hwAddr,
+		}); err != nil {
+			return fmt.Errorf("failed to add neighbor %s for %s: %v", nb.MAC, nb.IP, err)
+		}
+	}
+	return nil
+}
+
+// setLinkDown sets the configured container interface administratively
+// down, keeping its IPv6 addresses, which the kernel would remove otherwise
+func setLinkDown(ifName string, result *current.Result) error {
+	for _, ipc := range result.IPs {
+		if ipc.Version == "6" {
+			name := fmt.Sprintf("net.ipv6.conf.%s.keep_addr_on_down", ifName)
+			if _, err := sysctl.Sysctl(name, "1"); err != nil {
+				log.Printf("WARNING: failed to set %s, the IPv6 addresses go with the link: %v", name, err)
+			}
+			break
+		}
+	}
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	if err := netlink.LinkSetDown(link); err != nil {
+		return fmt.Errorf("failed to set %q down: %v", ifName, err)
+	}
+	return nil
+}
+
+// setupRA sets how the container interface handles IPv6 router
+// advertisements. Unless configured, RAs are ignored when IPAM assigned an
+// IPv6 address, so SLAAC does not add addresses and routes next to it.
+func setupRA(ifName string, n *ovsconf.NetConf, result *current.Result) error {
+	acceptRA := n.AcceptRA
+	if acceptRA == nil {
+		for _, ipc := range result.IPs {
+			if ipc.Version == "6" {
+				acceptRA = new(int)
+				break
+			}
+		}
+	}
+	settings := map[string]string{}
+	if acceptRA != nil {
+		settings["accept_ra"] = strconv.Itoa(*acceptRA)
+	}
+	if n.Autoconf != nil {
+		settings["autoconf"] = "0"
+		if *n.Autoconf {
+			settings["autoconf"] = "1"
+		}
+	}
+	for key, value := range settings {
+		name := fmt.Sprintf("net.ipv6.conf.%s.%s", ifName, key)
+		if _, err := sysctl.Sysctl(name, value); err != nil {
+			return fmt.Errorf("failed to set %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// setupLoopback brings up lo in the current netns
+func setupLoopback() error {
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("failed to lookup lo: %v", err)
+	}
+	if err := netlink.LinkSetUp(lo); err != nil {
+		return fmt.Errorf("failed to set lo up: %v", err)
+	}
+	return nil
+}
+
+// containerIfName is the name of the interface inside the container. The
+// runtime asks for args.IfName unless the config overrides it.
+func containerIfName(args *skel.CmdArgs, n *ovsconf.NetConf) string {
+	if n.ContainerInterfaceName != "" {
+		return n.ContainerInterfaceName
+	}
+	return args.IfName
+}
+
+// parseCNIArgs splits the runtime's CNI_ARGS into its keys and values
+func parseCNIArgs(args *skel.CmdArgs) map[string]string {
+	cniArgs := map[string]string{}
+	for _, pair := range strings.Split(args.Args, ";") {
+		if kv := strings.SplitN(pair, "=", 2); len(kv) == 2 {
+			cniArgs[kv[0]] = kv[1]
+		}
+	}
+	return cniArgs
+}
+
+// ifAlias expands the {pod}, {namespace} and {containerID} placeholders of
+// the alias template from the runtime's CNI_ARGS
+func ifAlias(args *skel.CmdArgs, template string) string {
+	cniArgs := parseCNIArgs(args)
+	alias := strings.NewReplacer(
+		"{pod}", cniArgs["K8S_POD_NAME"],
+		"{namespace}", cniArgs["K8S_POD_NAMESPACE"],
+		"{containerID}", args.ContainerID,
+	).Replace(template)
+	// IFALIASZ is 256 including the terminating NUL
+	if len(alias) > 255 {
+		alias = alias[:255]
+	}
+	return alias
+}
+
+// prefixedMAC returns the MAC of the attachment under prefix, the other
+// three bytes are taken from a hash of the attachment so a re-ADD gets the
+// same MAC back
+func prefixedMAC(args *skel.CmdArgs, prefix string) string {
+	// validated by LoadNetConf
+	oui, _ := ovsconf.ParseOUI(prefix)
+	h := attachmentHash(args)
+	mac := net.HardwareAddr{oui[0], oui[1], oui[2], byte(h >> 16), byte(h >> 8), byte(h)}
+	return mac.String()
+}
+
+// assignMAC sets n.MAC to the generated MAC when stickyMAC or macPrefix ask
+// for one
+func assignMAC(args *skel.CmdArgs, n *ovsconf.NetConf) error {
+	var err error
+	switch {
+	case n.StickyMAC:
+		n.MAC, err = stickyMAC(args, n.MACPrefix)
+	case n.MACPrefix != "":
+		n.MAC = prefixedMAC(args, n.MACPrefix)
+	}
+	return err
+}
+
+// stickyMAC returns the MAC of the pod's interface, hashed from its
+// namespace, name and ifname rather than from the container, so the pod gets
+// it back when it is rescheduled to another node. The first three bytes are
+// prefix if set, else the MAC is locally administered throughout.
+func stickyMAC(args *skel.CmdArgs, prefix string) (string, error) {
+	cniArgs := parseCNIArgs(args)
+	namespace, pod := cniArgs["K8S_POD_NAMESPACE"], cniArgs["K8S_POD_NAME"]
+	if namespace == "" || pod == "" {
+		return "", fmt.Errorf("stickyMAC requires K8S_POD_NAMESPACE and K8S_POD_NAME in CNI_ARGS")
+	}
+	h := fnv.New64a()
+	h.Write([]byte(namespace + "/" + pod + "/" + args.IfName))
+	sum := h.Sum64()
+	mac := net.HardwareAddr{0x02, byte(sum >> 32), byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)}
+	if prefix != "" {
+		// validated by LoadNetConf
+		oui, _ := ovsconf.ParseOUI(prefix)
+		copy(mac, oui[:])
+	}
+	return mac.String(), nil
+}
+
+// sendGARP sends one gratuitous ARP for ip over iface
+var sendGARP = arping.GratuitousArpOverIface
+
+// sendGARPs sends count rounds of gratuitous ARPs for the IPv4 addresses of
+// result over iface, interval milliseconds apart. They are best effort, a
+// failed one is not retried.
+func sendGARPs(iface net.Interface, result *current.Result, count, interval int) {
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(interval) * time.Millisecond)
+		}
+		for _, ipc := range result.IPs {
+			if ipc.Version == "4" {
+				_ = sendGARP(ipc.Address.IP, iface)
+			}
+		}
+	}
+}
+
+// attachmentID identifies the container attachment in OVS records
+func attachmentID(args *skel.CmdArgs) string {
+	return args.ContainerID + "/" + args.IfName
+}
+
+// attachmentHash is a stable hash of the attachment for deriving names
+func attachmentHash(args *skel.CmdArgs) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(attachmentID(args)))
+	return h.Sum64()
+}
+
+// meterID is the OpenFlow meter of the attachment. Like prefixedMAC it is
+// taken from the hash, 24 bits of it.
+func meterID(args *skel.CmdArgs) uint32 {
+	return 1 + uint32(attachmentHash(args)&0xffffff)
+}
+
+// openOVSNetNS returns the netns the bridge lives in, the current one when
+// path is empty
+func openOVSNetNS(path string) (ns.NetNS, error) {
+	if path == "" {
+		return ns.GetCurrentNS()
+	}
+	ovsNS, err := ns.GetNS(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open OVS netns %q: %v", path, err)
+	}
+	return ovsNS, nil
+}
+
+// hostVethName returns the name of the host end of the container's veth, or
+// "" if the container interface is already gone
+func hostVethName(netnsPath string, ovsNS ns.NetNS, ifName string) (string, error) {
+	var name string
+	err := ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		_, peerIndex, err := ip.GetVethPeerIfindex(ifName)
+		if err != nil {
+			return nil
+		}
+		return ovsNS.Do(func(_ ns.NetNS) error {
+			if hostVeth, err := netlink.LinkByIndex(peerIndex); err == nil {
+				name = hostVeth.Attrs().Name
+			}
+			return nil
+		})
+	})
+	return name, err
+}
+
+// logOVSVersion logs the Open vSwitch release the plugin runs against, for
+// matching logs with the feature gates. Failing to get it is only logged.
+func logOVSVersion() {
+	version, err := ovs.Version()
+	if err != nil {
+		log.Printf("WARNING: %v", err)
+		return
+	}
+	log.Printf("Open vSwitch %s", version)
+}
+
+// loadNetConf loads the network config of the invocation with the
+// environment overrides applied
+func loadNetConf(args *skel.CmdArgs) (*ovsconf.NetConf, string, error) {
+	n, cniVersion, err := ovsconf.LoadNetConf(args.StdinData)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := n.ApplyEnv(os.Getenv); err != nil {
+		return nil, "", err
+	}
+	if err := n.Validate(); err != nil {
+		return nil, "", err
+	}
+	if n.Syslog != nil {
+		setupSyslog(n.Syslog)
+	}
+	return n, cniVersion, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) (err error) {
+	n, cniVersion, err := loadNetConf(args)
+	if err != nil {
+		return classify(classConfig, errInvalidConfig, err)
+	}
+	root := startTracing(n.Tracing, "ADD", args)
+	defer func() { finishTracing(root, err) }()
+	if err := checkPrivileges(n); err != nil {
+		return err
+	}
+	start := time.Now()
+	// only the OVS tools can be killed, netlink and IPAM run to completion
+	if n.AddTimeout > 0 {
+		ovs.SetDeadline(start.Add(time.Duration(n.AddTimeout) * time.Millisecond))
+	}
+	result, err := addResult(args, n)
+	if err != nil {
+		// rolled back already, the runtime may just retry
+		if n.AddTimeout > 0 && time.Since(start) >= time.Duration(n.AddTimeout)*time.Millisecond {
+			return &types.Error{
+				Code:    errTryAgainLater,
+				Msg:     fmt.Sprintf("ADD of %s exceeded addTimeout of %dms", attachmentID(args), n.AddTimeout),
+				Details: err.Error(),
+			}
+		}
+		return err
+	}
+	if n.DebugDir != "" {
+		writeDebugRecord(n.DebugDir, args, result, cniVersion)
+	}
+	return types.PrintResult(result, cniVersion)
+}
+
+// addResult attaches the container as n describes and returns the result
+// cmdAdd prints. It is the ADD without the CNI I/O, for callers embedding
+// the plugin. A failure removes what was created so far.
+func addResult(args *skel.CmdArgs, n *ovsconf.NetConf) (_ *current.Result, err error) {
+	h, err := ovsconf.LoadHostConf(ovsconf.HostConfPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.Check(n); err != nil {
+		return nil, classify(classConfig, errInvalidConfig, err)
+	}
+	// a broken flows file fails before anything is created
+	if n.FlowsFile != "" {
+		if _, err := ovs.LoadFlowsTemplate(n.FlowsFile); err != nil {
+			return nil, classify(classConfig, errInvalidConfig, err)
+		}
+	}
+	// every kind of attachment takes turns with the others of its bridge
+	unlock, err := lockBridge(n)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if n.HostBridgeType == ovsconf.HostBridgeLinux {
+		return addLinuxResult(args, n)
+	}
+	if n.PortType == ovsconf.PortTypeMacvlan || n.PortType == ovsconf.PortTypeIPVlan {
+		return addSubLinkResult(args, n)
+	}
+	if n.OVSBinDir != "" {
+		if err := ovs.SetBinDir(n.OVSBinDir); err != nil {
+			return nil, err
+		}
+	}
+	if n.OVSDB != "" {
+		if err := ovs.SetDB(n.OVSDB, n.OVSDBPrivateKey, n.OVSDBCertificate, n.OVSDBCACert); err != nil {
+			return nil, err
+		}
+	}
+	if n.Verbose {
+		logOVSVersion()
+	}
+	if n.OVSSystemID != "" {
+		id, err := ovs.SystemID()
+		if err != nil {
+			return nil, err
+		}
+		if id != n.OVSSystemID {
+			return nil, fmt.Errorf("connected to Open vSwitch with system-id %q, expected %q", id, n.OVSSystemID)
+		}
+	}
+	if err := checkFeatures(n); err != nil {
+		return nil, err
+	}
+
+	if err := reapQuarantine(args, n); err != nil {
+		return nil, err
+	}
+
+	if result, err := replayAdd(args, n); err != nil || result != nil {
+		return result, err
+	}
+
+	if h.MaxPortsPerBridge > 0 {
+		if err := checkPortLimit(args, n.BrName, h.MaxPortsPerBridge); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.VSwitchd != nil && n.VSwitchd.Enable {
+		if err := configureVSwitchd(n.VSwitchd); err != nil {
+			return nil, err
+		}
+	}
+
+	br, brInterface, err := setupBridge(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.PortType == "" || n.PortType == ovsconf.PortTypeVeth {
+		if err := checkVethDatapath(br); err != nil {
+			return nil, err
+		}
+	}
+
+	ovsNS, err := openOVSNetNS(n.OVSNetns)
+	if err != nil {
+		return nil, err
+	}
+	defer ovsNS.Close()
+
+	if n.Device != "" {
+		if err := ovsNS.Do(func(_ ns.NetNS) error {
+			return resolveDevice(n)
+		}); err != nil {
+			return nil, err
+		}
+		if n.Device == "" && n.Bandwidth != nil {
+			log.Printf("WARNING: no bandwidth for %s without a device", attachmentID(args))
+			n.Bandwidth = nil
+		}
+	}
+
+	var uplinkInterface *current.Interface
+	var uplinkMTU int
+	if n.Device != "" {
+		if err := ovsNS.Do(func(_ ns.NetNS) error {
+			if err := setupDevice(n); err != nil {
+				return err
+			}
+			if err := attachUplink(br, n); err != nil {
+				return err
+			}
+			port := uplinkPort(n)
+			link, err := netlink.LinkByName(port)
+			if err != nil {
+				return fmt.Errorf("failed to lookup device %q: %v", port, err)
+			}
+			uplinkInterface = &current.Interface{
+				Name: port,
+				Mac:  link.Attrs().HardwareAddr.String(),
+			}
+			uplinkMTU = link.Attrs().MTU
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	netns, err := openNetNS(args.Netns)
+	if err != nil {
+		return nil, err
+	}
+	defer netns.Close()
+
+	if err := assignMAC(args, n); err != nil {
+		return nil, err
+	}
+	if n.RejectDuplicateMAC && n.MAC != "" {
+		if err := checkDuplicateMAC(br, n.MAC, args.ContainerID); err != nil {
+			return nil, err
+		}
+	}
+
+	ifName := containerIfName(args, n)
+	if n.PortType == "" || n.PortType == ovsconf.PortTypeVeth {
+		if err := handleForeignPort(args, ovsNS, br, ifName, n); err != nil {
+			return nil, err
+		}
+	}
+	reusePort, err := handleStalePorts(args, ovsNS, br, n)
+	if err != nil {
+		return nil, err
+	}
+
+	reuseIface, err := handleIfNameCollision(netns, ifName, n)
+	if err != nil {
+		return nil, err
+	}
+
+	var hostInterface, containerInterface *current.Interface
+	switch {
+	case reuseIface:
+		hostInterface, containerInterface, err = reuseVeth(netns, ovsNS, br, ifName)
+	case n.PortType == ovsconf.PortTypeTap:
+		hostInterface, containerInterface, err = setupTap(args, netns, ovsNS, br, ifName, n)
+	case n.PortType == ovsconf.PortTypeVF:
+		hostInterface, containerInterface, err = setupVF(netns, ovsNS, br, ifName, n)
+	default:
+		hostInterface, containerInterface, err = setupVeth(args, netns, ovsNS, br, ifName, reusePort, n)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// from here on a failed ADD removes what it created
+	ipamDone := false
+	defer func() {
+		if err != nil {
+			// the rollback has to run even after the deadline
+			ovs.SetDeadline(time.Time{})
+			rollbackAdd(args, n, br, hostInterface.Name, ipamDone)
+		}
+	}()
+
+	flows, err := configurePort(args, n, br, hostInterface.Name, containerInterface.Mac)
+	if err != nil {
+		return nil, err
+	}
+	// the rollback removes the block with the attachment's other flows
+	if n.SafeBringup {
+		if err := br.Flows(attachmentID(args)).BlockPort(hostInterface.Name, containerInterface.Mac); err != nil {
+			return nil, err
+		}
+	}
+
+	// run the IPAM plugin and get back the config to apply
+	result, err := execIPAM(args, n)
+	if err != nil {
+		return nil, err
+	}
+	ipamDone = true
+
+	if len(result.IPs) == 0 {
+		return nil, errors.New("IPAM plugin returned missing IP config")
+	}
+	// on the same destination the IPAM route wins. The result lists the
+	// routes as configureIface installs them, the implied defaults included,
+	// so the runtime and chained plugins see them in any CNI version.
+	result.Routes = resultRoutes(result.IPs, result.Routes, n.RuntimeConfig.Routes)
+
+	result.Interfaces = []*current.Interface{brInterface, hostInterface, containerInterface}
+	// the uplink goes last, after the container interface
+	if uplinkInterface != nil {
+		result.Interfaces = append(result.Interfaces, uplinkInterface)
+	}
+
+	// let the uplink come up so the first packets and the garps get out
+	if n.Device != "" && n.LinkUpTimeout > 0 {
+		if err := ovsNS.Do(func(_ ns.NetNS) error {
+			return waitLinkUp(uplinkPort(n), time.Duration(n.LinkUpTimeout)*time.Millisecond)
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := netns.Do(func(_ ns.NetNS) error {
+		if n.SetupLoopback {
+			if err := setupLoopback(); err != nil {
+				return err
+			}
+		}
+
+		contVeth, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return err
+		}
+
+		// All IPs refer to the container interface
+		if err := ipInterfaces(result, ifName, args.Netns); err != nil {
+			return err
+		}
+		if n.SkipDAD {
+			if err := disableDAD(ifName, result); err != nil {
+				return err
+			}
+		}
+		if err := setupRA(ifName, n, result); err != nil {
+			return err
+		}
+		if err := configureIface(ifName, result); err != nil {
+			return err
+		}
+		if n.ClampMSS {
+			// an uplink smaller than the container interface is the path
+			pathMTU := contVeth.MTU
+			if uplinkMTU > 0 && uplinkMTU < pathMTU {
+				pathMTU = uplinkMTU
+			}
+			if err := clampMSS(ifName, pathMTU); err != nil {
+				return err
+			}
+		}
+		if n.ProxyARP {
+			name := fmt.Sprintf("net.ipv4.conf.%s.proxy_arp", ifName)
+			if _, err := sysctl.Sysctl(name, "1"); err != nil {
+				return fmt.Errorf("failed to set %s: %v", name, err)
+			}
+		}
+		if n.GatewayMAC != "" {
+			if err := addGatewayNeigh(ifName, result, n.GatewayMAC); err != nil {
+				return err
+			}
+		}
+		if len(n.Neighbors) > 0 {
+			if err := addNeighbors(ifName, n.Neighbors); err != nil {
+				return err
+			}
+		}
+
+		if n.IfAlias != "" {
+			link, err := netlink.LinkByName(ifName)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+			}
+			if err := netlink.LinkSetAlias(link, ifAlias(args, n.IfAlias)); err != nil {
+				return fmt.Errorf("failed to set alias of %q: %v", ifName, err)
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if n.EgressNAT != nil {
+		if err := setupEgressNAT(flows, ovsNS, br, hostInterface.Name, containerInterface.Mac, result, n); err != nil {
+			return nil, err
+		}
+	}
+	if n.EgressUplink != "" {
+		if err := steerToUplink(flows, br, hostInterface.Name, n, result); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := publishIPs(br, hostInterface.Name, result); err != nil {
+		return nil, err
+	}
+
+	if n.SafeBringup {
+		if err := br.Flows(attachmentID(args)).UnblockPort(hostInterface.Name, containerInterface.Mac); err != nil {
+			return nil, err
+		}
+	}
+	// Send gratuitous arps, best effort. They are only sent now so they get
+	// past the block of safeBringup.
+	if err := netns.Do(func(_ ns.NetNS) error {
+		if n.LinkState == ovsconf.LinkStateDown {
+			return setLinkDown(ifName, result)
+		}
+		contVeth, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return err
+		}
+		sendGARPs(*contVeth, result, n.GARPCount, n.GARPInterval)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// a repeated ADD gets this result back
+	if err := writeResult(n.StateDir, args, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// needsOFPort tells whether the ADD installs flows matching the container
+// port, which only work once OVS has assigned the port an ofport
+func needsOFPort(n *ovsconf.NetConf) bool {
+	return n.Isolate || n.Meter != nil || n.DSCP != nil || n.Bandwidth != nil ||
+		n.SafeBringup || n.EgressNAT != nil || n.EgressUplink != "" ||
+		len(n.EgressAllow) > 0 || len(n.EgressDeny) > 0 || n.FlowsFile != "" || n.PinFlows
+}
+
+// uplinkName is the port of the bridge the container's traffic leaves
+// through: egressUplink, or else uplinkPort. It is "" on a bridge without an
+// uplink.
+func uplinkName(n *ovsconf.NetConf) string {
+	if n.EgressUplink != "" {
+		return n.EgressUplink
+	}
+	return uplinkPort(n)
+}
+
+// configurePort applies the per-port settings of n to the attachment's port:
+// its external ids, VLAN tag, flows, meter and queue. Each step sets the
+// state rather than adding to it, so the repair mode runs it again. It
+// returns the attachment's flows, which put what they pass on into the
+// port's queue, for the flows installed after it.
+func configurePort(args *skel.CmdArgs, n *ovsconf.NetConf, br *ovs.Switch, port, mac string) (*ovs.Flows, error) {
+	ids := map[string]string{
+		ovs.ContainerIDKey: args.ContainerID,
+		ovs.IfNameKey:      args.IfName,
+		ovs.MACKey:         mac,
+	}
+	if n.PortGroup != "" {
+		ids[ovs.PortGroupKey] = n.PortGroup
+	}
+	if uplink := uplinkName(n); uplink != "" {
+		ids[ovs.UplinkKey] = uplink
+	}
+	if err := br.SetPortExternalIDs(port, ids); err != nil {
+		return nil, err
+	}
+	if n.OFPortTimeout > 0 && needsOFPort(n) {
+		if err := br.WaitOFPort(port, n.OFPortTimeout); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.Vlan != 0 {
+		if err := br.SetPortTag(port, n.Vlan); err != nil {
+			return nil, err
+		}
+	}
+	if n.Protected {
+		if err := br.SetPortProtected(port, true); err != nil {
+			return nil, err
+		}
+	}
+	if n.STP != nil {
+		if err := br.SetPortOtherConfig(port, n.STP.OtherConfig()); err != nil {
+			return nil, err
+		}
+	}
+	// the queue comes first, the flows above its flow need its ID
+	flows := br.Flows(attachmentID(args))
+	if n.Bandwidth != nil {
+		queue, err := br.AddPortQueue(uplinkPort(n), port, attachmentID(args), n.Bandwidth.QoSType, n.Bandwidth.MinRate, n.Bandwidth.MaxRate)
+		if err != nil {
+			return nil, err
+		}
+		flows.SetQueue(queue)
+	}
+	if n.Isolate {
+		if err := flows.IsolatePort(port); err != nil {
+			return nil, err
+		}
+	}
+	var meter uint32
+	if n.Meter != nil {
+		meter = meterID(args)
+		if err := br.AddMeter(meter, n.Meter.Rate, n.Meter.Burst); err != nil {
+			return nil, err
+		}
+		if err := flows.MeterPort(port, meter); err != nil {
+			return nil, err
+		}
+	}
+	if n.DSCP != nil {
+		if err := flows.MarkDSCP(port, *n.DSCP, meter); err != nil {
+			return nil, err
+		}
+	}
+	if len(n.EgressAllow) > 0 || len(n.EgressDeny) > 0 {
+		allow, _ := ovsconf.ParseCIDRs("egressAllow", n.EgressAllow)
+		deny, _ := ovsconf.ParseCIDRs("egressDeny", n.EgressDeny)
+		if err := flows.FilterEgress(port, allow, deny); err != nil {
+			return nil, err
+		}
+	}
+	if n.FlowsFile != "" {
+		tmpl, err := ovs.LoadFlowsTemplate(n.FlowsFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := flows.AddTemplate(tmpl, port, mac, n.Vlan); err != nil {
+			return nil, err
+		}
+	}
+	if n.PinFlows {
+		if err := flows.PinPort(port, mac); err != nil {
+			return nil, err
+		}
+	}
+	return flows, nil
+}
+
+// publishIPs records the addresses of result on the port for controllers
+// reconciling OVS with IPAM
+func publishIPs(br *ovs.Switch, port string, result *current.Result) error {
+	ips := make([]string, 0, len(result.IPs))
+	for _, ipc := range result.IPs {
+		ips = append(ips, ipc.Address.String())
+	}
+	return br.SetPortExternalID(port, ovs.IPsKey, strings.Join(ips, ","))
+}
+
+// cmdDel tears the attachment down. Failing to clean up OVS, e.g. because
+// OVS was uninstalled since the ADD, is logged and recorded for the gc mode
+// rather than failing the DEL, which would keep the pod from being deleted.
+func cmdDel(args *skel.CmdArgs) (err error) {
+	n, _, err := loadNetConf(args)
+	if err != nil {
+		return classify(classConfig, errInvalidConfig, err)
+	}
+	root := startTracing(n.Tracing, "DEL", args)
+	defer func() { finishTracing(root, err) }()
+	if err := checkPrivileges(n); err != nil {
+		return err
+	}
+	if n.OVSBinDir != "" {
+		if err := ovs.SetBinDir(n.OVSBinDir); err != nil {
+			log.Printf("WARNING: %v", err)
+		}
+	}
+	if n.OVSDB != "" {
+		if err := ovs.SetDB(n.OVSDB, n.OVSDBPrivateKey, n.OVSDBCertificate, n.OVSDBCACert); err != nil {
+			log.Printf("WARNING: %v", err)
+		}
+	}
+
+	if n.Verbose {
+		logOVSVersion()
+	}
+
+	sum := &delSummary{
+		ContainerID: args.ContainerID,
+		IfName:      args.IfName,
+		Bridge:      n.BrName,
+	}
+	if n.Verbose {
+		defer sum.log()
+	}
+
+	// e.g. the network switched plugins after the ADD: the DEL is not ours
+	if unmanagedAttachment(args, n) {
+		sum.Unmanaged = true
+		return nil
+	}
+
+	netnsPath, err := delNetns(args.Netns)
+	if err != nil {
+		return err
+	}
+	if netnsPath != args.Netns {
+		a := *args
+		a.Netns = netnsPath
+		args = &a
+	}
+
+	// release the address first, IPAM plugins treat a missing allocation as
+	// already released so a repeated DEL still succeeds
+	if n.IPAM.Type != "" {
+		if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+			return classify(classIPAM, errInternal, fmt.Errorf("failed to release IPAM allocation: %v", err))
+		}
+		sum.IPAMReleased = true
+		if err := removeIPAMCache(n.StateDir, args.ContainerID, args.IfName); err != nil {
+			return err
+		}
+	}
+
+	// a DEL without the lock beats one failing for good
+	if unlock, err := lockBridge(n); err != nil {
+		log.Printf("WARNING: %v", err)
+	} else {
+		defer unlock()
+	}
+
+	// an earlier DEL quarantined the port: while it is there a repeated one
+	// neither cleans it up nor restarts its TTL, that is left to gc
+	if c, err := quarantinedIntent(n.StateDir, args.ContainerID, args.IfName); err != nil {
+		return err
+	} else if c != nil {
+		log.Printf("port %q of %s is quarantined, leaving it to gc", c.Port, attachmentID(args))
+		return nil
+	}
+
+	if n.HostBridgeType == ovsconf.HostBridgeLinux {
+		return delLinuxAttachment(args, n)
+	}
+	if n.PortType == ovsconf.PortTypeMacvlan || n.PortType == ovsconf.PortTypeIPVlan {
+		return delSubLinkAttachment(args, n)
+	}
+
+	br := ovs.OpenSwitch(n.BrName)
+
+	ovsNS, err := openOVSNetNS(n.OVSNetns)
+	if err != nil {
+		return err
+	}
+	defer ovsNS.Close()
+
+	ifName := containerIfName(args, n)
+	var hostIfName, vfName string
+	switch {
+	case n.PortType == ovsconf.PortTypeTap:
+		hostIfName = tapName(args)
+	case n.PortType == ovsconf.PortTypeVF:
+		if err := ovsNS.Do(func(_ ns.NetNS) error {
+			hostIfName, err = vfRepresentor(n.DeviceID)
+			return err
+		}); err != nil {
+			log.Printf("WARNING: %v", err)
+		}
+		if hostIfName != "" {
+			vfName, _ = br.PortExternalID(hostIfName, vfNameKey)
+		}
+	case args.Netns != "":
+		if hostIfName, err = hostVethName(args.Netns, ovsNS, ifName); err != nil {
+			return err
+		}
+	}
+	sum.Port = hostIfName
+
+	// stop new connections and give the established ones time to finish
+	if n.DrainGrace > 0 && hostIfName != "" {
+		if err := drainPort(br, hostIfName, attachmentID(args)); err != nil {
+			log.Printf("WARNING: not draining %s: %v", attachmentID(args), err)
+		} else {
+			sum.Drained = true
+			time.Sleep(time.Duration(n.DrainGrace) * time.Second)
+		}
+	}
+
+	// flows and queues refer to the port's ofport, so finish removes them
+	// before the port
+	c := &cleanupIntent{
+		ContainerID: args.ContainerID,
+		IfName:      args.IfName,
+		Bridge:      br.BridgeName(),
+		OVSNetns:    n.OVSNetns,
+		LockFile:    n.LockFile,
+		Created:     time.Now(),
+		Queue:       n.Bandwidth != nil,
+		Port:        hostIfName,
+	}
+	if n.Meter != nil {
+		c.Meter = meterID(args)
+	}
+	// flows are removed whatever the config says now, it may have changed
+	// since the ADD
+	c.Cookie = ovs.Cookie(attachmentID(args))
+	if n.QuarantineDel && hostIfName != "" {
+		return quarantinePort(args, n, br, c)
+	}
+	ovsErr := c.finish()
+	sum.FlowsRemoved = c.Cookie == 0
+	sum.MeterRemoved = n.Meter != nil && c.Meter == 0
+	sum.QueueRemoved = n.Bandwidth != nil && !c.Queue
+	sum.PortRemoved = hostIfName != "" && c.Port == ""
+
+	if n.PortType == "" || n.PortType == ovsconf.PortTypeVeth {
+		dups, err := removeDuplicatePorts(args, ovsNS, br, n, hostIfName)
+		if err != nil {
+			return err
+		}
+		sum.DuplicatesRemoved = dups
+	}
+
+	if n.PortType == ovsconf.PortTypeVF {
+		if err := releaseVF(args.Netns, ovsNS, ifName, n.DeviceID, vfName); err != nil {
+			return err
+		}
+	} else if args.Netns != "" {
+		// There is a netns so try to clean up. Delete can be called multiple times
+		// so don't return an error if the device is already removed.
+		err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+			_, err := ip.DelLinkByNameAddr(ifName)
+			if err != nil && err == ip.ErrLinkNotFound {
+				return nil
+			}
+			sum.IfaceRemoved = err == nil
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if n.Device != "" && n.PNICVlan != 0 {
+		if err := ovsNS.Do(func(_ ns.NetNS) error {
+			if err := resolveDevice(n); err != nil || n.Device == "" {
+				return err
+			}
+			return releasePNICVlan(br, uplinkPort(n))
+		}); err != nil {
+			log.Printf("WARNING: failed to release VLAN %d of %q: %v", n.PNICVlan, n.Device, err)
+		}
+	} else if n.Device != "" && n.ForceDetachPNIC {
+		if err := ovsNS.Do(func(_ ns.NetNS) error {
+			if err := resolveDevice(n); err != nil || n.Device == "" {
+				return err
+			}
+			return releaseDevice(br, n.Device)
+		}); err != nil {
+			log.Printf("WARNING: failed to release device %q: %v", n.Device, err)
+		}
+	}
+
+	if n.VerifyDel {
+		if err := verifyDel(br, ovsNS, args.Netns, hostIfName, ifName); err != nil {
+			return err
+		}
+	}
+
+	if err := removeResult(n.StateDir, args.ContainerID, args.IfName); err != nil {
+		return err
+	}
+	if n.DebugDir != "" {
+		removeDebugRecord(n.DebugDir, args.ContainerID, args.IfName)
+	}
+
+	if ovsErr != nil {
+		sum.LeftForGC = true
+		log.Printf("WARNING: DEL of %s left OVS resources for gc: %v", attachmentID(args), ovsErr)
+		if err := writeIntent(n.StateDir, c); err != nil {
+			log.Printf("WARNING: DEL of %s: %v", attachmentID(args), err)
+		}
+		return nil
+	}
+
+	// a finished DEL leaves nothing for gc
+	return removeIntent(n.StateDir, args.ContainerID, args.IfName)
+}
+
+// setupEgressNAT masquerades the container's first IPv4 address as the
+// configured external IP or the bridge interface's address, in the
+// container's conntrack zone
+func setupEgressNAT(flows *ovs.Flows, ovsNS ns.NetNS, br *ovs.Switch, port, mac string, result *current.Result, n *ovsconf.NetConf) error {
+	conf := n.EgressNAT
+	var podIP *net.IPNet
+	for _, ipc := range result.IPs {
+		if ipc.Address.IP.To4() != nil {
+			podIP = &ipc.Address
+			break
+		}
+	}
+	if podIP == nil {
+		return fmt.Errorf("egressNAT requires an IPv4 address")
+	}
+
+	externalIP := net.ParseIP(conf.ExternalIP)
+	if externalIP == nil {
+		if err := ovsNS.Do(func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName(br.BridgeName())
+			if err != nil {
+				return fmt.Errorf("failed to lookup bridge interface %q: %v", br.BridgeName(), err)
+			}
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+			if err != nil {
+				return fmt.Errorf("failed to list addresses of %q: %v", br.BridgeName(), err)
+			}
+			if len(addrs) == 0 {
+				return fmt.Errorf("bridge interface %q has no IPv4 address to NAT to, set egressNAT externalIP", br.BridgeName())
+			}
+			externalIP = addrs[0].IP
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return flows.AddEgressNAT(port, podIP, mac, externalIP, n.ConntrackZone())
+}
+
+// steerToUplink makes the container's IP traffic to outside its subnets
+// leave through n.EgressUplink, which has to be a port of br
+func steerToUplink(flows *ovs.Flows, br *ovs.Switch, port string, n *ovsconf.NetConf, result *current.Result) error {
+	bridge, err := ovs.PortBridge(n.EgressUplink)
+	if err != nil {
+		return err
+	}
+	if bridge != br.BridgeName() {
+		return fmt.Errorf("egressUplink %q is not a port of bridge %q", n.EgressUplink, br.BridgeName())
+	}
+	var local []*net.IPNet
+	for _, ipc := range result.IPs {
+		local = append(local, &net.IPNet{IP: ipc.Address.IP.Mask(ipc.Address.Mask), Mask: ipc.Address.Mask})
+	}
+	return flows.SteerToUplink(port, n.EgressUplink, n.Vlan, local)
+}
+
+// drainPort installs the drain flows of port as flows of owner
+func drainPort(br *ovs.Switch, port, owner string) error {
+	mac, err := br.PortExternalID(port, ovs.MACKey)
+	if err != nil {
+		return err
+	}
+	return br.Flows(owner).DrainPort(port, mac)
+}
+
+// verifyDel checks that the host port is gone from the bridge and the
+// container interface from its netns, since a successful ovs-vsctl does not
+// prove the database converged
+func verifyDel(br *ovs.Switch, ovsNS ns.NetNS, netns, hostIfName, ifName string) error {
+	var remains []string
+	if hostIfName != "" {
+		var ports []string
+		if err := ovsNS.Do(func(_ ns.NetNS) error {
+			var err error
+			ports, err = br.ListPorts()
+			return err
+		}); err != nil {
+			return err
+		}
+		for _, port := range ports {
+			if port == hostIfName {
+				remains = append(remains, fmt.Sprintf("port %q on bridge %q", hostIfName, br.BridgeName()))
+			}
+		}
+	}
+	if netns != "" {
+		err := ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+			_, err := netlink.LinkByName(ifName)
+			if err == nil {
+				remains = append(remains, fmt.Sprintf("interface %q in %q", ifName, netns))
+			} else if _, ok := err.(netlink.LinkNotFoundError); !ok {
+				return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+			}
+			return nil
+		})
+		// the netns itself being gone leaves nothing behind
+		if err != nil {
+			if _, ok := err.(ns.NSPathNotExistErr); !ok {
+				return err
+			}
+		}
+	}
+	if len(remains) > 0 {
+		for _, r := range remains {
+			log.Printf("WARNING: %s remained after DEL", r)
+		}
+		return fmt.Errorf("DEL did not remove %s", strings.Join(remains, ", "))
+	}
+	return nil
+}
+
+// modes the binary runs in when invoked by hand rather than by a runtime
+var modes = map[string]func(args []string) error{
+	"list":     cmdList,
+	"tunnels":  cmdTunnels,
+	"stats":    cmdStats,
+	"gc":       cmdGC,
+	"migrate":  cmdMigrate,
+	"repair":   cmdRepair,
+	"check":    cmdCheck,
+	"selftest": cmdSelftest,
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if mode, ok := modes[os.Args[1]]; ok {
+			if err := mode(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	if structuredErrors() {
+		pluginMainStructured(cmdAdd, cmdDel)
+		return
+	}
 	skel.PluginMain(cmdAdd, cmdDel, version.All)
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types/current"
+)
+
+func TestSendGARPs(t *testing.T) {
+	result := &current.Result{IPs: []*current.IPConfig{
+		{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.1.0.5"), Mask: net.CIDRMask(24, 32)}},
+		{Version: "6", Address: net.IPNet{IP: net.ParseIP("fd00::5"), Mask: net.CIDRMask(64, 128)}},
+		{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.2.0.5"), Mask: net.CIDRMask(24, 32)}},
+	}}
+	defer func(orig func(net.IP, net.Interface) error) { sendGARP = orig }(sendGARP)
+
+	tests := []struct {
+		count int
+		want  int
+	}{
+		{0, 0},
+		{1, 2},
+		{3, 6},
+	}
+	for _, tt := range tests {
+		var sent []string
+		sendGARP = func(ip net.IP, iface net.Interface) error {
+			if iface.Name != "eth0" {
+				t.Errorf("sent over %q, want eth0", iface.Name)
+			}
+			sent = append(sent, ip.String())
+			return nil
+		}
+		sendGARPs(net.Interface{Name: "eth0"}, result, tt.count, 0)
+		if len(sent) != tt.want {
+			t.Errorf("count %d: sent %d garps %v, want %d", tt.count, len(sent), sent, tt.want)
+		}
+		for _, ip := range sent {
+			if strings.Contains(ip, ":") {
+				t.Errorf("count %d: sent a garp for IPv6 address %s", tt.count, ip)
+			}
+		}
+	}
+}
+
+func TestPrefixedMAC(t *testing.T) {
+	a := &skel.CmdArgs{ContainerID: "c1", IfName: "eth0"}
+	b := &skel.CmdArgs{ContainerID: "c2", IfName: "eth0"}
+	mac := prefixedMAC(a, "0a:58:0a")
+	if !strings.HasPrefix(mac, "0a:58:0a:") {
+		t.Errorf("prefixedMAC = %s, want prefix 0a:58:0a", mac)
+	}
+	if again := prefixedMAC(a, "0a:58:0a"); again != mac {
+		t.Errorf("prefixedMAC not stable: %s then %s", mac, again)
+	}
+	if other := prefixedMAC(b, "0a:58:0a"); other == mac {
+		t.Errorf("containers c1 and c2 got the same MAC %s", mac)
+	}
+}
+
+func TestStickyMAC(t *testing.T) {
+	pod := "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-0"
+	tests := []struct {
+		name    string
+		args    *skel.CmdArgs
+		prefix  string
+		same    bool
+		wantErr bool
+	}{
+		// a reschedule gets a new container id
+		{"rescheduled", &skel.CmdArgs{ContainerID: "c2", IfName: "eth0", Args: pod}, "", true, false},
+		{"other ifname", &skel.CmdArgs{ContainerID: "c1", IfName: "net1", Args: pod}, "", false, false},
+		{"other pod", &skel.CmdArgs{ContainerID: "c1", IfName: "eth0", Args: "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-1"}, "", false, false},
+		{"no pod name", &skel.CmdArgs{ContainerID: "c1", IfName: "eth0", Args: "K8S_POD_NAMESPACE=default"}, "", false, true},
+	}
+	orig, err := stickyMAC(&skel.CmdArgs{ContainerID: "c1", IfName: "eth0", Args: pod}, "")
+	if err != nil {
+		t.Fatalf("stickyMAC: %v", err)
+	}
+	if mac, _ := net.ParseMAC(orig); mac[0]&0x03 != 0x02 {
+		t.Errorf("stickyMAC = %s, want a locally administered unicast MAC", orig)
+	}
+	for _, tt := range tests {
+		mac, err := stickyMAC(tt.args, tt.prefix)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %s, want an error", tt.name, mac)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if (mac == orig) != tt.same {
+			t.Errorf("%s: stickyMAC = %s, original %s, want same %t", tt.name, mac, orig, tt.same)
+		}
+	}
+
+	prefixed, err := stickyMAC(&skel.CmdArgs{ContainerID: "c1", IfName: "eth0", Args: pod}, "0a:58:0a")
+	if err != nil {
+		t.Fatalf("stickyMAC: %v", err)
+	}
+	if !strings.HasPrefix(prefixed, "0a:58:0a:") || prefixed[9:] != orig[9:] {
+		t.Errorf("stickyMAC with prefix = %s, want 0a:58:0a and the bytes of %s", prefixed, orig)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/linkernetworks/cni/pkg/ovs"
+	"github.com/vishvananda/netlink"
+)
+
+// pnicVlanKey marks the port of a VLAN sub-interface cnie created, which DEL
+// removes again with the last container
+const pnicVlanKey = "cnie-created-vlan"
+
+// pnicVlanName is the name of the sub-interface of parent for vlan
+func pnicVlanName(parent string, vlan int) string {
+	return parent + "." + strconv.Itoa(vlan)
+}
+
+// setupPNICVlan returns the VLAN sub-interface of parent, creating it if it
+// does not exist yet. An existing interface of that name has to be that VLAN
+// of parent.
+func setupPNICVlan(parent string, vlan int) (string, bool, error) {
+	name := pnicVlanName(parent, vlan)
+	// IFNAMSIZ is 16 including the terminating NUL
+	if len(name) > 15 {
+		return "", false, fmt.Errorf("VLAN sub-interface name %q is too long, create it under a shorter name and set it as device", name)
+	}
+	parentLink, err := netlink.LinkByName(parent)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to lookup device %q: %v", parent, err)
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err == nil {
+		v, ok := link.(*netlink.Vlan)
+		if !ok || v.VlanId != vlan || v.ParentIndex != parentLink.Attrs().Index {
+			return "", false, fmt.Errorf("%q exists but is not VLAN %d of %q", name, vlan, parent)
+		}
+		return name, false, nil
+	}
+	if _, ok := err.(netlink.LinkNotFoundError); !ok {
+		return "", false, fmt.Errorf("failed to lookup %q: %v", name, err)
+	}
+
+	v := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        name,
+			ParentIndex: parentLink.Attrs().Index,
+			MTU:         parentLink.Attrs().MTU,
+		},
+		VlanId: vlan,
+	}
+	if err := netlink.LinkAdd(v); err != nil {
+		return "", false, fmt.Errorf("failed to create VLAN %d of %q: %v", vlan, parent, err)
+	}
+	for _, l := range []netlink.Link{parentLink, v} {
+		if err := netlink.LinkSetUp(l); err != nil {
+			netlink.LinkDel(v)
+			return "", false, fmt.Errorf("failed to set %q up: %v", l.Attrs().Name, err)
+		}
+	}
+	log.Printf("created VLAN sub-interface %q", name)
+	return name, true, nil
+}
+
+// releasePNICVlan removes the VLAN sub-interface device from the bridge and
+// deletes it once it is the last port left, if cnie created it
+func releasePNICVlan(br *ovs.Switch, device string) error {
+	created, err := br.PortExternalID(device, pnicVlanKey)
+	if err != nil || created != "true" {
+		return err
+	}
+	ports, err := br.ListPorts()
+	if err != nil {
+		return err
+	}
+	for _, port := range ports {
+		if port != device {
+			return nil
+		}
+	}
+
+	if err := br.DeletePort(device); err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(device)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", device, err)
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("failed to delete %q: %v", device, err)
+	}
+	log.Printf("deleted VLAN sub-interface %q", device)
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+)
+
+// The capabilities cnie needs itself, the OVS tools run through sudo
+var neededCaps = []struct {
+	bit  uint
+	name string
+}{
+	// links, addresses, routes and sysctls
+	{12, "CAP_NET_ADMIN"},
+	// setns into the container netns
+	{21, "CAP_SYS_ADMIN"},
+}
+
+// effectiveCaps returns the effective capability set of the process from
+// /proc/self/status
+func effectiveCaps() (uint64, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse %q: %v", line, err)
+		}
+		return caps, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no CapEff in /proc/self/status")
+}
+
+// checkPrivileges fails early, naming what is missing, when the plugin lacks
+// the capabilities to configure links and enter network namespaces, e.g.
+// when the DaemonSet installing it runs unprivileged. Without the check the
+// ADD or DEL fails deep inside a netlink call with a bare "operation not
+// permitted". capabilityCheck warn only logs it, off skips the check. If
+// the capabilities cannot be read the check passes.
+func checkPrivileges(n *ovsconf.NetConf) error {
+	if n.CapabilityCheck == ovsconf.CapabilityCheckOff {
+		return nil
+	}
+	caps, err := effectiveCaps()
+	if err != nil {
+		log.Printf("WARNING: cannot tell the capabilities of the plugin: %v", err)
+		return nil
+	}
+	var missing []string
+	for _, c := range neededCaps {
+		if caps&(1<<c.bit) == 0 {
+			missing = append(missing, c.name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	err = fmt.Errorf("cnie runs as uid %d without %s, which it needs to configure links and enter network namespaces; run it as root with the capabilities, e.g. from a privileged container",
+		os.Geteuid(), strings.Join(missing, " and "))
+	if n.CapabilityCheck == ovsconf.CapabilityCheckWarn {
+		log.Printf("WARNING: %v", err)
+		return nil
+	}
+	return classify(classRuntime, errInternal, err)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/linkernetworks/cni/pkg/ovs"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+)
+
+// quarantineKey is the port external-id recording when a DEL quarantined
+// the port
+const quarantineKey = "cnie-quarantined"
+
+// quarantinePort is the DEL of quarantineDel: the port and its flows, meter
+// and queue stay on the bridge for inspection, tagged and with everything it
+// sends dropped, and c is recorded for gc to remove them after the
+// quarantine TTL
+func quarantinePort(args *skel.CmdArgs, n *ovsconf.NetConf, br *ovs.Switch, c *cleanupIntent) error {
+	log.Printf("WARNING: quarantineDel is set, DEL of %s leaves port %q on bridge %q for debugging", attachmentID(args), c.Port, br.BridgeName())
+
+	// the address is released, the port must not answer for it anymore
+	if err := br.Flows(attachmentID(args)).BlockPort(c.Port, ""); err != nil {
+		log.Printf("WARNING: quarantined port %q is not blocked: %v", c.Port, err)
+	}
+	if err := br.SetPortExternalID(c.Port, quarantineKey, c.Created.UTC().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	if n.PortType == "" || n.PortType == ovsconf.PortTypeVeth {
+		c.Veth = c.Port
+	}
+	c.Quarantined = true
+	if err := writeIntent(n.StateDir, c); err != nil {
+		return err
+	}
+	return removeResult(n.StateDir, args.ContainerID, args.IfName)
+}
+
+// quarantinedIntent returns the intent of the attachment's quarantined port
+// while the port is still on its bridge and tagged, nil otherwise. If OVS
+// cannot tell, the quarantine is assumed to hold.
+func quarantinedIntent(stateDir, containerID, ifName string) (*cleanupIntent, error) {
+	c, err := readIntent(stateDir, containerID, ifName)
+	if err != nil || c == nil || !c.Quarantined || c.Port == "" {
+		return nil, err
+	}
+	tag, err := ovs.OpenSwitch(c.Bridge).PortExternalID(c.Port, quarantineKey)
+	if err != nil {
+		log.Printf("WARNING: cannot tell whether port %q is still quarantined: %v", c.Port, err)
+		return c, nil
+	}
+	if tag == "" {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// reapQuarantine removes the port, flows, meter and queue a quarantining DEL
+// of an earlier attachment with the same container id and ifName left. The
+// new attachment's flows and queue have the same owner, so they must not be
+// there yet when it is done, and the ADD has to run it before it creates
+// the new port.
+func reapQuarantine(args *skel.CmdArgs, n *ovsconf.NetConf) error {
+	c, err := readIntent(n.StateDir, args.ContainerID, args.IfName)
+	if err != nil || c == nil || !c.Quarantined {
+		return err
+	}
+	// the ADD holds the lock of its own bridge
+	if other := (&ovsconf.NetConf{BrName: c.Bridge, StateDir: n.StateDir, LockFile: c.LockFile}); lockPath(other) != lockPath(n) {
+		unlock, err := lockBridge(other)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	if err := c.finish(); err != nil {
+		if err := writeIntent(n.StateDir, c); err != nil {
+			log.Printf("WARNING: %v", err)
+		}
+		return fmt.Errorf("failed to remove the quarantined port of an earlier %s: %v", attachmentID(args), err)
+	}
+	log.Printf("removed the quarantined port of an earlier %s", attachmentID(args))
+	return removeIntent(n.StateDir, args.ContainerID, args.IfName)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/linkernetworks/cni/pkg/ovs"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+)
+
+// changedConfig returns the config the recorded ADD of the attachment was
+// made with if it differs from the one of this ADD, nil if it is the same or
+// was not recorded. Configs differing only in whitespace or key order are
+// the same. It fails if the change is more than reconfigurePort can apply to
+// the port in place.
+func changedConfig(args *skel.CmdArgs, n *ovsconf.NetConf) (*ovsconf.NetConf, error) {
+	data, err := ioutil.ReadFile(configPath(n.StateDir, args.ContainerID, args.IfName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recorded config: %v", err)
+	}
+	if string(data) == string(args.StdinData) {
+		return nil, nil
+	}
+
+	prev, _, err := ovsconf.LoadNetConf(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse recorded config of %s: %v", attachmentID(args), err)
+	}
+	if err := prev.ApplyEnv(os.Getenv); err != nil {
+		return nil, err
+	}
+	if reflect.DeepEqual(prev, n) {
+		return nil, nil
+	}
+
+	// what is left different once the port settings are taken from n needs
+	// the interface or the bridge to be set up again
+	rest := *prev
+	rest.PortGroup = n.PortGroup
+	rest.Vlan = n.Vlan
+	rest.Isolate = n.Isolate
+	rest.Protected = n.Protected
+	rest.Meter = n.Meter
+	rest.DSCP = n.DSCP
+	rest.Bandwidth = n.Bandwidth
+	rest.EgressUplink = n.EgressUplink
+	rest.EgressAllow = n.EgressAllow
+	rest.EgressDeny = n.EgressDeny
+	rest.EgressNAT = n.EgressNAT
+	rest.CTZone = n.CTZone
+	rest.FlowsFile = n.FlowsFile
+	rest.PinFlows = n.PinFlows
+	rest.STP = n.STP
+	rest.ReconfigureOnChange = n.ReconfigureOnChange
+	if reflect.DeepEqual(&rest, n) {
+		return prev, nil
+	}
+	return nil, fmt.Errorf("%s is already attached and its config changed beyond port settings, DEL it first", attachmentID(args))
+}
+
+// reconfigureAttachment moves the port of the attachment from the settings
+// of prev to those of n: what prev set and n does not is removed, then the
+// port is configured as an ADD with n would. The bridge lock is held.
+func reconfigureAttachment(args *skel.CmdArgs, n, prev *ovsconf.NetConf, result *current.Result) error {
+	if len(result.Interfaces) < 3 {
+		return fmt.Errorf("recorded result of %s has no container interface", attachmentID(args))
+	}
+	mac := result.Interfaces[2].Mac
+
+	ovsNS, err := openOVSNetNS(n.OVSNetns)
+	if err != nil {
+		return err
+	}
+	defer ovsNS.Close()
+	// the uplink external id and the queue go by the device in use
+	if n.Device != "" {
+		if err := ovsNS.Do(func(_ ns.NetNS) error {
+			return resolveDevice(n)
+		}); err != nil {
+			return err
+		}
+	}
+	port, err := findHostPort(args, n, ovsNS)
+	if err != nil {
+		return err
+	}
+	if port == "" {
+		return fmt.Errorf("the host end of %s is gone", attachmentID(args))
+	}
+	br := ovs.OpenSwitch(n.BrName)
+
+	flows := br.Flows(attachmentID(args))
+	if err := flows.Delete(); err != nil {
+		return err
+	}
+	if prev.Meter != nil {
+		if err := br.DeleteMeter(meterID(args)); err != nil {
+			return err
+		}
+	}
+	if prev.Bandwidth != nil {
+		if err := br.DeletePortQueue(port, attachmentID(args)); err != nil {
+			return err
+		}
+	}
+	if prev.Vlan != 0 && n.Vlan == 0 {
+		if err := br.ClearPortTag(port); err != nil {
+			return err
+		}
+	}
+	if prev.Protected && !n.Protected {
+		if err := br.SetPortProtected(port, false); err != nil {
+			return err
+		}
+	}
+	if prev.STP != nil {
+		var keys []string
+		for key := range prev.STP.OtherConfig() {
+			keys = append(keys, key)
+		}
+		if len(keys) > 0 {
+			if err := br.RemovePortOtherConfig(port, keys...); err != nil {
+				return err
+			}
+		}
+	}
+	if prev.PortGroup != "" && n.PortGroup == "" {
+		if err := br.RemovePortExternalID(port, ovs.PortGroupKey); err != nil {
+			return err
+		}
+	}
+	if prev.EgressUplink != "" && uplinkName(n) == "" {
+		if err := br.RemovePortExternalID(port, ovs.UplinkKey); err != nil {
+			return err
+		}
+	}
+
+	flows, err = configurePort(args, n, br, port, mac)
+	if err != nil {
+		return err
+	}
+	if n.EgressNAT != nil {
+		if err := setupEgressNAT(flows, ovsNS, br, port, mac, result, n); err != nil {
+			return err
+		}
+	}
+	if n.EgressUplink != "" {
+		if err := steerToUplink(flows, br, port, n, result); err != nil {
+			return err
+		}
+	}
+	if err := publishIPs(br, port, result); err != nil {
+		return err
+	}
+	log.Printf("port %q of %s reconfigured", port, attachmentID(args))
+	return nil
+}
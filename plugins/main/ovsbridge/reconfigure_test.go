@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+)
+
+func TestChangedConfig(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "cnie-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	conf := func(extra string) []byte {
+		return []byte(`{"cniVersion": "0.3.1", "name": "net", "type": "ovsbridge", "bridge": "br0", "stateDir": "` + stateDir + `"` + extra + `}`)
+	}
+	recorded := conf(`, "vlan": 100`)
+
+	tests := []struct {
+		name     string
+		recorded []byte
+		conf     []byte
+		changed  bool
+		err      string
+	}{
+		{"not recorded", nil, conf(`, "vlan": 100`), false, ""},
+		{"same", recorded, recorded, false, ""},
+		{"reformatted", recorded, []byte(strings.Replace(string(recorded), `, "vlan": 100`, `,
+	"vlan":100`, 1)), false, ""},
+		{"changed vlan", recorded, conf(`, "vlan": 200`), true, ""},
+		{"vlan removed", recorded, conf(``), true, ""},
+		{"changed bridge", recorded, []byte(strings.Replace(string(recorded), `"br0"`, `"br1"`, 1)), false, "changed beyond port settings"},
+		{"changed mtu", recorded, conf(`, "vlan": 100, "mtu": 1400`), false, "changed beyond port settings"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := &skel.CmdArgs{ContainerID: "c1", IfName: "eth0", StdinData: tt.conf}
+			path := configPath(stateDir, args.ContainerID, args.IfName)
+			os.Remove(path)
+			if tt.recorded != nil {
+				if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(path, tt.recorded, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			n, _, err := ovsconf.LoadNetConf(tt.conf)
+			if err != nil {
+				t.Fatalf("LoadNetConf: %v", err)
+			}
+
+			prev, err := changedConfig(args, n)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("changedConfig: %v", err)
+			}
+			if (prev != nil) != tt.changed {
+				t.Fatalf("changedConfig = %v, want changed %t", prev, tt.changed)
+			}
+			if prev != nil && prev.Vlan != 100 {
+				t.Errorf("previous vlan = %d, want 100", prev.Vlan)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/linkernetworks/cni/pkg/ovs"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+)
+
+// cmdRepair sets the OVS side of an attachment up again the way its ADD did,
+// e.g. after OVS restarted with an empty database. It is run as
+// `ovsbridge repair -config net.conf -container-id ID -ifname IF -netns PATH`
+// outside of the CNI protocol. Every step sets state rather than adding to
+// it, so it can be run again. With -dry-run it prints what it would
+// reconcile instead.
+func cmdRepair(args []string) error {
+	flags := flag.NewFlagSet("repair", flag.ContinueOnError)
+	config := flags.String("config", "", "network config the attachment was added with")
+	containerID := flags.String("container-id", "", "container id of the attachment")
+	ifName := flags.String("ifname", "", "interface name the runtime asked for")
+	netns := flags.String("netns", "", "netns path of the container")
+	dryRun := flags.Bool("dry-run", false, "print what repair would reconcile and change nothing")
+	asJSON := flags.Bool("json", false, "with -dry-run, print the drift as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *config == "" || *containerID == "" || *ifName == "" || *netns == "" {
+		return fmt.Errorf("repair: -config, -container-id, -ifname and -netns are required")
+	}
+	data, err := ioutil.ReadFile(*config)
+	if err != nil {
+		return fmt.Errorf("repair: failed to read config: %v", err)
+	}
+	cargs := &skel.CmdArgs{
+		ContainerID: *containerID,
+		Netns:       *netns,
+		IfName:      *ifName,
+		StdinData:   data,
+	}
+	n, _, err := loadNetConf(cargs)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		drifts, err := attachmentDrift(cargs, n)
+		if err != nil {
+			return err
+		}
+		return printDrift(drifts, *asJSON)
+	}
+	return repairAttachment(cargs, n)
+}
+
+// repairAttachment reconciles the bridge, the uplink and the attachment's
+// port, flows and queue with n and the result the ADD recorded
+func repairAttachment(args *skel.CmdArgs, n *ovsconf.NetConf) error {
+	result, err := readResult(n.StateDir, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+	if result == nil || len(result.Interfaces) < 3 {
+		return fmt.Errorf("repair: no ADD of %s recorded under %q", attachmentID(args), n.StateDir)
+	}
+	mac := result.Interfaces[2].Mac
+
+	if n.OVSBinDir != "" {
+		if err := ovs.SetBinDir(n.OVSBinDir); err != nil {
+			return err
+		}
+	}
+	if n.OVSDB != "" {
+		if err := ovs.SetDB(n.OVSDB, n.OVSDBPrivateKey, n.OVSDBCertificate, n.OVSDBCACert); err != nil {
+			return err
+		}
+	}
+	unlock, err := lockBridge(n)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	br, _, err := setupBridge(n)
+	if err != nil {
+		return err
+	}
+	log.Printf("repair: bridge %q configured", n.BrName)
+
+	ovsNS, err := openOVSNetNS(n.OVSNetns)
+	if err != nil {
+		return err
+	}
+	defer ovsNS.Close()
+
+	if n.Device != "" {
+		if err := ovsNS.Do(func(_ ns.NetNS) error {
+			if err := resolveDevice(n); err != nil || n.Device == "" {
+				return err
+			}
+			// with pnicVlan the sub-interface is the port, never the trunk
+			return attachUplink(br, n)
+		}); err != nil {
+			return err
+		}
+		if n.Device != "" {
+			log.Printf("repair: device %q attached", uplinkPort(n))
+		}
+	}
+
+	port, err := findHostPort(args, n, ovsNS)
+	if err != nil {
+		return err
+	}
+	if port == "" {
+		return fmt.Errorf("repair: the container interface of %s is gone, it needs a new ADD", attachmentID(args))
+	}
+	bridge, err := ovs.PortBridge(port)
+	if err != nil {
+		return err
+	}
+	if bridge != n.BrName {
+		// the tap went with its fd when OVS dropped the port
+		if n.PortType == ovsconf.PortTypeTap {
+			return fmt.Errorf("repair: tap %q of %s is gone, it needs a new ADD", port, attachmentID(args))
+		}
+		if bridge != "" {
+			if err := ovs.OpenSwitch(bridge).DeletePort(port); err != nil {
+				return err
+			}
+		}
+		if err := br.AddPort(port); err != nil {
+			return err
+		}
+		log.Printf("repair: port %q reattached to %q", port, n.BrName)
+	}
+
+	// flows of a reattached port refer to its old ofport
+	flows := br.Flows(attachmentID(args))
+	if err := flows.Delete(); err != nil {
+		return err
+	}
+	flows, err = configurePort(args, n, br, port, mac)
+	if err != nil {
+		return err
+	}
+	// configurePort only sets a tag, an untagged config needs one cleared
+	if n.Vlan == 0 {
+		tag, err := br.PortTag(port)
+		if err != nil {
+			return err
+		}
+		if tag != 0 {
+			if err := br.ClearPortTag(port); err != nil {
+				return err
+			}
+		}
+	}
+	if n.EgressNAT != nil {
+		if err := setupEgressNAT(flows, ovsNS, br, port, mac, result, n); err != nil {
+			return err
+		}
+	}
+	if n.EgressUplink != "" {
+		if err := steerToUplink(flows, br, port, n, result); err != nil {
+			return err
+		}
+	}
+	if err := publishIPs(br, port, result); err != nil {
+		return err
+	}
+	log.Printf("repair: external ids, tag, flows and queue of %q reapplied", port)
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/linkernetworks/cni/pkg/ovs"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+	"github.com/vishvananda/netlink"
+)
+
+// An ADD repeated with the same container id, ifname and netns while the
+// attachment it created is still intact is read-only: it prints the result
+// the first ADD recorded and changes nothing, so there is still exactly one
+// port, one veth pair and one IPAM allocation. An attachment that is no
+// longer intact is set up again, replacing what is left of it.
+
+func resultPath(stateDir, containerID, ifName string) string {
+	return filepath.Join(stateDir, "results", containerID+"-"+ifName+".json")
+}
+
+// configPath holds the network config the result was made with, so a
+// repeated ADD can tell whether its config changed
+func configPath(stateDir, containerID, ifName string) string {
+	return filepath.Join(stateDir, "configs", containerID+"-"+ifName+".json")
+}
+
+func writeResult(stateDir string, args *skel.CmdArgs, result *current.Result) error {
+	path := resultPath(stateDir, args.ContainerID, args.IfName)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create %q: %v", filepath.Dir(path), err)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write result %q: %v", path, err)
+	}
+
+	path = configPath(stateDir, args.ContainerID, args.IfName)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create %q: %v", filepath.Dir(path), err)
+	}
+	if err := ioutil.WriteFile(path, args.StdinData, 0600); err != nil {
+		return fmt.Errorf("failed to write config %q: %v", path, err)
+	}
+	return nil
+}
+
+func removeResult(stateDir, containerID, ifName string) error {
+	for _, path := range []string{resultPath(stateDir, containerID, ifName), configPath(stateDir, containerID, ifName)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove result: %v", err)
+		}
+	}
+	return nil
+}
+
+// readResult returns the result the ADD of the attachment recorded, nil if
+// there is none
+func readResult(stateDir, containerID, ifName string) (*current.Result, error) {
+	data, err := ioutil.ReadFile(resultPath(stateDir, containerID, ifName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read result: %v", err)
+	}
+	result := &current.Result{}
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, fmt.Errorf("failed to parse result: %v", err)
+	}
+	return result, nil
+}
+
+// replayAdd returns the result of an earlier ADD of this attachment if the
+// attachment is still intact, nil if the ADD has to be done
+func replayAdd(args *skel.CmdArgs, n *ovsconf.NetConf) (*current.Result, error) {
+	result, err := readResult(n.StateDir, args.ContainerID, args.IfName)
+	if err != nil || result == nil {
+		return nil, err
+	}
+
+	intact, err := attachmentIntact(args, n)
+	if err != nil {
+		return nil, err
+	}
+	if !intact {
+		return nil, removeResult(n.StateDir, args.ContainerID, args.IfName)
+	}
+
+	prev, err := changedConfig(args, n)
+	if err != nil || prev == nil {
+		return result, err
+	}
+	if !n.ReconfigureOnChange {
+		return nil, fmt.Errorf("%s is already attached with another config; DEL it first or set reconfigureOnChange", attachmentID(args))
+	}
+	if err := reconfigureAttachment(args, n, prev, result); err != nil {
+		return nil, err
+	}
+	return result, writeResult(n.StateDir, args, result)
+}
+
+// attachmentIntact tells whether the container interface exists and its
+// host side is a port of the bridge owned by this attachment
+func attachmentIntact(args *skel.CmdArgs, n *ovsconf.NetConf) (bool, error) {
+	ovsNS, err := openOVSNetNS(n.OVSNetns)
+	if err != nil {
+		return false, err
+	}
+	defer ovsNS.Close()
+
+	port, err := findHostPort(args, n, ovsNS)
+	if err != nil || port == "" {
+		return false, nil
+	}
+
+	br := ovs.OpenSwitch(n.BrName)
+	ports, err := br.FindPorts(ovs.ContainerIDKey, args.ContainerID)
+	if err != nil {
+		return false, nil
+	}
+	for _, p := range ports {
+		if p != port {
+			continue
+		}
+		owner, err := br.PortExternalID(p, ovs.IfNameKey)
+		if err != nil {
+			return false, err
+		}
+		return owner == args.IfName, nil
+	}
+	return false, nil
+}
+
+// findHostPort returns the name of the attachment's port on the host side,
+// "" if the container interface is gone
+func findHostPort(args *skel.CmdArgs, n *ovsconf.NetConf, ovsNS ns.NetNS) (string, error) {
+	ifName := containerIfName(args, n)
+	switch n.PortType {
+	case ovsconf.PortTypeTap, ovsconf.PortTypeVF:
+		found := false
+		if err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+			_, lerr := netlink.LinkByName(ifName)
+			found = lerr == nil
+			return nil
+		}); err != nil || !found {
+			return "", err
+		}
+		if n.PortType == ovsconf.PortTypeTap {
+			return tapName(args), nil
+		}
+		var port string
+		err := ovsNS.Do(func(_ ns.NetNS) error {
+			var err error
+			port, err = vfRepresentor(n.DeviceID)
+			return err
+		})
+		return port, err
+	default:
+		return hostVethName(args.Netns, ovsNS, ifName)
+	}
+}
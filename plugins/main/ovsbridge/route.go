@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/vishvananda/netlink"
+)
+
+// configureIface applies result to ifName like ipam.ConfigureIface, with two
+// additions: a gateway outside the configured subnets is made reachable with
+// an on-link host route before routes use it, and a family with a gateway
+// but no default route gets a default route through that gateway.
+func configureIface(ifName string, result *current.Result) error {
+	// let ipam set the link up and add the addresses, routes are added below
+	routes := result.Routes
+	result.Routes = nil
+	err := ipam.ConfigureIface(ifName, result)
+	result.Routes = routes
+	if err != nil {
+		return err
+	}
+
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	v4gw, v6gw := gateways(result.IPs)
+	routes = withDefaultRoutes(result.IPs, routes)
+
+	onLink := map[string]bool{}
+	for _, r := range routes {
+		gw := r.GW
+		if gw == nil {
+			if r.Dst.IP.To4() != nil {
+				gw = v4gw
+			} else {
+				gw = v6gw
+			}
+		}
+		if gw != nil && !onLink[gw.String()] && !inSubnets(gw, result.IPs) {
+			if err := addOnLinkRoute(gw, link); err != nil {
+				return err
+			}
+			onLink[gw.String()] = true
+		}
+		if err := ip.AddRoute(&r.Dst, gw, link); err != nil {
+			// we skip over duplicate routes as we assume the first one wins
+			if !os.IsExist(err) {
+				return fmt.Errorf("failed to add route '%v via %v dev %v': %v", r.Dst, gw, ifName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// gateways returns the first IPv4 and IPv6 gateway of ips
+func gateways(ips []*current.IPConfig) (v4gw, v6gw net.IP) {
+	for _, ipc := range ips {
+		if ipc.Gateway == nil {
+			continue
+		}
+		if ipc.Gateway.To4() != nil && v4gw == nil {
+			v4gw = ipc.Gateway
+		} else if ipc.Gateway.To4() == nil && v6gw == nil {
+			v6gw = ipc.Gateway
+		}
+	}
+	return v4gw, v6gw
+}
+
+// withDefaultRoutes appends a default route through the gateway of each
+// family that has a gateway but no default route in routes
+func withDefaultRoutes(ips []*current.IPConfig, routes []*types.Route) []*types.Route {
+	v4gw, v6gw := gateways(ips)
+	var v4default, v6default bool
+	for _, r := range routes {
+		if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+			if r.Dst.IP.To4() != nil {
+				v4default = true
+			} else {
+				v6default = true
+			}
+		}
+	}
+	if v4gw != nil && !v4default {
+		routes = append(routes, &types.Route{Dst: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}, GW: v4gw})
+	}
+	if v6gw != nil && !v6default {
+		routes = append(routes, &types.Route{Dst: net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}, GW: v6gw})
+	}
+	return routes
+}
+
+// resultRoutes merges the IPAM routes with extra into the routes the
+// container ends up with and the result reports: the first route to a
+// destination wins, and a family with a gateway gets its default route.
+func resultRoutes(ips []*current.IPConfig, ipamRoutes, extra []*types.Route) []*types.Route {
+	var routes []*types.Route
+	seen := map[string]bool{}
+	for _, r := range append(append([]*types.Route{}, ipamRoutes...), extra...) {
+		if dst := r.Dst.String(); !seen[dst] {
+			seen[dst] = true
+			routes = append(routes, r)
+		}
+	}
+	return withDefaultRoutes(ips, routes)
+}
+
+// ipInterfaces points every IP of result at the container interface ifName
+// and checks the result before it is applied: the interface must be listed
+// once, inside the sandbox netnsPath, and no other interface may carry a
+// sandbox, which some runtimes reject for host interfaces. A change to the
+// construction of result.Interfaces fails here with the reason instead of
+// as an invalid interface index.
+func ipInterfaces(result *current.Result, ifName, netnsPath string) error {
+	idx := -1
+	for i, iface := range result.Interfaces {
+		if iface == nil {
+			return fmt.Errorf("result interface %d is missing", i)
+		}
+		if iface.Sandbox == "" {
+			continue
+		}
+		if iface.Name != ifName {
+			return fmt.Errorf("host interface %q is listed in the result with sandbox %q", iface.Name, iface.Sandbox)
+		}
+		if iface.Sandbox != netnsPath {
+			return fmt.Errorf("container interface %q is listed in the result with sandbox %q, not %q", ifName, iface.Sandbox, netnsPath)
+		}
+		if idx >= 0 {
+			return fmt.Errorf("container interface %q is listed twice in the result, at %d and %d", ifName, idx, i)
+		}
+		idx = i
+	}
+	if idx < 0 {
+		return fmt.Errorf("container interface %q is not in the result interfaces", ifName)
+	}
+	for _, ipc := range result.IPs {
+		ipc.Interface = current.Int(idx)
+	}
+	return nil
+}
+
+// inSubnets tells whether addr is inside one of the configured subnets
+func inSubnets(addr net.IP, ips []*current.IPConfig) bool {
+	for _, ipc := range ips {
+		if ipc.Address.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// addOnLinkRoute makes gw reachable on dev without a covering subnet
+func addOnLinkRoute(gw net.IP, dev netlink.Link) error {
+	bits := 128
+	if gw.To4() != nil {
+		bits = 32
+	}
+	err := netlink.RouteAdd(&netlink.Route{
+		LinkIndex: dev.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+		Dst:       &net.IPNet{IP: gw, Mask: net.CIDRMask(bits, bits)},
+	})
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to add on-link route to gateway %v: %v", gw, err)
+	}
+	return nil
+}
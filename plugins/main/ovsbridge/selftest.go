@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/linkernetworks/cni/pkg/ovs"
+	"github.com/vishvananda/netlink"
+)
+
+// selftestStep is one step of a selftest run
+type selftestStep struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	MS    int64  `json:"ms"`
+	Error string `json:"error,omitempty"`
+}
+
+// selftestReport is what selftest prints
+type selftestReport struct {
+	Passed bool           `json:"passed"`
+	Steps  []selftestStep `json:"steps"`
+}
+
+// step runs fn as the step name and records how it went
+func (r *selftestReport) step(name string, fn func() error) bool {
+	start := time.Now()
+	err := fn()
+	s := selftestStep{Name: name, OK: err == nil, MS: int64(time.Since(start) / time.Millisecond)}
+	if err != nil {
+		s.Error = err.Error()
+		r.Passed = false
+	}
+	r.Steps = append(r.Steps, s)
+	return err == nil
+}
+
+// cmdSelftest runs an ADD and a DEL of a container on a scratch bridge and
+// netns, the way a runtime would, and reports each step. It is run as
+// `ovsbridge selftest -run [-cni-path dir] [-json]` outside of the CNI
+// protocol. Since it changes the node it does nothing without -run. The
+// bridge, netns and state it creates are removed whatever failed.
+func cmdSelftest(args []string) error {
+	flags := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	run := flags.Bool("run", false, "create the scratch bridge and netns and run the test")
+	cniPath := flags.String("cni-path", "/opt/cni/bin", "directories holding the static IPAM plugin")
+	address := flags.String("address", "192.0.2.10/24", "address the static IPAM plugin assigns")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	binDir := flags.String("ovs-bin-dir", "", "directory holding ovs-vsctl if it is not in PATH")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if !*run {
+		return fmt.Errorf("selftest: it adds a bridge, a netns and a container port to this node, pass -run to do so")
+	}
+	if *binDir != "" {
+		if err := ovs.SetBinDir(*binDir); err != nil {
+			return err
+		}
+	}
+
+	report := runSelftest(*cniPath, *address, *binDir)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "STEP\tRESULT\tTIME\tERROR")
+		for _, s := range report.Steps {
+			result := "ok"
+			if !s.OK {
+				result = "FAIL"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%dms\t%s\n", s.Name, result, s.MS, s.Error)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if !report.Passed {
+		return fmt.Errorf("selftest failed")
+	}
+	return nil
+}
+
+// runSelftest runs the steps of selftest, cleaning up in any case
+func runSelftest(cniPath, address, binDir string) *selftestReport {
+	r := &selftestReport{Passed: true}
+	id := os.Getpid() % 100000
+	brName := fmt.Sprintf("cnie-st%d", id)
+	nsName := fmt.Sprintf("cnie-selftest-%d", id)
+	containerID := nsName
+
+	if !r.step("ovs-vsctl", func() error {
+		if _, err := ovs.Version(); err != nil {
+			return err
+		}
+		bridges, err := ovs.ListBridges()
+		if err != nil {
+			return err
+		}
+		for _, name := range bridges {
+			if name == brName {
+				return fmt.Errorf("bridge %q exists already, it is not the selftest's to remove", brName)
+			}
+		}
+		return nil
+	}) {
+		return r
+	}
+
+	stateDir, err := ioutil.TempDir("", "cnie-selftest")
+	if !r.step("state dir", func() error { return err }) {
+		return r
+	}
+	defer r.step("remove state dir", func() error { return os.RemoveAll(stateDir) })
+
+	if !r.step("netns", func() error {
+		if out, err := exec.Command("ip", "netns", "add", nsName).CombinedOutput(); err != nil {
+			return fmt.Errorf("ip netns add %s: %v: %s", nsName, err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}) {
+		return r
+	}
+	defer r.step("remove netns", func() error {
+		if out, err := exec.Command("ip", "netns", "del", nsName).CombinedOutput(); err != nil {
+			return fmt.Errorf("ip netns del %s: %v: %s", nsName, err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	})
+	// the ADD creates the bridge, even one that fails half way
+	defer r.step("remove bridge", func() error { return ovs.OpenSwitch(brName).DeleteBridge() })
+
+	conf, err := json.Marshal(map[string]interface{}{
+		"cniVersion": "0.3.1",
+		"name":       "cnie-selftest",
+		"type":       "ovsbridge",
+		"bridge":     brName,
+		"stateDir":   stateDir,
+		"ovsBinDir":  binDir,
+		"ipam": map[string]interface{}{
+			"type":      "static",
+			"addresses": []map[string]string{{"address": address}},
+		},
+	})
+	if !r.step("config", func() error { return err }) {
+		return r
+	}
+	plugin, err := os.Executable()
+	if !r.step("plugin", func() error { return err }) {
+		return r
+	}
+	cargs := func(command string) *invoke.Args {
+		return &invoke.Args{
+			Command:     command,
+			ContainerID: containerID,
+			NetNS:       filepath.Join("/var/run/netns", nsName),
+			IfName:      "eth0",
+			Path:        cniPath,
+		}
+	}
+
+	// DEL runs after a failed ADD too, it must clean up either way
+	defer r.step("del", func() error {
+		return invoke.ExecPluginWithoutResult(plugin, conf, cargs("DEL"))
+	})
+	if !r.step("add", func() error {
+		_, err := invoke.ExecPluginWithResult(plugin, conf, cargs("ADD"))
+		return err
+	}) {
+		return r
+	}
+	var port string
+	if !r.step("attachment", func() error {
+		attachments, err := ovs.ListAttachments()
+		if err != nil {
+			return err
+		}
+		for _, a := range attachments {
+			if a.Bridge == brName && a.ContainerID == containerID {
+				port = a.Port
+				return nil
+			}
+		}
+		return fmt.Errorf("no port of %s on bridge %q after ADD", containerID, brName)
+	}) {
+		return r
+	}
+	r.step("namespaces", func() error {
+		return checkSelftestNamespaces(filepath.Join("/var/run/netns", nsName), "eth0", port, address)
+	})
+	return r
+}
+
+// checkSelftestNamespaces fails unless each step of the ADD landed in its
+// netns: the container interface with address in the container netns, the
+// host veth end in ours, and address on no link of ours. Every netlink call
+// of the ADD has to run in ns.Do of the netns it targets, on a thread of
+// its own, or it changes whatever netns the thread happens to be in.
+func checkSelftestNamespaces(netnsPath, ifName, port, address string) error {
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %v", address, err)
+	}
+	hasAddr := func(link netlink.Link) (bool, error) {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return false, fmt.Errorf("failed to list addresses: %v", err)
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	if err := ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("container interface %q: %v", ifName, err)
+		}
+		found, err := hasAddr(link)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("container interface %q lacks %s", ifName, ip)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if _, err := netlink.LinkByName(port); err != nil {
+		return fmt.Errorf("host end %q is not in the plugin's netns: %v", port, err)
+	}
+	found, err := hasAddr(nil)
+	if err != nil {
+		return err
+	}
+	if found {
+		return fmt.Errorf("%s of the container is configured in the plugin's netns", ip)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/linkernetworks/cni/pkg/ovs"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+	"github.com/vishvananda/netlink"
+)
+
+// handleStalePorts deals with ports a previous ADD of the same container id
+// and ifname left on the bridge, e.g. after a reboot. Under the reuse policy
+// it returns the port whose record the new host end should take over, all
+// other stale ports are removed along with their flows and queue.
+func handleStalePorts(args *skel.CmdArgs, ovsNS ns.NetNS, br *ovs.Switch, n *ovsconf.NetConf) (string, error) {
+	ports, err := br.FindPorts(ovs.ContainerIDKey, args.ContainerID)
+	if err != nil {
+		return "", err
+	}
+
+	var reuse string
+	for _, port := range ports {
+		ifName, err := br.PortExternalID(port, ovs.IfNameKey)
+		if err != nil {
+			return "", err
+		}
+		if ifName != args.IfName {
+			continue
+		}
+		if n.StalePorts == ovsconf.StaleReuse && reuse == "" {
+			matches, err := stalePortMatches(br, port, n)
+			if err != nil {
+				return "", err
+			}
+			if matches {
+				log.Printf("reusing stale port %q of %s", port, attachmentID(args))
+				reuse = port
+				continue
+			}
+		}
+		log.Printf("removing stale port %q of %s", port, attachmentID(args))
+		if err := removeStalePort(args, ovsNS, br, n, port); err != nil {
+			return "", err
+		}
+	}
+
+	// flows of the old attachment refer to an ofport that may change
+	if reuse != "" {
+		if err := br.Flows(attachmentID(args)).Delete(); err != nil {
+			return "", err
+		}
+	}
+	return reuse, nil
+}
+
+// removeDuplicatePorts removes the ports of the attachment other than port,
+// which only a double ADD or an earlier bug leaves behind, and those left
+// when the container is gone and port is "". It returns how many there were.
+func removeDuplicatePorts(args *skel.CmdArgs, ovsNS ns.NetNS, br *ovs.Switch, n *ovsconf.NetConf, port string) (int, error) {
+	ports, err := br.FindPorts(ovs.ContainerIDKey, args.ContainerID)
+	if err != nil {
+		return 0, err
+	}
+	var dups []string
+	for _, p := range ports {
+		if p == port {
+			continue
+		}
+		ifName, err := br.PortExternalID(p, ovs.IfNameKey)
+		if err != nil {
+			return 0, err
+		}
+		if ifName == args.IfName {
+			dups = append(dups, p)
+		}
+	}
+	if len(dups) == 0 {
+		return 0, nil
+	}
+	if port == "" {
+		// the container and the veths went away before the DEL
+		log.Printf("removing ports %v left by %s", dups, attachmentID(args))
+	} else {
+		log.Printf("WARNING: %s has %d more ports %v, an earlier ADD went wrong; removing them", attachmentID(args), len(dups), dups)
+	}
+	for _, p := range dups {
+		if err := removeStalePort(args, ovsNS, br, n, p); err != nil {
+			return 0, err
+		}
+	}
+	return len(dups), nil
+}
+
+// stalePortMatches tells whether the stale port was set up as n would
+func stalePortMatches(br *ovs.Switch, port string, n *ovsconf.NetConf) (bool, error) {
+	tag, err := br.PortTag(port)
+	if err != nil {
+		return false, err
+	}
+	return tag == n.Vlan, nil
+}
+
+// removeStalePort removes the port, its flows and queue and the host veth
+// end if it is still around
+func removeStalePort(args *skel.CmdArgs, ovsNS ns.NetNS, br *ovs.Switch, n *ovsconf.NetConf, port string) error {
+	if err := br.Flows(attachmentID(args)).Delete(); err != nil {
+		return err
+	}
+	if n.Bandwidth != nil {
+		if err := br.DeletePortQueue(port, attachmentID(args)); err != nil {
+			return err
+		}
+	}
+	if err := br.DeletePort(port); err != nil {
+		return err
+	}
+	return ovsNS.Do(func(_ ns.NetNS) error {
+		if err := ip.DelLinkByName(port); err != nil && err != ip.ErrLinkNotFound {
+			return fmt.Errorf("failed to delete stale veth %q: %v", port, err)
+		}
+		return nil
+	})
+}
+
+// renameHostVeth gives the host veth end the name of the stale port it
+// takes over, removing whatever is left of the old device first. It runs in
+// the netns of the bridge.
+func renameHostVeth(name, newName string) error {
+	if err := ip.DelLinkByName(newName); err != nil && err != ip.ErrLinkNotFound {
+		return fmt.Errorf("failed to delete stale veth %q: %v", newName, err)
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", name, err)
+	}
+	if err := netlink.LinkSetDown(link); err != nil {
+		return fmt.Errorf("failed to set %q down: %v", name, err)
+	}
+	if err := netlink.LinkSetName(link, newName); err != nil {
+		return fmt.Errorf("failed to rename %q to %q: %v", name, newName, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to set %q up: %v", newName, err)
+	}
+	return nil
+}
+
+// handleForeignPort looks for an existing veth named ifName in the container
+// whose host end is a port of a bridge other than br. That fails the ADD,
+// unless the policy is reattach: the port and its flows are then removed
+// from the other bridge and the veth deleted, so the ADD can attach a fresh
+// one to br.
+func handleForeignPort(args *skel.CmdArgs, ovsNS ns.NetNS, br *ovs.Switch, ifName string, n *ovsconf.NetConf) error {
+	hostIfName, err := hostVethName(args.Netns, ovsNS, ifName)
+	if err != nil || hostIfName == "" {
+		return err
+	}
+	bridge, err := ovs.PortBridge(hostIfName)
+	if err != nil {
+		return err
+	}
+	if bridge == "" || bridge == br.BridgeName() {
+		return nil
+	}
+	if n.ForeignPort != ovsconf.ForeignPortReattach {
+		return fmt.Errorf("interface %q of the container is attached to bridge %q through port %q, not to %q; set foreignPort to reattach to move it",
+			ifName, bridge, hostIfName, br.BridgeName())
+	}
+
+	log.Printf("reattaching %s from bridge %q to %q", attachmentID(args), bridge, br.BridgeName())
+	other := ovs.OpenSwitch(bridge)
+	if err := other.Flows(attachmentID(args)).Delete(); err != nil {
+		return err
+	}
+	if err := other.DeletePort(hostIfName); err != nil {
+		return err
+	}
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		if err := ip.DelLinkByName(ifName); err != nil && err != ip.ErrLinkNotFound {
+			return fmt.Errorf("failed to delete %q: %v", ifName, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/j-keck/arping"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+	"github.com/vishvananda/netlink"
+)
+
+// subLinkParent returns the pNIC a macvlan or ipvlan is created over. It has
+// to be free: the kernel gives a link to one rx handler, so a pNIC that is
+// already a port of OVS or a Linux bridge cannot take a macvlan or ipvlan.
+func subLinkParent(name string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+	if index := link.Attrs().MasterIndex; index != 0 {
+		master := fmt.Sprintf("index %d", index)
+		if m, err := netlink.LinkByIndex(index); err == nil {
+			master = fmt.Sprintf("%q", m.Attrs().Name)
+		}
+		return nil, fmt.Errorf("device %q is a port of %s, a macvlan or ipvlan needs a device that is not", name, master)
+	}
+	return link, nil
+}
+
+// createSubLink creates the macvlan or ipvlan of n over parent right in
+// netns and renames it to ifName there. The temporary name keeps it from
+// clashing with another container's link while it is in the host netns.
+func createSubLink(netns ns.NetNS, parent netlink.Link, ifName string, n *ovsconf.NetConf) (*current.Interface, error) {
+	tmpName, err := ip.RandomVethName()
+	if err != nil {
+		return nil, err
+	}
+	attrs := netlink.LinkAttrs{
+		Name:        tmpName,
+		MTU:         n.MTU,
+		ParentIndex: parent.Attrs().Index,
+		Namespace:   netlink.NsFd(int(netns.Fd())),
+	}
+	var link netlink.Link
+	switch n.PortType {
+	case ovsconf.PortTypeMacvlan:
+		if n.MAC != "" {
+			// validated by LoadNetConf
+			attrs.HardwareAddr, _ = net.ParseMAC(n.MAC)
+		}
+		link = &netlink.Macvlan{LinkAttrs: attrs, Mode: netlink.MACVLAN_MODE_BRIDGE}
+	case ovsconf.PortTypeIPVlan:
+		link = &netlink.IPVlan{LinkAttrs: attrs, Mode: netlink.IPVLAN_MODE_L2}
+	}
+	if err := netlink.LinkAdd(link); err != nil {
+		return nil, fmt.Errorf("failed to create %s over %q: %v", n.PortType, parent.Attrs().Name, err)
+	}
+
+	contIface := &current.Interface{Name: ifName, Sandbox: netns.Path()}
+	if err := netns.Do(func(_ ns.NetNS) error {
+		if err := ip.RenameLink(tmpName, ifName); err != nil {
+			_ = ip.DelLinkByName(tmpName)
+			return fmt.Errorf("failed to rename %s %q to %q: %v", n.PortType, tmpName, ifName, err)
+		}
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", ifName, err)
+		}
+		contIface.Mac = link.Attrs().HardwareAddr.String()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return contIface, nil
+}
+
+// addSubLinkResult is the ADD of portType macvlan and ipvlan: the container
+// interface is created over n.Device and talks to the network through it
+// directly, so neither the bridge nor any of the OVS port settings apply.
+// addResult holds the bridge lock.
+func addSubLinkResult(args *skel.CmdArgs, n *ovsconf.NetConf) (_ *current.Result, err error) {
+	hostNS, err := openOVSNetNS(n.OVSNetns)
+	if err != nil {
+		return nil, err
+	}
+	defer hostNS.Close()
+
+	var parent netlink.Link
+	if err := hostNS.Do(func(_ ns.NetNS) error {
+		parent, err = subLinkParent(n.Device)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	parentInterface := &current.Interface{Name: n.Device, Mac: parent.Attrs().HardwareAddr.String()}
+
+	netns, err := openNetNS(args.Netns)
+	if err != nil {
+		return nil, err
+	}
+	defer netns.Close()
+
+	if err := assignMAC(args, n); err != nil {
+		return nil, err
+	}
+	ifName := containerIfName(args, n)
+	if _, err := handleIfNameCollision(netns, ifName, n); err != nil {
+		return nil, err
+	}
+	var containerInterface *current.Interface
+	if err := hostNS.Do(func(_ ns.NetNS) error {
+		containerInterface, err = createSubLink(netns, parent, ifName, n)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	// from here on a failed ADD removes what it created
+	ipamDone := false
+	defer func() {
+		if err == nil {
+			return
+		}
+		// a cached allocation is kept for the retry
+		if ipamDone && !n.IPAMCache {
+			if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+				log.Printf("rollback of %s failed to release IPAM allocation: %v", attachmentID(args), err)
+			}
+		}
+		if err := netns.Do(func(_ ns.NetNS) error {
+			return ip.DelLinkByName(ifName)
+		}); err != nil && err != ip.ErrLinkNotFound {
+			log.Printf("rollback of %s failed to delete %q: %v", attachmentID(args), ifName, err)
+		}
+	}()
+
+	result, err := execIPAM(args, n)
+	if err != nil {
+		return nil, err
+	}
+	ipamDone = true
+	if len(result.IPs) == 0 {
+		return nil, errors.New("IPAM plugin returned missing IP config")
+	}
+	result.Routes = resultRoutes(result.IPs, result.Routes, n.RuntimeConfig.Routes)
+	result.Interfaces = []*current.Interface{parentInterface, containerInterface}
+	if err := ipInterfaces(result, ifName, args.Netns); err != nil {
+		return nil, err
+	}
+
+	if err := netns.Do(func(_ ns.NetNS) error {
+		if n.SetupLoopback {
+			if err := setupLoopback(); err != nil {
+				return err
+			}
+		}
+		if err := configureIface(ifName, result); err != nil {
+			return err
+		}
+		if len(n.Neighbors) > 0 {
+			if err := addNeighbors(ifName, n.Neighbors); err != nil {
+				return err
+			}
+		}
+		contIface, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return err
+		}
+		for _, ipc := range result.IPs {
+			if ipc.Version == "4" {
+				_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contIface)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// delSubLinkAttachment is the DEL of portType macvlan and ipvlan after the
+// IPAM release. Only the container has a link to remove; one that is not of
+// the configured type was not created by this attachment and is left alone.
+func delSubLinkAttachment(args *skel.CmdArgs, n *ovsconf.NetConf) error {
+	if args.Netns == "" {
+		return nil
+	}
+	ifName := containerIfName(args, n)
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		if link.Type() != n.PortType {
+			log.Printf("WARNING: not deleting %q, it is a %s and not a %s", ifName, link.Type(), n.PortType)
+			return nil
+		}
+		if err := netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete %q: %v", ifName, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"log/syslog"
+	"os"
+
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+)
+
+// syslogTag is what the plugin's syslog messages are tagged with
+const syslogTag = "cnie"
+
+// syslogWriter sends each log line to syslog at warning severity if it is
+// a warning and at info severity otherwise
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+func (s syslogWriter) Write(p []byte) (int, error) {
+	msg := string(bytes.TrimRight(p, "\n"))
+	var err error
+	if bytes.Contains(p, []byte("WARNING: ")) {
+		err = s.w.Warning(msg)
+	} else {
+		err = s.w.Info(msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// setupSyslog points the log at syslog as conf says. Stdout carries the CNI
+// result, so the log never goes there. If syslog cannot be reached the log
+// stays on stderr.
+func setupSyslog(conf *ovsconf.SyslogConf) {
+	facility := syslog.LOG_LOCAL0
+	if conf.Facility != "" {
+		// validated by LoadNetConf
+		facility += syslog.Priority(conf.Facility[5]-'0') << 3
+	}
+	w, err := syslog.New(facility|syslog.LOG_INFO, syslogTag)
+	if err != nil {
+		log.Printf("WARNING: failed to connect to syslog, logging to stderr: %v", err)
+		return
+	}
+	var out io.Writer = syslogWriter{w}
+	if !conf.Only {
+		out = io.MultiWriter(os.Stderr, out)
+	}
+	log.SetOutput(out)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/linkernetworks/cni/pkg/ovs"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+	"github.com/vishvananda/netlink"
+)
+
+// tapName is the OVS port name of the attachment's tap, it is derived from
+// the attachment so DEL finds it without a veth peer to follow
+func tapName(args *skel.CmdArgs) string {
+	return "tap" + fmt.Sprintf("%016x", attachmentHash(args))[:12]
+}
+
+// setupTap attaches the container through an OVS internal port, which the
+// netdev datapath backs with a tap. The tap is moved into the container and
+// renamed to ifName, OVS keeps reading and writing it through its tap fd.
+func setupTap(args *skel.CmdArgs, netns, ovsNS ns.NetNS, br *ovs.Switch, ifName string, n *ovsconf.NetConf) (*current.Interface, *current.Interface, error) {
+	name := tapName(args)
+	if err := br.AddInternalPort(name); err != nil {
+		return nil, nil, fmt.Errorf("failed to add tap %q to bridge %v: %v", name, br.BridgeName(), err)
+	}
+
+	contIface, err := moveTap(netns, ovsNS, name, ifName, n)
+	if err != nil {
+		// the tap goes away with its port
+		if delErr := br.DeletePort(name); delErr != nil {
+			return nil, nil, fmt.Errorf("%v, and failed to remove it: %v", err, delErr)
+		}
+		return nil, nil, err
+	}
+	return &current.Interface{Name: name}, contIface, nil
+}
+
+// moveTap moves the tap from ovsNS into netns and configures it there
+func moveTap(netns, ovsNS ns.NetNS, name, ifName string, n *ovsconf.NetConf) (*current.Interface, error) {
+	if err := ovsNS.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to lookup tap %q: %v", name, err)
+		}
+		if err := netlink.LinkSetNsFd(link, int(netns.Fd())); err != nil {
+			return fmt.Errorf("failed to move tap %q to %q: %v", name, netns.Path(), err)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	contIface := &current.Interface{}
+	err := netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to lookup tap %q: %v", name, err)
+		}
+		if err := netlink.LinkSetName(link, ifName); err != nil {
+			return fmt.Errorf("failed to rename tap %q to %q: %v", name, ifName, err)
+		}
+		if n.MTU > 0 {
+			if err := netlink.LinkSetMTU(link, n.MTU); err != nil {
+				return fmt.Errorf("failed to set MTU %d on %q: %v", n.MTU, ifName, err)
+			}
+		}
+		if n.MAC != "" {
+			mac, _ := net.ParseMAC(n.MAC)
+			if err := setHardwareAddr(ifName, mac); err != nil {
+				return err
+			}
+		}
+		if n.TxQueueLen > 0 {
+			if err := setTxQueueLen(ifName, n.TxQueueLen); err != nil {
+				return err
+			}
+		}
+		if len(n.OffloadFeatures) > 0 {
+			if err := setOffloads(ifName, n.OffloadFeatures); err != nil {
+				return err
+			}
+		}
+		if link, err = netlink.LinkByName(ifName); err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		contIface.Name = ifName
+		contIface.Mac = link.Attrs().HardwareAddr.String()
+		contIface.Sandbox = netns.Path()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return contIface, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/linkernetworks/cni/pkg/ovs"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+)
+
+// With tracing an invocation records a span for itself and, under it, for
+// IPAM, the bridge and veth setup and every OVS tool run, and exports them
+// to the collector in OTLP/HTTP JSON once it is done. Tracing fails open:
+// an export that fails or times out is logged and never changes the
+// invocation's outcome.
+
+// tracer collects the spans of one invocation
+type tracer struct {
+	conf    *ovsconf.TracingConf
+	traceID string
+
+	mu    sync.Mutex
+	spans []*span
+	// open are the spans not ended yet, innermost last
+	open []*span
+}
+
+// span is one timed step of an invocation
+type span struct {
+	t      *tracer
+	id     string
+	parent string
+	name   string
+	start  time.Time
+	end    time.Time
+	attrs  map[string]string
+	err    error
+}
+
+// tracing is the tracer of the running invocation, nil without tracing
+var tracing *tracer
+
+// startTracing starts the trace of the invocation op of args as conf says
+// and returns its root span. Without conf it returns nil, whose methods do
+// nothing.
+func startTracing(conf *ovsconf.TracingConf, op string, args *skel.CmdArgs) *span {
+	if conf == nil {
+		return nil
+	}
+	tracing = &tracer{conf: conf, traceID: randomID(16)}
+	ovs.SetObserver(func(cmd string, args []string, start time.Time, err error) {
+		s := tracing.startAt(cmd+" "+firstCommand(args), start)
+		s.attrs["ovs.args"] = strings.Join(args, " ")
+		s.finish(err)
+	})
+	root := tracing.startAt(op, time.Now())
+	root.attrs["cni.containerID"] = args.ContainerID
+	root.attrs["cni.ifName"] = args.IfName
+	root.attrs["cni.netns"] = args.Netns
+	return root
+}
+
+// startSpan starts a span under the innermost open one, nil without tracing
+func startSpan(name string) *span {
+	if tracing == nil {
+		return nil
+	}
+	return tracing.startAt(name, time.Now())
+}
+
+func (t *tracer) startAt(name string, start time.Time) *span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &span{t: t, id: randomID(8), name: name, start: start, attrs: map[string]string{}}
+	if len(t.open) > 0 {
+		s.parent = t.open[len(t.open)-1].id
+	}
+	t.spans = append(t.spans, s)
+	t.open = append(t.open, s)
+	return s
+}
+
+// finish ends the span, failed if err is set
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.end = time.Now()
+	s.err = err
+	for i := len(s.t.open) - 1; i >= 0; i-- {
+		if s.t.open[i] == s {
+			s.t.open = append(s.t.open[:i], s.t.open[i+1:]...)
+			break
+		}
+	}
+}
+
+// finishTracing ends the root span with err and exports the trace, then
+// stops tracing
+func finishTracing(root *span, err error) {
+	if root == nil {
+		return
+	}
+	root.finish(err)
+	ovs.SetObserver(nil)
+	t := tracing
+	tracing = nil
+	if err := t.export(); err != nil {
+		log.Printf("WARNING: failed to export trace %s: %v", t.traceID, err)
+	}
+}
+
+// otlpValue, otlpAttr and otlpSpan are the OTLP/JSON encoding of
+// opentelemetry-proto's trace messages
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	// Code is 1 for ok, 2 for error
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       otlpStatus `json:"status"`
+}
+
+// payload is the ExportTraceServiceRequest of the trace
+func (t *tracer) payload() ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	spans := make([]otlpSpan, 0, len(t.spans))
+	for _, s := range t.spans {
+		end := s.end
+		// left open by a panic or an early return
+		if end.IsZero() {
+			end = time.Now()
+		}
+		o := otlpSpan{
+			TraceID:      t.traceID,
+			SpanID:       s.id,
+			ParentSpanID: s.parent,
+			Name:         s.name,
+			// SPAN_KIND_INTERNAL
+			Kind:   1,
+			Start:  strconv.FormatInt(s.start.UnixNano(), 10),
+			End:    strconv.FormatInt(end.UnixNano(), 10),
+			Status: otlpStatus{Code: 1},
+		}
+		for _, key := range sortedAttrKeys(s.attrs) {
+			o.Attributes = append(o.Attributes, otlpAttr{Key: key, Value: otlpValue{s.attrs[key]}})
+		}
+		if s.err != nil {
+			o.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		spans = append(spans, o)
+	}
+
+	service := t.conf.ServiceName
+	if service == "" {
+		service = "cnie"
+	}
+	req := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttr{{Key: "service.name", Value: otlpValue{service}}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/linkernetworks/cni/plugins/main/ovsbridge"},
+				"spans": spans,
+			}},
+		}},
+	}
+	return json.Marshal(req)
+}
+
+// export posts the trace to the collector
+func (t *tracer) export() error {
+	data, err := t.payload()
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(t.conf.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(t.conf.Endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector %q answered %s", t.conf.Endpoint, resp.Status)
+	}
+	return nil
+}
+
+// firstCommand is the first argument of an OVS tool run that is not an
+// option, e.g. add-port
+func firstCommand(args []string) string {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			return arg
+		}
+	}
+	return ""
+}
+
+func sortedAttrKeys(attrs map[string]string) []string {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// randomID is n random bytes in hex, a trace id with 16 and a span id with 8
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// ids only need to be unique within the collector
+		binary.BigEndian.PutUint64(b[n-8:], uint64(time.Now().UnixNano()))
+	}
+	return hex.EncodeToString(b)
+}
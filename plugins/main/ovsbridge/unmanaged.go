@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/linkernetworks/cni/pkg/ovs"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+)
+
+// unmanagedAttachment tells whether cnie never configured the attachment:
+// no port of any bridge carries its container id and ifname, and stateDir
+// holds no result, cached IPAM allocation or cleanup intent for it. The
+// ADD tags the port before it runs IPAM, so an attachment without a port
+// has no address to release either. Any doubt, such as OVS not answering,
+// counts as managed.
+func unmanagedAttachment(args *skel.CmdArgs, n *ovsconf.NetConf) bool {
+	// these keep no external ids on OVS
+	if n.HostBridgeType == ovsconf.HostBridgeLinux || n.PortType == ovsconf.PortTypeMacvlan || n.PortType == ovsconf.PortTypeIPVlan {
+		return false
+	}
+	for _, path := range []string{
+		resultPath(n.StateDir, args.ContainerID, args.IfName),
+		ipamCachePath(n.StateDir, args.ContainerID, args.IfName),
+		intentPath(n.StateDir, args.ContainerID, args.IfName),
+	} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			return false
+		}
+	}
+	attachments, err := ovs.ListAttachments()
+	if err != nil {
+		return false
+	}
+	for _, a := range attachments {
+		if a.ContainerID == args.ContainerID && a.IfName == args.IfName {
+			return false
+		}
+	}
+	return true
+}
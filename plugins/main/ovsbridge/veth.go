@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// vethRetryDelay is the pause before the first retry of a transient veth
+// creation failure, doubled on every further one
+const vethRetryDelay = 10 * time.Millisecond
+
+// randomVethName returns prefix followed by 8 random hex digits
+func randomVethName(prefix string) (string, error) {
+	entropy := make([]byte, 4)
+	if _, err := rand.Reader.Read(entropy); err != nil {
+		return "", fmt.Errorf("failed to generate random veth name: %v", err)
+	}
+	return fmt.Sprintf("%s%x", prefix, entropy), nil
+}
+
+// transientLinkErr tells netlink errors worth retrying the same request for
+func transientLinkErr(err error) bool {
+	switch err {
+	case syscall.EBUSY, syscall.EAGAIN, syscall.EINTR, syscall.ENOBUFS:
+		return true
+	}
+	return false
+}
+
+// setupVethPair is ip.SetupVeth with a configurable host name prefix. Unlike
+// ip.SetupVeth it also picks a new host name when the generated one already
+// exists in hostNS rather than only in the container, and retries transient
+// failures, both up to tries times. Call it from inside the container netns.
+func setupVethPair(contVethName, prefix string, mtu, tries int, hostNS ns.NetNS) (net.Interface, net.Interface, error) {
+	var hostVethName string
+	var contVeth netlink.Link
+	delay := vethRetryDelay
+	for i := 0; ; i++ {
+		name, err := randomVethName(prefix)
+		if err != nil {
+			return net.Interface{}, net.Interface{}, err
+		}
+		veth := &netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:  contVethName,
+				Flags: net.FlagUp,
+				MTU:   mtu,
+			},
+			PeerName: name,
+		}
+		err = netlink.LinkAdd(veth)
+		if err == nil {
+			hostVethName = name
+			break
+		}
+		switch {
+		case os.IsExist(err):
+			// a clash of the container name is not going away by retrying
+			if link, lerr := netlink.LinkByName(contVethName); lerr == nil {
+				return net.Interface{}, net.Interface{}, fmt.Errorf("container interface %q already exists (%s, index %d), probably left over from an earlier ADD of this container; DEL that attachment or remove the interface first",
+					contVethName, link.Type(), link.Attrs().Index)
+			}
+			if i >= tries {
+				return net.Interface{}, net.Interface{}, fmt.Errorf("failed to find a unique host veth name with prefix %q in %d tries, last tried %q", prefix, i+1, name)
+			}
+		case transientLinkErr(err):
+			if i >= tries {
+				return net.Interface{}, net.Interface{}, fmt.Errorf("failed to make veth pair after %d tries: %v", i+1, err)
+			}
+			time.Sleep(delay)
+			delay *= 2
+		default:
+			return net.Interface{}, net.Interface{}, fmt.Errorf("failed to make veth pair: %v", err)
+		}
+	}
+
+	contVeth, err := netlink.LinkByName(contVethName)
+	if err != nil {
+		return net.Interface{}, net.Interface{}, fmt.Errorf("failed to lookup %q: %v", contVethName, err)
+	}
+	if err := netlink.LinkSetUp(contVeth); err != nil {
+		return net.Interface{}, net.Interface{}, fmt.Errorf("failed to set %q up: %v", contVethName, err)
+	}
+
+	// the name is only known to be free in the container, rename the host
+	// end until the move into hostNS does not clash
+	for i := 0; ; i++ {
+		hostVeth, err := netlink.LinkByName(hostVethName)
+		if err != nil {
+			return net.Interface{}, net.Interface{}, fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+		}
+		err = netlink.LinkSetNsFd(hostVeth, int(hostNS.Fd()))
+		if err == nil {
+			break
+		}
+		if err != syscall.EEXIST || i >= tries {
+			netlink.LinkDel(contVeth)
+			return net.Interface{}, net.Interface{}, fmt.Errorf("failed to move veth to host netns: %v", err)
+		}
+		name, err := randomVethName(prefix)
+		if err != nil {
+			netlink.LinkDel(contVeth)
+			return net.Interface{}, net.Interface{}, err
+		}
+		if err := netlink.LinkSetName(hostVeth, name); err != nil {
+			netlink.LinkDel(contVeth)
+			return net.Interface{}, net.Interface{}, fmt.Errorf("failed to rename %q to %q: %v", hostVethName, name, err)
+		}
+		hostVethName = name
+	}
+
+	var hostVeth netlink.Link
+	err = hostNS.Do(func(_ ns.NetNS) error {
+		hostVeth, err = netlink.LinkByName(hostVethName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q in %q: %v", hostVethName, hostNS.Path(), err)
+		}
+		if err = netlink.LinkSetUp(hostVeth); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", hostVethName, err)
+		}
+		return nil
+	})
+	if err != nil {
+		netlink.LinkDel(contVeth)
+		return net.Interface{}, net.Interface{}, err
+	}
+	return ifaceFromLink(hostVeth), ifaceFromLink(contVeth), nil
+}
+
+func ifaceFromLink(l netlink.Link) net.Interface {
+	a := l.Attrs()
+	return net.Interface{
+		Index:        a.Index,
+		MTU:          a.MTU,
+		Name:         a.Name,
+		HardwareAddr: a.HardwareAddr,
+		Flags:        a.Flags,
+	}
+}
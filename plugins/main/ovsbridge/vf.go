@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/linkernetworks/cni/pkg/ovs"
+	"github.com/linkernetworks/cni/pkg/ovsconf"
+	"github.com/vishvananda/netlink"
+)
+
+// vfNameKey is the port external-id recording the name the VF netdev had
+// before it was moved into the container
+const vfNameKey = "cnie-vf-name"
+
+// sysfsRoot is where sysfs is mounted
+var sysfsRoot = "/sys"
+
+// pciNetdev returns the netdev name of the PCI device in the current netns
+func pciNetdev(pciAddr string) (string, error) {
+	dir := filepath.Join(sysfsRoot, "bus/pci/devices", pciAddr, "net")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read netdevs of %s: %v", pciAddr, err)
+	}
+	if len(entries) != 1 {
+		return "", fmt.Errorf("%s has %d netdevs, want 1", pciAddr, len(entries))
+	}
+	return entries[0].Name(), nil
+}
+
+// vfRepresentor returns the switchdev representor of the VF at pciAddr: the
+// netdev sharing the phys_switch_id of the VF's PF whose phys_port_name
+// names the VF index, e.g. pf0vf3 or 3
+func vfRepresentor(pciAddr string) (string, error) {
+	dev := filepath.Join(sysfsRoot, "bus/pci/devices", pciAddr)
+	pf, err := filepath.EvalSymlinks(filepath.Join(dev, "physfn"))
+	if err != nil {
+		return "", fmt.Errorf("%s is not an SR-IOV VF: %v", pciAddr, err)
+	}
+
+	index := -1
+	virtfns, _ := filepath.Glob(filepath.Join(pf, "virtfn*"))
+	for _, virtfn := range virtfns {
+		target, err := filepath.EvalSymlinks(virtfn)
+		if err != nil || filepath.Base(target) != pciAddr {
+			continue
+		}
+		fmt.Sscanf(filepath.Base(virtfn), "virtfn%d", &index)
+	}
+	if index < 0 {
+		return "", fmt.Errorf("failed to find the VF index of %s", pciAddr)
+	}
+
+	pfNetdevs, err := ioutil.ReadDir(filepath.Join(pf, "net"))
+	if err != nil || len(pfNetdevs) == 0 {
+		return "", fmt.Errorf("failed to find the PF netdev of %s", pciAddr)
+	}
+	switchID, err := ioutil.ReadFile(filepath.Join(pf, "net", pfNetdevs[0].Name(), "phys_switch_id"))
+	if err != nil {
+		return "", fmt.Errorf("PF of %s is not in switchdev mode: %v", pciAddr, err)
+	}
+
+	netdevs, err := ioutil.ReadDir(filepath.Join(sysfsRoot, "class/net"))
+	if err != nil {
+		return "", fmt.Errorf("failed to list netdevs: %v", err)
+	}
+	for _, netdev := range netdevs {
+		base := filepath.Join(sysfsRoot, "class/net", netdev.Name())
+		id, err := ioutil.ReadFile(filepath.Join(base, "phys_switch_id"))
+		if err != nil || strings.TrimSpace(string(id)) != strings.TrimSpace(string(switchID)) {
+			continue
+		}
+		portName, err := ioutil.ReadFile(filepath.Join(base, "phys_port_name"))
+		if err != nil {
+			continue
+		}
+		name := strings.TrimSpace(string(portName))
+		if name == fmt.Sprint(index) || strings.HasSuffix(name, fmt.Sprintf("vf%d", index)) {
+			return netdev.Name(), nil
+		}
+	}
+	return "", fmt.Errorf("failed to find the representor of VF %d of %s", index, pciAddr)
+}
+
+// setupVF moves the VF the device plugin allocated into the container as
+// ifName and connects its representor to the bridge. The VF and its
+// representor are looked up in the netns of the bridge.
+func setupVF(netns, ovsNS ns.NetNS, br *ovs.Switch, ifName string, n *ovsconf.NetConf) (*current.Interface, *current.Interface, error) {
+	var vfName, repName string
+	if err := ovsNS.Do(func(_ ns.NetNS) error {
+		var err error
+		if vfName, err = pciNetdev(n.DeviceID); err != nil {
+			return err
+		}
+		if repName, err = vfRepresentor(n.DeviceID); err != nil {
+			return err
+		}
+		vf, err := netlink.LinkByName(vfName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup VF %q: %v", vfName, err)
+		}
+		if err := netlink.LinkSetNsFd(vf, int(netns.Fd())); err != nil {
+			return fmt.Errorf("failed to move VF %q to %q: %v", vfName, netns.Path(), err)
+		}
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	contIface := &current.Interface{}
+	err := netns.Do(func(_ ns.NetNS) error {
+		vf, err := netlink.LinkByName(vfName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup VF %q: %v", vfName, err)
+		}
+		if err := netlink.LinkSetName(vf, ifName); err != nil {
+			return fmt.Errorf("failed to rename VF %q to %q: %v", vfName, ifName, err)
+		}
+		if n.MTU > 0 {
+			if err := netlink.LinkSetMTU(vf, n.MTU); err != nil {
+				return fmt.Errorf("failed to set MTU %d on %q: %v", n.MTU, ifName, err)
+			}
+		}
+		if n.MAC != "" {
+			mac, _ := net.ParseMAC(n.MAC)
+			if err := setHardwareAddr(ifName, mac); err != nil {
+				return err
+			}
+		}
+		if vf, err = netlink.LinkByName(ifName); err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		if err := netlink.LinkSetUp(vf); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", ifName, err)
+		}
+		contIface.Name = ifName
+		contIface.Mac = vf.Attrs().HardwareAddr.String()
+		contIface.Sandbox = netns.Path()
+		return nil
+	})
+	if err == nil {
+		err = ovsNS.Do(func(_ ns.NetNS) error {
+			rep, err := netlink.LinkByName(repName)
+			if err != nil {
+				return fmt.Errorf("failed to lookup representor %q: %v", repName, err)
+			}
+			return netlink.LinkSetUp(rep)
+		})
+	}
+	portAdded := false
+	if err == nil {
+		err = br.AddPort(repName)
+		portAdded = err == nil
+	}
+	if err == nil {
+		err = br.SetPortExternalID(repName, vfNameKey, vfName)
+	}
+	if err != nil {
+		if portAdded {
+			if err := br.DeletePort(repName); err != nil {
+				log.Printf("WARNING: failed to remove representor port %q: %v", repName, err)
+			}
+		}
+		releaseVF(netns.Path(), ovsNS, ifName, n.DeviceID, vfName)
+		return nil, nil, err
+	}
+	return &current.Interface{Name: repName}, contIface, nil
+}
+
+// releaseVF gives the VF back to the netns of the bridge under the name it
+// had before. In the container it is ifName, or still vfName when an ADD
+// failed to rename it. A VF whose container netns is already gone was
+// returned by the kernel and only gets its name back.
+func releaseVF(netnsPath string, ovsNS ns.NetNS, ifName, pciAddr, vfName string) error {
+	if netnsPath != "" {
+		err := ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+			vf, err := netlink.LinkByName(ifName)
+			if err != nil && vfName != "" {
+				vf, err = netlink.LinkByName(vfName)
+			}
+			if err != nil {
+				// already gone from the container
+				return nil
+			}
+			name := vf.Attrs().Name
+			if err := netlink.LinkSetDown(vf); err != nil {
+				return fmt.Errorf("failed to set %q down: %v", name, err)
+			}
+			if err := netlink.LinkSetNsFd(vf, int(ovsNS.Fd())); err != nil {
+				return fmt.Errorf("failed to move VF %q out of %q: %v", name, netnsPath, err)
+			}
+			return nil
+		})
+		if err != nil {
+			if _, ok := err.(ns.NSPathNotExistErr); !ok {
+				return err
+			}
+		}
+	}
+	if vfName == "" {
+		return nil
+	}
+	return ovsNS.Do(func(_ ns.NetNS) error {
+		current, err := pciNetdev(pciAddr)
+		if err != nil || current == vfName {
+			return nil
+		}
+		vf, err := netlink.LinkByName(current)
+		if err != nil {
+			return fmt.Errorf("failed to lookup VF %q: %v", current, err)
+		}
+		if err := netlink.LinkSetDown(vf); err != nil {
+			return fmt.Errorf("failed to set %q down: %v", current, err)
+		}
+		if err := netlink.LinkSetName(vf, vfName); err != nil {
+			return fmt.Errorf("failed to rename VF %q to %q: %v", current, vfName, err)
+		}
+		return nil
+	})
+}